@@ -0,0 +1,133 @@
+package flex
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Backend is implemented by the drivers the daemon uses to manage
+// containers. Containers are always referred to by name, and operations
+// on a container that isn't defined must fail with ErrNoSuchContainer.
+type Backend interface {
+	// Create defines a new container and unpacks or downloads its root
+	// filesystem, as described by opts.
+	Create(name string, opts CreateOptions) error
+
+	Start(name string) error
+	Stop(name string) error
+	Reboot(name string) error
+	Destroy(name string) error
+
+	// Configure applies config, which holds container configuration
+	// keys already validated, and devices to the named container. It
+	// takes effect when the container is next started.
+	Configure(name string, config map[string]string, devices map[string]Device) error
+
+	// UpdateLimits applies the limits.* keys in config, which holds the
+	// whole container configuration, to the running container. Limits
+	// missing from config are lifted.
+	UpdateLimits(name string, config map[string]string) error
+
+	// AddDevice makes the device dev, named devname, available to the
+	// running container. It fails with ErrHotplugUnsupported if that
+	// can only happen when the container is next started.
+	AddDevice(name string, devname string, dev Device) error
+
+	// RemoveDevice takes away the device dev, named devname, from the
+	// running container, or fails with ErrHotplugUnsupported like
+	// AddDevice.
+	RemoveDevice(name string, devname string, dev Device) error
+
+	// List returns the names of all defined containers.
+	List() ([]string, error)
+
+	// State returns the state of the named container, such as
+	// "RUNNING" or "STOPPED".
+	State(name string) (string, error)
+
+	// RuntimeState returns the state of the named container, along
+	// with the details of its processes and resource usage if it runs.
+	RuntimeState(name string) (*ContainerState, error)
+
+	// Attach runs a command inside the named container and returns
+	// its exit status once it finishes. Commands killed by a signal
+	// exit with status 128 plus the signal number.
+	Attach(name string, argv []string, opts AttachOptions) (int, error)
+
+	// PackRootfs writes the root filesystem of the named container,
+	// which must be stopped, or the one in its snapshot if snapshot
+	// isn't empty, into tw under rootfs/, with its files owned by the
+	// ids seen from within the container.
+	PackRootfs(name string, snapshot string, tw *tar.Writer) error
+
+	// Snapshot takes a snapshot of the root filesystem and backend
+	// configuration of the named container, which must be stopped,
+	// and returns the name the backend knows the snapshot by.
+	Snapshot(name string) (string, error)
+
+	// RestoreSnapshot replaces the root filesystem and backend
+	// configuration of the named container, which must be stopped,
+	// with those in its snapshot.
+	RestoreSnapshot(name string, snapshot string) error
+
+	// DeleteSnapshot removes the snapshot of the named container.
+	DeleteSnapshot(name string, snapshot string) error
+
+	// Checkpoint dumps the state of the running container into dir.
+	Checkpoint(name string, dir string, stop bool, verbose bool) error
+
+	// Restore resumes the container from a dump previously made into
+	// dir by Checkpoint.
+	Restore(name string, dir string, verbose bool) error
+}
+
+// CreateOptions holds the details of the image a container is created from.
+type CreateOptions struct {
+	// Image holds the path of the image tarball in the store to unpack
+	// the container from. If empty, the root filesystem is downloaded
+	// instead.
+	Image string
+
+	Distro  string
+	Release string
+	Arch    string
+}
+
+// AttachOptions holds the environment for a command run inside a container.
+type AttachOptions struct {
+	Stdin  *os.File
+	Stdout *os.File
+	Stderr *os.File
+
+	// Env holds the environment variables of the command, in the
+	// "KEY=VALUE" form. No other variables are set.
+	Env []string
+
+	// Cwd holds the working directory of the command inside the
+	// container. If empty, it's the root directory.
+	Cwd string
+
+	// Signals delivers signals to be sent to the command while it runs.
+	Signals <-chan os.Signal
+}
+
+var (
+	ErrNoSuchContainer = errors.New("no such container")
+	ErrContainerExists = errors.New("container already exists")
+	ErrNoSuchSnapshot  = errors.New("no such snapshot")
+
+	ErrHotplugUnsupported = errors.New("device cannot be changed while the container runs")
+)
+
+// newBackend returns the backend selected by the provided configuration.
+func newBackend(config *Config, lxcpath string) (Backend, error) {
+	switch config.Backend {
+	case "", "lxc":
+		return newLXCBackend(lxcpath)
+	case "fake":
+		return newFakeBackend(lxcpath)
+	}
+	return nil, fmt.Errorf("unknown backend: %q", config.Backend)
+}
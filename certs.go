@@ -0,0 +1,479 @@
+package flex
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CertificateInfo describes a client certificate trusted by the daemon.
+type CertificateInfo struct {
+	Fingerprint string `json:"fingerprint"`
+
+	// Certificate holds the PEM encoded certificate.
+	Certificate string `json:"certificate"`
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of cert in hexadecimal.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseCert parses a PEM encoded certificate.
+func ParseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("cannot find PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate: %v", err)
+	}
+	return cert, nil
+}
+
+func encodeCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// generateCert creates a new self-signed certificate and its key, and writes
+// them PEM encoded into certf and keyf.
+func generateCert(certf string, keyf string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("cannot generate key: %v", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("cannot generate serial number: %v", err)
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"flex"},
+			CommonName:   hostname,
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("cannot create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("cannot marshal key: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(certf), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyf, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write key: %v", err)
+	}
+	err = ioutil.WriteFile(certf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write certificate: %v", err)
+	}
+	return nil
+}
+
+// loadCert reads the certificate and key at certf and keyf, generating them
+// first if they don't exist yet.
+func loadCert(certf string, keyf string) (tls.Certificate, error) {
+	if _, err := os.Stat(certf); os.IsNotExist(err) {
+		Logf("generating certificate %s", certf)
+		err := generateCert(certf, keyf)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certf, keyf)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot load certificate: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot parse certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// clientCertPath returns the path of the file named name in the directory
+// holding the client certificate and key.
+func clientCertPath(name string) string {
+	return filepath.Join(filepath.Dir(os.ExpandEnv(configPath)), name)
+}
+
+// loadClientCert returns the certificate the client presents to remote
+// daemons, generating it on first use.
+func loadClientCert() (tls.Certificate, error) {
+	return loadCert(clientCertPath("client.crt"), clientCertPath("client.key"))
+}
+
+// ClientCert returns the certificate the client presents to remote daemons,
+// which must be trusted by them for requests to be accepted. It's generated
+// on first use.
+func ClientCert() (*x509.Certificate, error) {
+	cert, err := loadClientCert()
+	if err != nil {
+		return nil, err
+	}
+	return cert.Leaf, nil
+}
+
+// trustedCertPath returns the path in the daemon trust store for the
+// certificate with the provided fingerprint.
+func trustedCertPath(fingerprint string) string {
+	return varPath("clientcerts", fingerprint+".crt")
+}
+
+// loadTrustedCerts reads the certificates in the daemon trust store.
+func (d *Daemon) loadTrustedCerts() error {
+	d.certsMu.Lock()
+	defer d.certsMu.Unlock()
+	d.certs = make(map[string]*x509.Certificate)
+	entries, err := ioutil.ReadDir(varPath("clientcerts"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read trusted certificates: %v", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".crt") {
+			continue
+		}
+		data, err := ioutil.ReadFile(varPath("clientcerts", entry.Name()))
+		if err != nil {
+			return fmt.Errorf("cannot read trusted certificate: %v", err)
+		}
+		cert, err := ParseCert(data)
+		if err != nil {
+			Logf("ignoring trusted certificate %s: %v", entry.Name(), err)
+			continue
+		}
+		d.certs[CertFingerprint(cert)] = cert
+	}
+	return nil
+}
+
+// trustCert adds cert to the daemon trust store.
+func (d *Daemon) trustCert(cert *x509.Certificate) error {
+	fingerprint := CertFingerprint(cert)
+	err := os.MkdirAll(varPath("clientcerts"), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(trustedCertPath(fingerprint), encodeCert(cert), 0600)
+	if err != nil {
+		return err
+	}
+	d.certsMu.Lock()
+	d.certs[fingerprint] = cert
+	d.certsMu.Unlock()
+	return nil
+}
+
+// isTrusted returns whether the request r may be served. Requests over the
+// unix socket are always trusted, while requests over TLS must have been
+// made with a client certificate in the trust store. Only the leaf
+// certificate counts, as the chain isn't verified and the client only
+// proves it holds the key of the leaf.
+func (d *Daemon) isTrusted(r *http.Request) bool {
+	if r.TLS == nil {
+		return true
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	d.certsMu.Lock()
+	defer d.certsMu.Unlock()
+	_, ok := d.certs[CertFingerprint(r.TLS.PeerCertificates[0])]
+	return ok
+}
+
+// RemoteCert connects to the daemon listening on addr and returns the
+// certificate it presents, without verifying it.
+func RemoteCert(addr string) (*x509.Certificate, error) {
+	cert, err := loadClientCert()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: clientDialTimeout}, "tcp", addr, &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("daemon at %s presented no certificate", addr)
+	}
+	return certs[0], nil
+}
+
+// setTrustPassword defines the password which allows a single client to add
+// its own certificate to the trust store. An empty password disables that.
+func (d *Daemon) setTrustPassword(password string) error {
+	d.certsMu.Lock()
+	defer d.certsMu.Unlock()
+	if password == "" {
+		err := os.Remove(varPath("trust-password"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	data := hex.EncodeToString(salt) + ":" + hex.EncodeToString(hashPassword(salt, password))
+	return ioutil.WriteFile(varPath("trust-password"), []byte(data), 0600)
+}
+
+// Clients that provide an invalid trust password must wait for
+// trustPasswordDelay before trying again from the same host, and for twice
+// as long after every further consecutive failure, up to
+// trustPasswordMaxDelay.
+var (
+	trustPasswordDelay    = time.Second
+	trustPasswordMaxDelay = 5 * time.Minute
+)
+
+// trustFailure records the consecutive invalid trust passwords provided
+// from a host.
+type trustFailure struct {
+	count int
+	until time.Time
+}
+
+// useTrustPassword returns whether password, provided from host, matches
+// the trust password, which is then discarded so that it may not be used
+// again. If host provided an invalid password too recently, the password
+// isn't checked, and the time left until it may be is returned instead.
+func (d *Daemon) useTrustPassword(host string, password string) (ok bool, retry time.Duration, err error) {
+	d.certsMu.Lock()
+	defer d.certsMu.Unlock()
+	now := time.Now()
+	failure := d.trustFailures[host]
+	if failure != nil && now.Before(failure.until) {
+		return false, failure.until.Sub(now), nil
+	}
+	ok, err = d.matchTrustPassword(password)
+	if err != nil {
+		return false, 0, err
+	}
+	if ok {
+		delete(d.trustFailures, host)
+		return true, 0, nil
+	}
+
+	// Forget about hosts which haven't failed for a while.
+	for h, f := range d.trustFailures {
+		if now.Sub(f.until) > trustPasswordMaxDelay {
+			delete(d.trustFailures, h)
+		}
+	}
+	if d.trustFailures[host] == nil {
+		d.trustFailures[host] = &trustFailure{}
+	}
+	failure = d.trustFailures[host]
+	delay := trustPasswordDelay
+	for i := 0; i < failure.count && delay < trustPasswordMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > trustPasswordMaxDelay {
+		delay = trustPasswordMaxDelay
+	}
+	failure.count++
+	failure.until = now.Add(delay)
+	return false, 0, nil
+}
+
+// matchTrustPassword returns whether password matches the trust password,
+// and discards it if so. It must be called with d.certsMu held.
+func (d *Daemon) matchTrustPassword(password string) (bool, error) {
+	data, err := ioutil.ReadFile(varPath("trust-password"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+	if len(fields) != 2 {
+		return false, fmt.Errorf("invalid trust password file")
+	}
+	salt, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid trust password file")
+	}
+	hash, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return false, fmt.Errorf("invalid trust password file")
+	}
+	if subtle.ConstantTimeCompare(hash, hashPassword(salt, password)) != 1 {
+		return false, nil
+	}
+	return true, os.Remove(varPath("trust-password"))
+}
+
+func hashPassword(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func (d *Daemon) serveCertificates(r *http.Request) response {
+	res := &resource{get: d.certificatesGet, post: d.certificatesPost}
+	return res.serve(r)
+}
+
+// serveCertificate serves /1.0/certificates/<fingerprint>.
+func (d *Daemon) serveCertificate(r *http.Request) response {
+	res := &resource{delete: d.certificateDelete}
+	return res.serve(r)
+}
+
+func (d *Daemon) serveTrustPassword(r *http.Request) response {
+	res := &resource{put: d.trustPasswordPut}
+	return res.serve(r)
+}
+
+var errUntrusted = errorf(http.StatusForbidden, "client certificate not trusted")
+
+func (d *Daemon) certificatesGet(r *http.Request) response {
+	if !d.isTrusted(r) {
+		return errUntrusted
+	}
+	d.certsMu.Lock()
+	result := make([]*CertificateInfo, 0, len(d.certs))
+	for fingerprint, cert := range d.certs {
+		result = append(result, &CertificateInfo{fingerprint, string(encodeCert(cert))})
+	}
+	d.certsMu.Unlock()
+	return &syncResponse{result}
+}
+
+type certificatesPostReq struct {
+	Certificate string `json:"certificate"`
+	Password    string `json:"password"`
+}
+
+// certificatesPost adds a certificate to the trust store. Trusted clients
+// may add any certificate, while untrusted clients connected over TLS may
+// add the certificate they presented if they provide the trust password.
+func (d *Daemon) certificatesPost(r *http.Request) response {
+	var req certificatesPostReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+
+	var cert *x509.Certificate
+	if req.Certificate != "" {
+		if !d.isTrusted(r) {
+			return errUntrusted
+		}
+		var err error
+		cert, err = ParseCert([]byte(req.Certificate))
+		if err != nil {
+			return badRequest("%v", err)
+		}
+	} else {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return badRequest("missing certificate")
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ok, retry, err := d.useTrustPassword(host, req.Password)
+		if err != nil {
+			return internalError("cannot check trust password: %v", err)
+		}
+		if retry > 0 {
+			return errorf(http.StatusTooManyRequests, "too many invalid trust passwords; try again in %ds", (retry+time.Second-1)/time.Second)
+		}
+		if !ok {
+			Logf("invalid trust password from %s", host)
+			return errorf(http.StatusForbidden, "invalid trust password")
+		}
+		cert = r.TLS.PeerCertificates[0]
+	}
+
+	err := d.trustCert(cert)
+	if err != nil {
+		return internalError("cannot add trusted certificate: %v", err)
+	}
+	return &syncResponse{CertFingerprint(cert)}
+}
+
+func (d *Daemon) certificateDelete(r *http.Request) response {
+	if !d.isTrusted(r) {
+		return errUntrusted
+	}
+	fingerprint := strings.TrimPrefix(r.URL.Path, "/1.0/certificates/")
+	d.certsMu.Lock()
+	_, ok := d.certs[fingerprint]
+	delete(d.certs, fingerprint)
+	d.certsMu.Unlock()
+	if !ok {
+		return notFound("certificate %q not found", fingerprint)
+	}
+	err := os.Remove(trustedCertPath(fingerprint))
+	if err != nil {
+		return internalError("cannot remove trusted certificate: %v", err)
+	}
+	return emptySyncResponse
+}
+
+type trustPasswordPutReq struct {
+	Password string `json:"password"`
+}
+
+func (d *Daemon) trustPasswordPut(r *http.Request) response {
+	var req trustPasswordPutReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	err := d.setTrustPassword(req.Password)
+	if err != nil {
+		return internalError("cannot set trust password: %v", err)
+	}
+	return emptySyncResponse
+}
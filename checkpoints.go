@@ -0,0 +1,491 @@
+package flex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckpointInfo describes a dump of the state of a running container,
+// which the container may be restored from.
+type CheckpointInfo struct {
+	// ID identifies the checkpoint among those of the container. Ids
+	// increase with every checkpoint taken.
+	ID int `json:"id"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// Size is the disk space taken by the dump, in bytes.
+	Size int64 `json:"size"`
+}
+
+var errNoSuchCheckpoint = errors.New("no such checkpoint")
+
+// defaultCheckpointRetain is how many checkpoints of a container are kept
+// when checkpoint.retain isn't set.
+const defaultCheckpointRetain = 5
+
+// Checkpoints of a container are kept in checkpoints/<name>/<id>, along
+// with their details in checkpointInfoFile within the directory.
+const checkpointInfoFile = "checkpoint.json"
+
+// checkpointNextFile holds the id of the next checkpoint of a container,
+// in checkpoints/<name>, so that ids of deleted checkpoints aren't handed
+// out again.
+const checkpointNextFile = "next"
+
+// checkpointDir returns the directory holding the checkpoint of the named
+// container with the provided id.
+func checkpointDir(name string, id int) string {
+	return varPath("checkpoints", name, strconv.Itoa(id))
+}
+
+// checkpointIDs returns the ids of the checkpoints of the named container,
+// in increasing order.
+func checkpointIDs(name string) ([]int, error) {
+	infos, err := ioutil.ReadDir(varPath("checkpoints", name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, fi := range infos {
+		id, err := strconv.Atoi(fi.Name())
+		if err != nil || id < 0 || !fi.IsDir() {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// readCheckpoint returns the details of the checkpoint of the named
+// container with the provided id, or errNoSuchCheckpoint if there's none.
+// Checkpoints copied from elsewhere without their details have them worked
+// out from the dump.
+func readCheckpoint(name string, id int) (*CheckpointInfo, error) {
+	path := checkpointDir(name, id)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) || err == nil && !fi.IsDir() {
+		return nil, errNoSuchCheckpoint
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &CheckpointInfo{ID: id}
+	data, err := ioutil.ReadFile(filepath.Join(path, checkpointInfoFile))
+	if err == nil {
+		err = json.Unmarshal(data, info)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse details of checkpoint %d of container %q: %v", id, name, err)
+		}
+		info.ID = id
+		return info, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	info.CreatedAt = fi.ModTime().UTC()
+	info.Size, err = dirSize(path)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// dirSize returns the total size of the files within dir, in bytes.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// listCheckpoints returns the details of the checkpoints of the named
+// container, in the order they were taken.
+func listCheckpoints(name string) ([]*CheckpointInfo, error) {
+	ids, err := checkpointIDs(name)
+	if err != nil {
+		return nil, err
+	}
+	result := []*CheckpointInfo{}
+	for _, id := range ids {
+		info, err := readCheckpoint(name, id)
+		if err == errNoSuchCheckpoint {
+			// Deleted meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// newCheckpointDir creates the directory for a new checkpoint of the named
+// container, with an id above those of all its previous checkpoints, and
+// returns the id.
+func (d *Daemon) newCheckpointDir(name string) (int, error) {
+	d.checkpointsMu.Lock()
+	defer d.checkpointsMu.Unlock()
+
+	dir := varPath("checkpoints", name)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create checkpoint directory: %v", err)
+	}
+	nextPath := filepath.Join(dir, checkpointNextFile)
+	id := 0
+	data, err := ioutil.ReadFile(nextPath)
+	if err == nil {
+		id, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || id < 0 {
+			return 0, fmt.Errorf("invalid checkpoint id in %s: %q", nextPath, data)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	// Checkpoints may have been copied from elsewhere.
+	ids, err := checkpointIDs(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 && ids[len(ids)-1] >= id {
+		id = ids[len(ids)-1] + 1
+	}
+	for {
+		err := os.Mkdir(checkpointDir(name, id), 0700)
+		if os.IsExist(err) {
+			id++
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot create checkpoint directory: %v", err)
+		}
+		break
+	}
+
+	err = ioutil.WriteFile(nextPath+".new", []byte(strconv.Itoa(id+1)+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(nextPath+".new", nextPath)
+	}
+	if err != nil {
+		os.Remove(nextPath + ".new")
+		os.Remove(checkpointDir(name, id))
+		return 0, fmt.Errorf("cannot record next checkpoint id: %v", err)
+	}
+	return id, nil
+}
+
+// takeCheckpoint dumps the state of the named running container into a new
+// checkpoint, stopping the container afterwards if stop is set, and prunes
+// the checkpoints beyond those that are to be retained.
+func (d *Daemon) takeCheckpoint(op *operation, name string, stop bool, verbose bool) (*CheckpointInfo, error) {
+	id, err := d.newCheckpointDir(name)
+	if err != nil {
+		return nil, err
+	}
+	path := checkpointDir(name, id)
+
+	op.progress("dumping container state")
+	d.beginChange(name)
+	err = d.backend.Checkpoint(name, path, stop, verbose)
+	d.endChange(name, "checkpointed", err)
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+
+	info := &CheckpointInfo{ID: id, CreatedAt: time.Now().UTC()}
+	info.Size, err = dirSize(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(path, checkpointInfoFile), data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.pruneCheckpoints(name); err != nil {
+		Logf("cannot prune checkpoints of container %q: %v", name, err)
+	}
+	return info, nil
+}
+
+// pruneCheckpoints removes the oldest checkpoints of the named container
+// beyond the number set in its checkpoint.retain configuration key, or
+// defaultCheckpointRetain if it's not set. Zero retains all checkpoints.
+func (d *Daemon) pruneCheckpoints(name string) error {
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return err
+	}
+	info := &ContainerInfo{}
+	err = d.fillConfig(rec, info)
+	if err != nil {
+		return err
+	}
+	retain := defaultCheckpointRetain
+	if value, ok := info.ExpandedConfig["checkpoint.retain"]; ok {
+		retain, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for checkpoint.retain: %q", value)
+		}
+	}
+	if retain == 0 {
+		return nil
+	}
+	ids, err := checkpointIDs(name)
+	if err != nil {
+		return err
+	}
+	for len(ids) > retain {
+		Debugf("pruning checkpoint %d of container %q", ids[0], name)
+		err := os.RemoveAll(checkpointDir(name, ids[0]))
+		if err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// checkpointError returns the error response appropriate for err, which was
+// obtained while trying to perform action on the checkpoint of the named
+// container with the provided id.
+func checkpointError(name string, id string, action string, err error) response {
+	switch err {
+	case ErrNoSuchContainer:
+		return notFound("container %q not found", name)
+	case errNoSuchCheckpoint:
+		return notFound("checkpoint %q of container %q not found", id, name)
+	}
+	return internalError("cannot %s checkpoint %q of container %q: %v", action, id, name, err)
+}
+
+// parseCheckpointID returns the checkpoint id in s, or errNoSuchCheckpoint
+// if it's not a valid one.
+func parseCheckpointID(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 || strconv.Itoa(id) != s {
+		return 0, errNoSuchCheckpoint
+	}
+	return id, nil
+}
+
+// checkpointPath splits the path of a request under
+// /1.0/containers/<name>/checkpoints/ into the container name, the
+// checkpoint id and the path of the resource within the checkpoint, if any.
+func checkpointPath(r *http.Request) (name string, id string, sub string) {
+	name, sub = containerPath(r)
+	elems := strings.SplitN(strings.TrimPrefix(sub, "checkpoints/"), "/", 2)
+	if len(elems) == 2 {
+		return name, elems[0], elems[1]
+	}
+	return name, elems[0], ""
+}
+
+// serveCheckpoint serves the resources under
+// /1.0/containers/<name>/checkpoints/<id>.
+func (d *Daemon) serveCheckpoint(r *http.Request) response {
+	name, id, sub := checkpointPath(r)
+	if id == "" {
+		return notFound("missing checkpoint id in %s", r.URL.Path)
+	}
+	var res *resource
+	switch sub {
+	case "":
+		res = &resource{get: d.checkpointGet, delete: d.checkpointDelete}
+	case "restore":
+		res = &resource{post: d.checkpointRestore}
+	default:
+		return notFound("unknown resource %q of checkpoint %q of container %q", sub, id, name)
+	}
+	return res.serve(r)
+}
+
+func (d *Daemon) containerCheckpointsGet(r *http.Request) response {
+	name, _ := containerPath(r)
+	if resp := d.checkContainer(name, "inspect"); resp != nil {
+		return resp
+	}
+	checkpoints, err := listCheckpoints(name)
+	if err != nil {
+		return internalError("cannot list checkpoints of container %q: %v", name, err)
+	}
+	return &syncResponse{checkpoints}
+}
+
+// containerCheckpointsPostReq holds the options for taking a checkpoint.
+// The container is stopped once its state is dumped if Stop is set.
+type containerCheckpointsPostReq struct {
+	Stop    bool `json:"stop"`
+	Verbose bool `json:"verbose"`
+}
+
+// containerCheckpointsPost dumps the state of a running container into a
+// new checkpoint. The details of the checkpoint are the result of the
+// operation.
+func (d *Daemon) containerCheckpointsPost(r *http.Request) response {
+	name, _ := containerPath(r)
+
+	var req containerCheckpointsPostReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if resp := d.checkContainer(name, "checkpoint"); resp != nil {
+		return resp
+	}
+	return d.startOperation(fmt.Sprintf("checkpoint %s", name), false, func(op *operation) (interface{}, error) {
+		info, err := d.takeCheckpoint(op, name, req.Stop, req.Verbose)
+		if err != nil {
+			return nil, fmt.Errorf("cannot checkpoint container %q: %v", name, err)
+		}
+		return info, nil
+	})
+}
+
+func (d *Daemon) checkpointGet(r *http.Request) response {
+	name, idstr, _ := checkpointPath(r)
+	if resp := d.checkContainer(name, "inspect"); resp != nil {
+		return resp
+	}
+	id, err := parseCheckpointID(idstr)
+	if err != nil {
+		return checkpointError(name, idstr, "inspect", err)
+	}
+	info, err := readCheckpoint(name, id)
+	if err != nil {
+		return checkpointError(name, idstr, "inspect", err)
+	}
+	return &syncResponse{info}
+}
+
+func (d *Daemon) checkpointDelete(r *http.Request) response {
+	name, idstr, _ := checkpointPath(r)
+	if resp := d.checkContainer(name, "delete"); resp != nil {
+		return resp
+	}
+	id, err := parseCheckpointID(idstr)
+	if err == nil {
+		_, err = readCheckpoint(name, id)
+	}
+	if err == nil {
+		err = os.RemoveAll(checkpointDir(name, id))
+	}
+	if err != nil {
+		return checkpointError(name, idstr, "delete", err)
+	}
+	return emptySyncResponse
+}
+
+// checkpointRestoreReq holds the options for restoring a checkpoint.
+type checkpointRestoreReq struct {
+	Verbose bool `json:"verbose"`
+}
+
+// checkpointRestore resumes a stopped container from its checkpoint.
+func (d *Daemon) checkpointRestore(r *http.Request) response {
+	name, idstr, _ := checkpointPath(r)
+
+	var req checkpointRestoreReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if resp := d.checkContainer(name, "restore"); resp != nil {
+		return resp
+	}
+	id, err := parseCheckpointID(idstr)
+	if err == nil {
+		_, err = readCheckpoint(name, id)
+	}
+	if err != nil {
+		return checkpointError(name, idstr, "restore", err)
+	}
+	return d.startOperation(fmt.Sprintf("restore %s from checkpoint %d", name, id), false, func(op *operation) (interface{}, error) {
+		op.progress("restoring container state")
+		err := d.restoreCheckpoint(name, id, req.Verbose)
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore checkpoint %d of container %q: %v", id, name, err)
+		}
+		return nil, nil
+	})
+}
+
+// restoreCheckpoint resumes the named container from its checkpoint with
+// the provided id.
+func (d *Daemon) restoreCheckpoint(name string, id int, verbose bool) error {
+	d.beginChange(name)
+	err := d.backend.Restore(name, checkpointDir(name, id), verbose)
+	d.endChange(name, "restored", err)
+	return err
+}
+
+// serveLegacyCheckpoint checkpoints the container named in the request
+// form, and the result of the operation is the checkpoint id.
+func (d *Daemon) serveLegacyCheckpoint(r *http.Request) response {
+	name := r.FormValue("name")
+	if name == "" {
+		return badRequest("missing container name")
+	}
+	if resp := d.checkContainer(name, "checkpoint"); resp != nil {
+		return resp
+	}
+	stop := r.FormValue("stop") != ""
+	verbose := r.FormValue("verbose") != ""
+	return d.startOperation(fmt.Sprintf("checkpoint %s", name), false, func(op *operation) (interface{}, error) {
+		info, err := d.takeCheckpoint(op, name, stop, verbose)
+		if err != nil {
+			return nil, fmt.Errorf("cannot checkpoint container %q: %v", name, err)
+		}
+		return info.ID, nil
+	})
+}
+
+// serveLegacyRestore restores the container named in the request form
+// from the checkpoint with the id in the form.
+func (d *Daemon) serveLegacyRestore(r *http.Request) response {
+	name := r.FormValue("name")
+	if name == "" {
+		return badRequest("missing container name")
+	}
+	if resp := d.checkContainer(name, "restore"); resp != nil {
+		return resp
+	}
+	idstr := r.FormValue("id")
+	id, err := parseCheckpointID(idstr)
+	if err == nil {
+		_, err = readCheckpoint(name, id)
+	}
+	if err != nil {
+		return checkpointError(name, idstr, "restore", err)
+	}
+	err = d.restoreCheckpoint(name, id, r.FormValue("verbose") != "")
+	if err != nil {
+		return containerError(name, "restore", err)
+	}
+	return emptySyncResponse
+}
@@ -1,31 +1,50 @@
 package flex
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // Client can talk to a flex daemon.
 type Client struct {
-	config  Config
-	Remote  *RemoteConfig
-	http    http.Client
-	baseURL string
+	config    Config
+	Remote    *RemoteConfig
+	http      http.Client
+	baseURL   string
+	tlsConfig *tls.Config
 }
 
+// Connecting to the daemon times out after clientDialTimeout, and requests
+// once sent after clientResponseTimeout without a response. Requests have
+// no overall timeout, as long operations are waited on with bounded
+// requests of up to clientWaitTimeout each, and their data is streamed.
+const (
+	clientDialTimeout     = 10 * time.Second
+	clientResponseTimeout = 2 * time.Minute
+	clientWaitTimeout     = time.Minute
+)
+
 // NewClient returns a new flex client.
 func NewClient(config *Config, raw string) (*Client, string, error) {
 	c := Client{
 		config: *config,
-		http: http.Client{
-			// Added on Go 1.3. Wait until it's more popular.
-			//Timeout: 10 * time.Second,
-		},
 	}
 
 	result := strings.SplitN(raw, ":", 2)
@@ -42,12 +61,21 @@ func NewClient(config *Config, raw string) (*Client, string, error) {
 
 	if remote == "" || remote == "local" {
 		c.baseURL = "http://unix.socket"
-		c.http.Transport = &unixTransport
+		c.http.Transport = &http.Transport{
+			Dial:                  unixDial,
+			ResponseHeaderTimeout: clientResponseTimeout,
+		}
 	} else if r, ok := config.Remotes[remote]; ok {
-		c.baseURL = "http://" + r.Addr
-		c.Remote = &r
+		if r.CertFingerprint == "" {
+			return nil, "", fmt.Errorf("remote %q has no known certificate; add it again with \"flex remote add\"", remote)
+		}
+		cert, err := loadClientCert()
+		if err != nil {
+			return nil, "", err
+		}
+		c.setRemote(&r, cert)
 	} else {
-		return nil, "", fmt.Errorf("unknown remote name: %q", config.DefaultRemote)
+		return nil, "", fmt.Errorf("unknown remote name: %q", remote)
 	}
 	if err := c.Ping(); err != nil {
 		return nil, "", err
@@ -55,6 +83,45 @@ func NewClient(config *Config, raw string) (*Client, string, error) {
 	return &c, container, nil
 }
 
+// setRemote sets the client up for talking to the remote daemon over TLS,
+// presenting cert.
+func (c *Client) setRemote(r *RemoteConfig, cert tls.Certificate) {
+	c.baseURL = "https://" + r.Addr
+	c.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// The daemon certificate is self-signed, so rather than
+		// verifying it against a CA it must match the one pinned
+		// when the remote was added.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: pinnedCert(r.CertFingerprint),
+	}
+	c.http.Transport = &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: clientDialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       c.tlsConfig,
+		TLSHandshakeTimeout:   clientDialTimeout,
+		ResponseHeaderTimeout: clientResponseTimeout,
+	}
+	c.Remote = r
+}
+
+// pinnedCert returns a function which verifies that the certificate presented
+// by the daemon has the provided fingerprint.
+func pinnedCert(fingerprint string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("daemon presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("cannot parse daemon certificate: %v", err)
+		}
+		if got := CertFingerprint(cert); got != fingerprint {
+			return fmt.Errorf("daemon certificate fingerprint %s does not match the expected %s", got, fingerprint)
+		}
+		return nil
+	}
+}
+
 // Ping pings the daemon to see if it is up listening and working.
 func (c *Client) Ping() error {
 	Debugf("pinging the daemon")
@@ -69,136 +136,830 @@ func (c *Client) Ping() error {
 	return nil
 }
 
-func (c *Client) List() (string, error) {
+// List returns the containers passing all of the provided filters, in the
+// key=value form, where key is "name", "state", "profile" or a container
+// configuration key.
+func (c *Client) List(filters ...string) ([]ContainerInfo, error) {
 	Debugf("Getting list from the daemon")
-	data, err := c.getstr("/list", nil)
+	// Filters repeat the same parameter, which get doesn't support.
+	query := url.Values{"filter": filters}.Encode()
+	resp, err := c.http.Get(c.url("/1.0/containers") + "?" + query)
 	if err != nil {
-		return "fail", err
+		return nil, err
 	}
-	return data, err
+	doc, err := parseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	var result []ContainerInfo
+	err = doc.decode(&result)
+	return result, err
 }
 
-func (c *Client) Attach(name string, cmd string, secret string) (string, error) {
-	data, err := c.getstr("/attach", map[string]string{
-		"name":    name,
-		"command":  cmd,
-		"secret": secret,
+// Container returns the details of the named container.
+func (c *Client) Container(name string) (*ContainerInfo, error) {
+	var info ContainerInfo
+	err := c.getjson(containerURL(name), nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SetConfig replaces the configuration of the named container with config.
+// Changes to keys applied by the backend take effect when the container is
+// next started.
+func (c *Client) SetConfig(name string, config map[string]string) error {
+	if config == nil {
+		config = map[string]string{}
+	}
+	_, err := c.send("PUT", containerURL(name), jmap{"config": config})
+	return err
+}
+
+// SetDevices replaces the devices of the named container. Devices are
+// added to and removed from the container right away if it's running and
+// the daemon supports doing so for them, and otherwise when the container
+// is next started.
+func (c *Client) SetDevices(name string, devices map[string]Device) error {
+	if devices == nil {
+		devices = map[string]Device{}
+	}
+	_, err := c.send("PUT", containerURL(name), jmap{"devices": devices})
+	return err
+}
+
+// ApplyProfiles replaces the profiles applied to the named container with
+// the provided ones, which are applied in order. Changes take effect when
+// the container is next started.
+func (c *Client) ApplyProfiles(name string, profiles []string) error {
+	if profiles == nil {
+		profiles = []string{}
+	}
+	_, err := c.send("PUT", containerURL(name), jmap{"profiles": profiles})
+	return err
+}
+
+// Profiles returns the configuration profiles known to the daemon.
+func (c *Client) Profiles() ([]ProfileInfo, error) {
+	var result []ProfileInfo
+	err := c.getjson("/1.0/profiles", nil, &result)
+	return result, err
+}
+
+// Profile returns the named configuration profile.
+func (c *Client) Profile(name string) (*ProfileInfo, error) {
+	var info ProfileInfo
+	err := c.getjson(profileURL(name), nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CreateProfile creates a configuration profile with the provided name.
+func (c *Client) CreateProfile(name string, config map[string]string, devices map[string]Device) error {
+	_, err := c.send("POST", "/1.0/profiles", &ProfileInfo{Name: name, Config: config, Devices: devices})
+	return err
+}
+
+// UpdateProfile replaces the configuration and devices of the named
+// profile. Changes take effect for each container using it when it's next
+// started.
+func (c *Client) UpdateProfile(name string, config map[string]string, devices map[string]Device) error {
+	if config == nil {
+		config = map[string]string{}
+	}
+	if devices == nil {
+		devices = map[string]Device{}
+	}
+	_, err := c.send("PUT", profileURL(name), jmap{"config": config, "devices": devices})
+	return err
+}
+
+// DeleteProfile deletes the named profile, which must not be in use.
+func (c *Client) DeleteProfile(name string) error {
+	_, err := c.send("DELETE", profileURL(name), nil)
+	return err
+}
+
+// Images returns the images in the daemon store.
+func (c *Client) Images() ([]ImageInfo, error) {
+	var result []ImageInfo
+	err := c.getjson("/1.0/images", nil, &result)
+	return result, err
+}
+
+// Image returns the image with the provided fingerprint, which may be
+// abbreviated to a unique prefix if the client is trusted.
+func (c *Client) Image(fingerprint string) (*ImageInfo, error) {
+	var info ImageInfo
+	err := c.getjson(imageURL(fingerprint), nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ImportImage adds the image tarball read from r to the daemon store.
+// If fingerprint isn't empty, the daemon rejects the tarball unless it
+// has that fingerprint.
+func (c *Client) ImportImage(r io.Reader, fingerprint string) (*ImageInfo, error) {
+	req, err := http.NewRequest("POST", c.url("/1.0/images"), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if fingerprint != "" {
+		req.Header.Set("X-Flex-Fingerprint", fingerprint)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	var info ImageInfo
+	err = doc.decode(&info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ExportImage writes the tarball of the image with the provided
+// fingerprint to w, and returns the file name suggested by the daemon for
+// it. The fingerprint may be abbreviated to a unique prefix if the client
+// is trusted. The tarball is verified against the fingerprint reported by
+// the daemon.
+func (c *Client) ExportImage(fingerprint string, w io.Writer) (filename string, err error) {
+	resp, err := c.http.Get(c.url(imageURL(fingerprint, "export")))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, err := parseResponse(resp)
+		if err == nil {
+			err = fmt.Errorf("unexpected response status: %s", resp.Status)
+		}
+		return "", err
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return "", fmt.Errorf("missing image file name in response")
+	}
+	filename = path.Base(params["filename"])
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return "", err
+	}
+	expected := resp.Header.Get("X-Flex-Fingerprint")
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+		return "", fmt.Errorf("fingerprint mismatch: expected %s, got %s", expected, sum)
+	}
+	return filename, nil
+}
+
+// SetImagePublic sets whether the image with the provided fingerprint,
+// which may be abbreviated to a unique prefix, is public. Public images
+// may be listed and downloaded by untrusted clients, and other daemons
+// may create containers from them.
+func (c *Client) SetImagePublic(fingerprint string, public bool) error {
+	_, err := c.send("PUT", imageURL(fingerprint), jmap{"public": public})
+	return err
+}
+
+// Publish adds an image made of the root filesystem of the named container,
+// or of its snapshot if container is in the <name>/<snapshot> form, to the
+// daemon store, under the provided alias unless it's empty. A container
+// that is running is stopped while that happens, and started again
+// afterwards. The image details are the result of the operation.
+func (c *Client) Publish(container string, alias string, public bool, properties map[string]string) (*Operation, error) {
+	resp, err := c.send("POST", "/1.0/images", jmap{
+		"container":  container,
+		"alias":      alias,
+		"public":     public,
+		"properties": properties,
 	})
 	if err != nil {
-		return "fail", err
+		return nil, err
 	}
-	return data, err
+	return asyncOperation(resp)
+}
+
+// DeleteImage removes the image with the provided fingerprint, which may
+// be abbreviated to a unique prefix, from the daemon store.
+func (c *Client) DeleteImage(fingerprint string) error {
+	_, err := c.send("DELETE", imageURL(fingerprint), nil)
+	return err
+}
+
+// ImageAliases returns all image aliases.
+func (c *Client) ImageAliases() ([]ImageAlias, error) {
+	var result []ImageAlias
+	err := c.getjson("/1.0/images/aliases", nil, &result)
+	return result, err
+}
+
+// ImageAlias returns the named image alias.
+func (c *Client) ImageAlias(name string) (*ImageAlias, error) {
+	var alias ImageAlias
+	err := c.getjson(imageURL("aliases", name), nil, &alias)
+	if err != nil {
+		return nil, err
+	}
+	return &alias, nil
+}
+
+// CreateImageAlias creates an alias named name for the image with the
+// target fingerprint, which may be abbreviated to a unique prefix.
+func (c *Client) CreateImageAlias(name string, target string, description string) error {
+	_, err := c.send("POST", "/1.0/images/aliases", &ImageAlias{Name: name, Target: target, Description: description})
+	return err
+}
+
+// DeleteImageAlias deletes the named image alias, leaving its image alone.
+func (c *Client) DeleteImageAlias(name string) error {
+	_, err := c.send("DELETE", imageURL("aliases", name), nil)
+	return err
+}
+
+// Attach runs an interactive shell inside the named container, on a
+// terminal allocated by the daemon, and returns its exit status once it
+// finishes. The shell input is read from opts.Stdin, and its output is
+// written to opts.Stdout.
+func (c *Client) Attach(name string, opts ExecOptions) (int, error) {
+	opts.Interactive = true
+	return c.Exec(name, []string{"/bin/bash"}, opts)
 }
 
-func (c *Client) Create(name string, distro string, release string, arch string) (string, error) {
-	data, err := c.getstr("/create", map[string]string{
+// Create starts creating a new container in the background, and returns
+// the operation that may be waited on for its completion.
+func (c *Client) Create(name string, distro string, release string, arch string) (*Operation, error) {
+	resp, err := c.send("POST", "/1.0/containers", jmap{
 		"name":    name,
 		"distro":  distro,
 		"release": release,
 		"arch":    arch,
 	})
 	if err != nil {
-		return "fail", err
+		return nil, err
 	}
-	return data, err
+	return asyncOperation(resp)
 }
 
-// Call a function in the flex API by name (i.e. this has nothing to do with
-// the parameter passing schemed :)
-func (c *Client) CallByName(function string, name string) (string, error) {
-	data, err := c.getstr("/"+function, map[string]string{"name": name})
+// CreateFromImage creates a container from the image in the daemon store
+// referred to by image, which is either an alias or a fingerprint,
+// possibly abbreviated to a unique prefix. The container uses the default
+// profiles if profiles is nil, and starts with the provided configuration.
+func (c *Client) CreateFromImage(name string, image string, profiles []string, config map[string]string) (*Operation, error) {
+	resp, err := c.send("POST", "/1.0/containers", jmap{
+		"name":     name,
+		"image":    image,
+		"profiles": profiles,
+		"config":   config,
+	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return asyncOperation(resp)
+}
+
+// CreateFromRemoteImage is like CreateFromImage, but the image is in the
+// store of the remote daemon, which must have it public. The daemon
+// creating the container downloads it into its own store first, unless
+// it's there already.
+func (c *Client) CreateFromRemoteImage(name string, remote *RemoteConfig, image string, profiles []string, config map[string]string) (*Operation, error) {
+	resp, err := c.send("POST", "/1.0/containers", jmap{
+		"name":        name,
+		"image":       image,
+		"server":      remote.Addr,
+		"certificate": remote.CertFingerprint,
+		"profiles":    profiles,
+		"config":      config,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp)
+}
+
+func (c *Client) Destroy(name string) error {
+	_, err := c.send("DELETE", containerURL(name), nil)
+	return err
+}
+
+// Snapshots returns the snapshots of the named container, in the order
+// they were taken.
+func (c *Client) Snapshots(name string) ([]SnapshotInfo, error) {
+	var result []SnapshotInfo
+	err := c.getjson(containerURL(name, "snapshots"), nil, &result)
+	return result, err
+}
+
+// Snapshot returns the details of the snapshot of the named container.
+func (c *Client) Snapshot(name string, snapshot string) (*SnapshotInfo, error) {
+	var info SnapshotInfo
+	err := c.getjson(containerURL(name, "snapshots", snapshot), nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CreateSnapshot takes a snapshot of the root filesystem, profiles,
+// configuration and devices of the named container. The container is
+// stopped while that happens if it's running, and started again
+// afterwards. The snapshot gets the first unused name in the snap0,
+// snap1, ... sequence if snapshot is empty.
+func (c *Client) CreateSnapshot(name string, snapshot string) (*Operation, error) {
+	resp, err := c.send("POST", containerURL(name, "snapshots"), jmap{"name": snapshot})
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp)
+}
+
+// RestoreSnapshot brings the named container back to the state recorded
+// in its snapshot. The container is stopped while that happens if it's
+// running, and started again afterwards.
+func (c *Client) RestoreSnapshot(name string, snapshot string) (*Operation, error) {
+	resp, err := c.send("POST", containerURL(name, "snapshots", snapshot, "restore"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp)
+}
+
+// DeleteSnapshot removes the snapshot of the named container.
+func (c *Client) DeleteSnapshot(name string, snapshot string) (*Operation, error) {
+	resp, err := c.send("DELETE", containerURL(name, "snapshots", snapshot), nil)
+	if err != nil {
+		return nil, err
 	}
-	return data, err
+	return asyncOperation(resp)
 }
 
-func (c *Client) Destroy(name string) (string, error) {
-	return c.CallByName("destroy", name)
+// changeState requests the daemon to perform action on the container state.
+func (c *Client) changeState(name string, action string) error {
+	_, err := c.send("PUT", containerURL(name, "state"), jmap{"action": action})
+	return err
 }
 
-func (c *Client) Reboot(name string) (string, error) {
-	return c.CallByName("reboot", name)
+func (c *Client) Reboot(name string) error {
+	return c.changeState(name, "restart")
 }
 
-func (c *Client) Start(name string) (string, error) {
-	return c.CallByName("start", name)
+func (c *Client) Start(name string) error {
+	return c.changeState(name, "start")
 }
 
-func (c *Client) Stop(name string) (string, error) {
-	return c.CallByName("stop", name)
+func (c *Client) Stop(name string) error {
+	return c.changeState(name, "stop")
 }
 
-func (c *Client) Status(name string) (string, error) {
-	return c.CallByName("status", name)
+// Status returns the runtime state of the named container.
+func (c *Client) Status(name string) (*ContainerState, error) {
+	var state ContainerState
+	err := c.getjson(containerURL(name, "state"), nil, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
 }
 
-func (c *Client) Checkpoint(name string, stop bool, verbose bool) (string, error) {
-	parms := map[string]string{"name": name}
-	if stop {
-		parms["stop"] = "true"
+// Exec runs argv inside the named container, with the environment in opts,
+// and returns its exit status once it finishes.
+func (c *Client) Exec(name string, argv []string, opts ExecOptions) (int, error) {
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = ioutil.Discard
+	}
+	resp, err := c.send("POST", containerURL(name, "exec"), jmap{
+		"command":     argv,
+		"environment": opts.Env,
+		"cwd":         opts.Cwd,
+		"interactive": opts.Interactive,
+		"width":       opts.Width,
+		"height":      opts.Height,
+	})
+	if err != nil {
+		return -1, err
+	}
+	op, err := asyncOperation(resp)
+	if err != nil {
+		return -1, err
+	}
+	var sockets execSockets
+	err = json.Unmarshal(op.Metadata, &sockets)
+	if err != nil {
+		return -1, fmt.Errorf("cannot parse exec operation metadata: %v", err)
 	}
-	if verbose {
-		parms["verbose"] = "verbose"
+	fds := []string{"control", "0"}
+	if !opts.Interactive {
+		fds = append(fds, "1", "2")
+	}
+	for _, fd := range fds {
+		if sockets.FDs[fd] == "" {
+			return -1, fmt.Errorf("exec operation metadata has no websocket for %q", fd)
+		}
 	}
 
-	return c.getstr("/checkpoint", parms)
+	conns := make(map[string]*websocket.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for fd, secret := range sockets.FDs {
+		conn, err := c.websocket(path.Join("/1.0/operations", op.ID, "websocket"), secret)
+		if err != nil {
+			return -1, err
+		}
+		conns[fd] = conn
+	}
+
+	if opts.Control != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func(conn *websocket.Conn) {
+			for {
+				select {
+				case msg, ok := <-opts.Control:
+					if !ok || conn.WriteJSON(&msg) != nil {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}(conns["control"])
+	}
+
+	if opts.Interactive {
+		if opts.Stdin != nil {
+			go wsWriteStream(conns["0"], opts.Stdin)
+		}
+		err := wsReadStream(opts.Stdout, conns["0"])
+		if err != nil {
+			return -1, fmt.Errorf("cannot read command output: %v", err)
+		}
+	} else {
+		go func() {
+			if opts.Stdin != nil {
+				wsWriteStream(conns["0"], opts.Stdin)
+			}
+			wsCloseStream(conns["0"])
+		}()
+		errs := make(chan error, 2)
+		go func() { errs <- wsReadStream(opts.Stdout, conns["1"]) }()
+		go func() { errs <- wsReadStream(opts.Stderr, conns["2"]) }()
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				return -1, fmt.Errorf("cannot read command output: %v", err)
+			}
+		}
+	}
+
+	op, err = c.WaitForOperation(op.ID, -1)
+	if err != nil {
+		return -1, err
+	}
+	if op.Status != OperationSuccess {
+		return -1, fmt.Errorf("%s", op.Error)
+	}
+	var result ExecResult
+	err = op.Result(&result)
+	if err != nil {
+		return -1, err
+	}
+	return result.Return, nil
 }
 
-func (c *Client) Restore(name string, id int, verbose bool) (string, error) {
-	parms := map[string]string{"name": name, "id": string(id)}
-	if verbose {
-		parms["verbose"] = "verbose"
+// Checkpoints returns the details of the checkpoints of the named
+// container, in the order they were taken.
+func (c *Client) Checkpoints(name string) ([]CheckpointInfo, error) {
+	var result []CheckpointInfo
+	err := c.getjson(containerURL(name, "checkpoints"), nil, &result)
+	return result, err
+}
+
+// Checkpoint returns the details of the checkpoint of the named container
+// with the provided id.
+func (c *Client) Checkpoint(name string, id int) (*CheckpointInfo, error) {
+	var info CheckpointInfo
+	err := c.getjson(containerURL(name, "checkpoints", strconv.Itoa(id)), nil, &info)
+	if err != nil {
+		return nil, err
 	}
+	return &info, nil
+}
 
-	return c.getstr("/checkpoint", parms)
+// CreateCheckpoint starts dumping the state of the named running container
+// into a new checkpoint in the background, stopping the container
+// afterwards if stop is set. The result of the returned operation is the
+// CheckpointInfo of the new checkpoint.
+func (c *Client) CreateCheckpoint(name string, stop bool, verbose bool) (*Operation, error) {
+	resp, err := c.send("POST", containerURL(name, "checkpoints"), jmap{"stop": stop, "verbose": verbose})
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp)
 }
 
-func (c *Client) SendContainer(remote *RemoteConfig, name string, id int) (string, error) {
+// RestoreCheckpoint starts resuming the named container from its
+// checkpoint with the provided id in the background.
+func (c *Client) RestoreCheckpoint(name string, id int, verbose bool) (*Operation, error) {
+	resp, err := c.send("POST", containerURL(name, "checkpoints", strconv.Itoa(id), "restore"), jmap{"verbose": verbose})
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp)
+}
+
+// DeleteCheckpoint removes the checkpoint of the named container with the
+// provided id.
+func (c *Client) DeleteCheckpoint(name string, id int) error {
+	_, err := c.send("DELETE", containerURL(name, "checkpoints", strconv.Itoa(id)), nil)
+	return err
+}
+
+// SendContainer starts sending the named container and its checkpoint with
+// the provided id, if not negative, to the remote daemon in the background.
+func (c *Client) SendContainer(remote *RemoteConfig, name string, id int) (*Operation, error) {
+	// The files are sent over ssh, rather than to the daemon port.
 	host := remote.Addr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
 	params := map[string]string{"name": name, "remote": host}
 	if id >= 0 {
-		params["id"] = string(id)
+		params["checkpoint"] = strconv.Itoa(id)
+	}
+
+	resp, err := c.get("/sendContainer", params)
+	if err != nil {
+		return nil, err
 	}
+	return asyncOperation(resp)
+}
 
-	return c.getstr("sendContainer", params)
+// ReceiveContainer records the named container, previously sent to the
+// daemon with SendContainer, so that it may be restored from its
+// checkpoint.
+func (c *Client) ReceiveContainer(name string) error {
+	_, err := c.get("/receiveContainer", map[string]string{"name": name})
+	return err
 }
 
-func (c *Client) getstr(base string, args map[string]string) (string, error) {
+// asyncOperation returns the operation referred to by an async response.
+func asyncOperation(resp *Response) (*Operation, error) {
+	if resp.Type != AsyncResponse {
+		return nil, fmt.Errorf("expected async response from daemon, got %q", resp.Type)
+	}
+	var op Operation
+	err := resp.decode(&op)
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// Operation returns the current state of the background operation with
+// the provided id.
+func (c *Client) Operation(id string) (*Operation, error) {
+	var op Operation
+	err := c.getjson(path.Join("/1.0/operations", id), nil, &op)
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// WaitForOperation blocks until the background operation with the provided
+// id finishes or timeout elapses, whichever happens first, and returns the
+// state of the operation at that time. A negative timeout waits for as
+// long as the operation takes.
+func (c *Client) WaitForOperation(id string, timeout time.Duration) (*Operation, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		// Each request waits for a while only, so that its response
+		// comes before the transport gives up on it.
+		wait := clientWaitTimeout
+		if timeout >= 0 {
+			if left := time.Until(deadline); left < wait {
+				wait = left
+			}
+			if wait < 0 {
+				wait = 0
+			}
+		}
+		var op Operation
+		err := c.getjson(path.Join("/1.0/operations", id, "wait"), map[string]string{
+			"timeout": strconv.Itoa(int((wait + time.Second - 1) / time.Second)),
+		}, &op)
+		if err != nil {
+			return nil, err
+		}
+		if op.Done() || timeout >= 0 && !time.Now().Before(deadline) {
+			return &op, nil
+		}
+	}
+}
+
+// CancelOperation requests the daemon to cancel the background operation
+// with the provided id. Not all operations may be cancelled.
+func (c *Client) CancelOperation(id string) error {
+	_, err := c.send("DELETE", path.Join("/1.0/operations", id), nil)
+	return err
+}
+
+// APIInfo returns details about the API served by the daemon, including
+// whether the client is trusted by it.
+func (c *Client) APIInfo() (*APIInfo, error) {
+	var info APIInfo
+	err := c.getjson("/1.0", nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// RequestTrust adds the certificate presented by the client to the ones
+// trusted by the daemon, using the trust password set on it. The password
+// may be used only once.
+func (c *Client) RequestTrust(password string) error {
+	_, err := c.send("POST", "/1.0/certificates", jmap{"password": password})
+	return err
+}
+
+// SetTrustPassword sets the password which allows a client to be trusted by
+// the daemon with RequestTrust. An empty password disables it.
+func (c *Client) SetTrustPassword(password string) error {
+	_, err := c.send("PUT", "/1.0/trust-password", jmap{"password": password})
+	return err
+}
+
+// Certificates returns the client certificates trusted by the daemon.
+func (c *Client) Certificates() ([]CertificateInfo, error) {
+	var result []CertificateInfo
+	err := c.getjson("/1.0/certificates", nil, &result)
+	return result, err
+}
+
+// AddCertificate adds cert to the certificates trusted by the daemon.
+func (c *Client) AddCertificate(cert *x509.Certificate) error {
+	_, err := c.send("POST", "/1.0/certificates", jmap{"certificate": string(encodeCert(cert))})
+	return err
+}
+
+// RemoveCertificate removes the certificate with the provided fingerprint
+// from the certificates trusted by the daemon.
+func (c *Client) RemoveCertificate(fingerprint string) error {
+	_, err := c.send("DELETE", path.Join("/1.0/certificates", fingerprint), nil)
+	return err
+}
+
+// Events connects to the daemon event stream, delivering events of the
+// provided types, or of all types if none are provided.
+func (c *Client) Events(types ...string) (*EventStream, error) {
+	vs := url.Values{}
+	if len(types) > 0 {
+		vs.Set("type", strings.Join(types, ","))
+	}
+	resp, err := c.http.Get(c.url("/1.0/events") + "?" + vs.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, err := parseResponse(resp)
+		if err == nil {
+			err = fmt.Errorf("unexpected response to event stream request: %s", resp.Status)
+		}
+		return nil, err
+	}
+	ch := make(chan *Event)
+	s := &EventStream{Events: ch, resp: resp, done: make(chan struct{})}
+	go s.loop(ch)
+	return s, nil
+}
+
+// get sends a request to the daemon and returns the response document.
+// Error documents are returned as an *Error.
+func (c *Client) get(base string, args map[string]string) (*Response, error) {
 	vs := url.Values{}
 	for k, v := range args {
 		vs.Set(k, v)
 	}
 
-	data, err := c.get(base + "?" + vs.Encode())
+	resp, err := c.http.Get(c.url(base) + "?" + vs.Encode())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(data), nil
+	return parseResponse(resp)
 }
 
-func (c *Client) get(elem ...string) ([]byte, error) {
-	resp, err := c.http.Get(c.url(elem...))
+// send sends a request with the provided method to the daemon, with body
+// marshalled as a json document, and returns the response document.
+// Error documents are returned as an *Error.
+func (c *Client) send(method string, base string, body interface{}) (*Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.url(base), &buf)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(resp)
+}
+
+// getstr sends a request to the daemon and returns the string held in the
+// metadata of the response.
+func (c *Client) getstr(base string, args map[string]string) (string, error) {
+	var result string
+	err := c.getjson(base, args, &result)
+	return result, err
+}
+
+// getjson sends a request to the daemon and unmarshals the metadata of the
+// response into result.
+func (c *Client) getjson(base string, args map[string]string, result interface{}) error {
+	resp, err := c.get(base, args)
+	if err != nil {
+		return err
+	}
+	return resp.decode(result)
+}
+
+// websocket connects to the websocket at the provided API path, using
+// secret for authenticating the connection.
+func (c *Client) websocket(base string, secret string) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: clientDialTimeout}
+	var u string
+	if c.Remote == nil {
+		dialer.NetDial = unixDial
+		u = "ws://unix.socket" + base
+	} else {
+		dialer.NetDial = (&net.Dialer{Timeout: clientDialTimeout}).Dial
+		dialer.TLSClientConfig = c.tlsConfig
+		u = "wss://" + c.Remote.Addr + base
+	}
+	u += "?" + url.Values{"secret": {secret}}.Encode()
+	conn, resp, err := dialer.Dial(u, nil)
+	if err == websocket.ErrBadHandshake {
+		_, perr := parseResponse(resp)
+		if perr != nil {
+			return nil, perr
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to websocket: %v", err)
+	}
+	return conn, nil
 }
 
 func (c *Client) url(elem ...string) string {
 	return c.baseURL + path.Join(elem...)
 }
 
-var unixTransport = http.Transport{
-	Dial: func(network, addr string) (net.Conn, error) {
-		if addr != "unix.socket:80" {
-			return nil, fmt.Errorf("non-unix-socket addresses not supported yet")
-		}
-		raddr, err := net.ResolveUnixAddr("unix", varPath("unix.socket"))
-		if err != nil {
-			return nil, fmt.Errorf("cannot resolve unix socket address: %v", err)
-		}
-		return net.DialUnix("unix", nil, raddr)
-	},
+// containerURL returns the API path of the named container, or of the
+// resource within it identified by elem.
+func containerURL(name string, elem ...string) string {
+	return path.Join(append([]string{"/1.0/containers", name}, elem...)...)
+}
+
+// profileURL returns the API path of the named profile.
+func profileURL(name string) string {
+	return path.Join("/1.0/profiles", name)
+}
+
+// imageURL returns the API path of the image with the provided
+// fingerprint, or of the resource under /1.0/images identified by elem.
+func imageURL(elem ...string) string {
+	return path.Join(append([]string{"/1.0/images"}, elem...)...)
+}
+
+// unixDial connects to the local daemon unix socket. Each client has its
+// own transport using it, so that idle connections are not shared with
+// clients of a different daemon.
+func unixDial(network, addr string) (net.Conn, error) {
+	if addr != "unix.socket:80" {
+		return nil, fmt.Errorf("non-unix-socket addresses not supported yet")
+	}
+	return net.DialTimeout("unix", varPath("unix.socket"), clientDialTimeout)
 }
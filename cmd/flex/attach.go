@@ -1,22 +1,18 @@
 package main
 
 import (
-	"github.com/niemeyer/flex"
-	"fmt"
-	"io"
-	"net"
 	"os"
-	"syscall"
 
 	"code.google.com/p/go.crypto/ssh/terminal"
+	"github.com/niemeyer/flex"
 )
 
 type attachCmd struct{}
 
 const attachUsage = `
-flex attach images:ubuntu/$release/$arch
+flex attach [remote:]<container>
 
-Attaches to a container
+Attaches to a container, running a shell inside it.
 `
 
 func (c *attachCmd) usage() string {
@@ -26,7 +22,7 @@ func (c *attachCmd) usage() string {
 func (c *attachCmd) flags() {}
 
 func (c *attachCmd) run(args []string) error {
-	if len(args) > 1 {
+	if len(args) != 1 {
 		return errArgs
 	}
 	config, err := flex.LoadConfig()
@@ -40,15 +36,8 @@ func (c *attachCmd) run(args []string) error {
 		return err
 	}
 
-	// TODO - random value in place of 5 :)
-	secret := "5"
-
-	l, err := d.Attach(name, "/bin/bash", secret)
-	if err != nil {
-		return err
-	}
-
-	cfd := syscall.Stdout
+	width, height, _ := terminal.GetSize(int(os.Stdout.Fd()))
+	cfd := int(os.Stdin.Fd())
 	if terminal.IsTerminal(cfd) {
 		oldttystate, err := terminal.MakeRaw(cfd)
 		if err != nil {
@@ -57,30 +46,22 @@ func (c *attachCmd) run(args []string) error {
 		defer terminal.Restore(cfd, oldttystate)
 	}
 
-	// open a connection to l and connect stdin/stdout to it
-
-	// connect
-	conn, err := net.Dial("tcp", l)
+	control, stop := forwardControl(true)
+	defer stop()
+
+	code, err := d.Attach(name, flex.ExecOptions{
+		Env:     map[string]string{"TERM": os.Getenv("TERM")},
+		Width:   width,
+		Height:  height,
+		Control: control,
+		Stdin:   os.Stdin,
+		Stdout:  os.Stdout,
+	})
 	if err != nil {
 		return err
 	}
-	_, err = conn.Write([]byte(secret))
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		_, err := io.Copy(conn, os.Stdin)
-		if err != nil {
-			fmt.Println("Stdin read error: %s", err.Error())
-			return
-		}
-	}()
-	_, err = io.Copy(os.Stdout, conn)
-	if err != nil {
-		fmt.Println("Connection read error: %s", err.Error())
-		return err
+	if code != 0 {
+		return exitCodeError(code)
 	}
-
 	return nil
 }
@@ -7,7 +7,7 @@ import (
 
 type byNameCmd struct {
 	function string
-	do       func(*flex.Client, string) (string, error)
+	do       func(*flex.Client, string) error
 }
 
 func (c *byNameCmd) usage() string {
@@ -35,7 +35,5 @@ func (c *byNameCmd) run(args []string) error {
 		return err
 	}
 
-	data, err := c.do(d, name)
-	fmt.Println(data)
-	return err
+	return c.do(d, name)
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type checkpointCmd struct {
+	stop    bool
+	verbose bool
+}
+
+const checkpointUsage = `
+Manage the checkpoints of running containers
+
+flex checkpoint create [remote:]<container> [--stop] [--verbose]
+                                                  Dump the container state.
+flex checkpoint list [remote:]<container>         List checkpoints.
+flex checkpoint restore [remote:]<container> <id> Resume from a checkpoint.
+flex checkpoint delete [remote:]<container> <id>  Delete a checkpoint.
+
+Checkpoints hold the state of a running container, which may be resumed
+from them once it's stopped. They are identified by an id which increases
+with every checkpoint taken. Only the newest checkpoints of a container
+are kept, as many as set in its checkpoint.retain configuration key, or
+5 if it's not set. Setting it to 0 keeps all of them.
+`
+
+func (c *checkpointCmd) usage() string {
+	return checkpointUsage
+}
+
+func (c *checkpointCmd) flags() {
+	gnuflag.BoolVar(&c.stop, "stop", false, "Stop the container once its state is dumped")
+	gnuflag.BoolVar(&c.verbose, "verbose", false, "Emit verbose criu logs")
+}
+
+func (c *checkpointCmd) run(args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+	nargs := map[string]int{"create": 1, "list": 1, "restore": 2, "delete": 2}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown checkpoint subcommand: %s", args[0])
+	}
+	if len(args)-1 != n {
+		return errArgs
+	}
+	d, name, err := containerClient(args[1])
+	if err != nil {
+		return err
+	}
+	id := -1
+	if n == 2 {
+		id, err = strconv.Atoi(args[2])
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid checkpoint id: %s", args[2])
+		}
+	}
+
+	switch args[0] {
+	case "create":
+		op, err := d.CreateCheckpoint(name, c.stop, c.verbose)
+		if err != nil {
+			return err
+		}
+		op, err = waitOperation(d, op)
+		if err != nil {
+			return err
+		}
+		var checkpoint flex.CheckpointInfo
+		err = op.Result(&checkpoint)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Checkpoint created with id: %d\n", checkpoint.ID)
+		return nil
+	case "list":
+		checkpoints, err := d.Checkpoints(name)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tSIZE")
+		for _, checkpoint := range checkpoints {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", checkpoint.ID, formatTime(checkpoint.CreatedAt), formatSize(uint64(checkpoint.Size)))
+		}
+		return w.Flush()
+	case "restore":
+		op, err := d.RestoreCheckpoint(name, id, c.verbose)
+		if err != nil {
+			return err
+		}
+		_, err = waitOperation(d, op)
+		return err
+	case "delete":
+		return d.DeleteCheckpoint(name, id)
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/niemeyer/flex"
+	"gopkg.in/yaml.v2"
+)
+
+type configCmd struct{}
+
+const configUsage = `
+Manage the configuration of containers and flex daemons
+
+flex config set [remote:]<container> <key> <value>  Set a container configuration key.
+flex config get [remote:]<container> <key>          Print a container configuration key.
+flex config unset [remote:]<container> <key>        Unset a container configuration key.
+flex config show [remote:]<container>               Print the container configuration.
+
+flex config device add [remote:]<container> <name> <type> [<key>=<value>...]
+                                                    Add a device to the container.
+flex config device remove [remote:]<container> <name>
+                                                    Remove a device from the container.
+flex config device list [remote:]<container>        List the container devices.
+
+flex config trust list [remote:]                   List trusted client certificates.
+flex config trust add [remote:] <cert.crt>         Trust the certificate in <cert.crt>.
+flex config trust remove [remote:] <fingerprint>   Stop trusting the certificate.
+flex config trust password [remote:] [<password>]  Set the trust password.
+
+The container configuration keys are:
+
+limits.cpu                Number of CPUs, or set of CPUs such as 0-3,6.
+limits.cpu.allowance      Share of CPU time when the host is busy, such as
+                          50%, or CPU time per period, such as 25ms/100ms.
+limits.memory             Memory limit, such as 512MB or 2GiB.
+limits.memory.swap        Whether the container may use swap.
+limits.processes          Maximum number of processes.
+limits.disk.priority      Block I/O priority, from 0 to 10.
+security.nesting          Whether containers may run inside the container.
+boot.autostart            Whether to start the container with the daemon.
+boot.autostart.delay      Seconds to wait after starting the container.
+boot.autostart.priority   Containers with higher priority start first.
+checkpoint.retain         Number of checkpoints kept, 5 by default, or 0 to
+                          keep all of them.
+environment.<NAME>        Environment variable for the container.
+user.<name>               Free-form value for the user.
+
+Changes to limits.* keys are applied to running containers right away.
+Other changes take effect when the container is next started.
+
+The device types and their keys are:
+
+disk         source (host path), path (container path), readonly
+nic          nictype (bridged, macvlan or physical), parent (host bridge
+             or interface), name, hwaddr, mtu
+unix-char    path (container path), source (host path, defaults to path),
+unix-block   major, minor (default to those of source)
+
+Unix devices and physical network interfaces are added to and removed
+from running containers right away. Other devices change when the
+container is next started.
+
+The trust password allows a single client to add its own certificate to
+the ones trusted by the daemon, with "flex remote add". It's discarded
+once used. An empty password disables it.
+`
+
+func (c *configCmd) usage() string {
+	return configUsage
+}
+
+func (c *configCmd) flags() {}
+
+func (c *configCmd) run(args []string) error {
+	if len(args) < 2 {
+		return errArgs
+	}
+	switch args[0] {
+	case "trust":
+		return c.runTrust(args[1], args[2:])
+	case "set", "get", "unset", "show":
+		return c.runContainer(args[0], args[1], args[2:])
+	case "device":
+		if len(args) < 3 {
+			return errArgs
+		}
+		return c.runDevice(args[1], args[2], args[3:])
+	}
+	return fmt.Errorf("unknown config subcommand: %s", args[0])
+}
+
+// runContainer runs the config subcommand sub on the container named by
+// raw, which may be prefixed by a remote.
+func (c *configCmd) runContainer(sub string, raw string, args []string) error {
+	nargs := map[string]int{"set": 2, "get": 1, "unset": 1, "show": 0}
+	if len(args) != nargs[sub] {
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, raw)
+	if err != nil {
+		return err
+	}
+	info, err := d.Container(name)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "get":
+		if value, ok := info.Config[args[0]]; ok {
+			fmt.Println(value)
+		}
+		return nil
+	case "show":
+		data, err := yaml.Marshal(info.Config)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+		return nil
+	}
+
+	if info.Config == nil {
+		info.Config = make(map[string]string)
+	}
+	if sub == "set" {
+		info.Config[args[0]] = args[1]
+	} else {
+		if _, ok := info.Config[args[0]]; !ok {
+			return fmt.Errorf("configuration key %q is not set", args[0])
+		}
+		delete(info.Config, args[0])
+	}
+	return d.SetConfig(name, info.Config)
+}
+
+// runDevice runs the config device subcommand sub on the container named
+// by raw, which may be prefixed by a remote.
+func (c *configCmd) runDevice(sub string, raw string, args []string) error {
+	switch {
+	case sub == "add" && len(args) >= 2:
+	case sub == "remove" && len(args) == 1:
+	case sub == "list" && len(args) == 0:
+	case sub != "add" && sub != "remove" && sub != "list":
+		return fmt.Errorf("unknown config device subcommand: %s", sub)
+	default:
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, raw)
+	if err != nil {
+		return err
+	}
+	info, err := d.Container(name)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		names := make([]string, 0, len(info.Devices))
+		for devname := range info.Devices {
+			names = append(names, devname)
+		}
+		sort.Strings(names)
+		for _, devname := range names {
+			fmt.Printf("%s: %s\n", devname, info.Devices[devname]["type"])
+		}
+		return nil
+	case "add":
+		devname := args[0]
+		if _, ok := info.Devices[devname]; ok {
+			return fmt.Errorf("device %q already exists", devname)
+		}
+		dev := flex.Device{"type": args[1]}
+		for _, kv := range args[2:] {
+			fields := strings.SplitN(kv, "=", 2)
+			if len(fields) != 2 || fields[0] == "" {
+				return fmt.Errorf("device property must be in the key=value form: %q", kv)
+			}
+			dev[fields[0]] = fields[1]
+		}
+		if info.Devices == nil {
+			info.Devices = make(map[string]flex.Device)
+		}
+		info.Devices[devname] = dev
+	case "remove":
+		if _, ok := info.Devices[args[0]]; !ok {
+			return fmt.Errorf("device %q not found", args[0])
+		}
+		delete(info.Devices, args[0])
+	}
+	return d.SetDevices(name, info.Devices)
+}
+
+// splitRemote returns the remote given as the first of args, if it has the
+// "remote:" form, and the remaining arguments.
+func splitRemote(args []string) (remote string, rest []string) {
+	if len(args) > 0 && strings.HasSuffix(args[0], ":") {
+		return args[0], args[1:]
+	}
+	return "", args
+}
+
+func (c *configCmd) runTrust(sub string, args []string) error {
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	remote, args := splitRemote(args)
+	if remote == "" {
+		remote = config.DefaultRemote
+	}
+	d, _, err := flex.NewClient(config, remote)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		if len(args) != 0 {
+			return errArgs
+		}
+		certs, err := d.Certificates()
+		if err != nil {
+			return err
+		}
+		for _, info := range certs {
+			name := ""
+			if cert, err := flex.ParseCert([]byte(info.Certificate)); err == nil {
+				name = cert.Subject.CommonName
+			}
+			fmt.Printf("%s %s\n", info.Fingerprint, name)
+		}
+		return nil
+	case "add":
+		if len(args) != 1 {
+			return errArgs
+		}
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		cert, err := flex.ParseCert(data)
+		if err != nil {
+			return err
+		}
+		return d.AddCertificate(cert)
+	case "remove":
+		if len(args) != 1 {
+			return errArgs
+		}
+		return d.RemoveCertificate(args[0])
+	case "password":
+		if len(args) > 1 {
+			return errArgs
+		}
+		var password string
+		if len(args) == 1 {
+			password = args[0]
+		} else {
+			password, err = promptPassword("Trust password: ")
+			if err != nil {
+				return err
+			}
+		}
+		return d.SetTrustPassword(password)
+	}
+	return fmt.Errorf("unknown config trust subcommand: %s", sub)
+}
@@ -2,50 +2,246 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
 )
 
-type createCmd struct{}
+type createCmd struct {
+	// launch is set for "flex launch", which starts the container too.
+	launch   bool
+	profiles listFlag
+	config   configFlag
+}
 
 const createUsage = `
-flex create images:ubuntu/$release/$arch
+flex create [remote:]<image> [[remote:]<name>] [--profile <profile>]... [-c <key>=<value>]...
 
-Creates a container using the specified release and arch
+Creates a container from an image, referred to by an alias or by its
+fingerprint, which may be abbreviated to a unique prefix. An image in the
+store of another remote, as in "otherhost:ubuntu/trusty", is downloaded
+into the store of the daemon holding the container first, which requires
+the image to be public (see "flex help image"). Images published by
+the image servers configured for the daemon are referred to in the same
+way, as in "images:ubuntu/trusty/amd64", and the daemon downloads them
+into its store unless they're there already.
+
+The container gets a random name unless one is provided, and it uses the
+default profile unless profiles are listed. The -c option sets container
+configuration keys, as "flex config set" does.
+`
+
+const launchUsage = `
+flex launch [remote:]<image> [[remote:]<name>] [--profile <profile>]... [-c <key>=<value>]...
+
+Creates a container from an image and starts it. See "flex help create"
+for the details.
 `
 
 func (c *createCmd) usage() string {
+	if c.launch {
+		return launchUsage
+	}
 	return createUsage
 }
 
-func (c *createCmd) flags() {}
+func (c *createCmd) flags() {
+	gnuflag.Var(&c.profiles, "profile", "Profile to apply to the container")
+	gnuflag.Var(&c.profiles, "p", "Profile to apply to the container")
+	gnuflag.Var(&c.config, "config", "Configuration key to set, as KEY=VALUE")
+	gnuflag.Var(&c.config, "c", "Configuration key to set, as KEY=VALUE")
+}
 
-func (c *createCmd) run(args []string) error {
-	if len(args) > 1 {
-		return errArgs
+// listFlag collects the values given with a repeated flag.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// configFlag collects the configuration keys given with repeated flags.
+type configFlag map[string]string
+
+func (f *configFlag) String() string {
+	var kvs []string
+	for k, v := range *f {
+		kvs = append(kvs, k+"="+v)
 	}
+	return strings.Join(kvs, " ")
+}
 
-	var containerRef string
-	if len(args) == 1 {
-		containerRef = args[0]
-	} else {
-		// TODO: come up with a random name a. la. juju/maas
-		containerRef = "foo"
+func (f *configFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("configuration key must be in the KEY=VALUE form: %q", s)
+	}
+	if *f == nil {
+		*f = make(configFlag)
+	}
+	(*f)[kv[0]] = kv[1]
+	return nil
+}
+
+func (c *createCmd) run(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errArgs
 	}
 
 	config, err := flex.LoadConfig()
 	if err != nil {
 		return err
 	}
-
-	// NewClient will ping the server to test the connection before returning.
+	containerRef := ""
+	if len(args) == 2 {
+		containerRef = args[1]
+	}
 	d, name, err := flex.NewClient(config, containerRef)
 	if err != nil {
 		return err
 	}
 
-	l, err := d.Create(name, "ubuntu", "trusty", "amd64")
+	image := args[0]
+	var remote *flex.RemoteConfig
+	if i := strings.Index(image, ":"); i < 0 || isRemote(config, image[:i]) {
+		src, ref, err := flex.NewClient(config, image)
+		if err != nil {
+			return err
+		}
+		if ref == "" {
+			return errArgs
+		}
+		image, err = resolveImage(src, ref)
+		if err != nil {
+			return err
+		}
+		info, err := src.Image(image)
+		if err != nil {
+			return err
+		}
+		image = info.Fingerprint
+		switch {
+		case sameDaemon(src, d):
+		case src.Remote != nil:
+			// The daemon downloads the image from the other one.
+			remote = src.Remote
+		default:
+			// The other daemon can't reach the local one.
+			err = copyImage(src, d, image)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Otherwise the image is published by an image server, which the
+	// daemon downloads it from.
+
+	if name == "" {
+		name, err = randomName(d)
+		if err != nil {
+			return err
+		}
+	}
+	var profiles []string
+	if len(c.profiles) > 0 {
+		profiles = c.profiles
+	}
+	fmt.Printf("Creating %s\n", name)
+	var op *flex.Operation
+	if remote != nil {
+		op, err = d.CreateFromRemoteImage(name, remote, image, profiles, c.config)
+	} else {
+		op, err = d.CreateFromImage(name, image, profiles, c.config)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = waitOperation(d, op)
+	if err != nil || !c.launch {
+		return err
+	}
+	fmt.Printf("Starting %s\n", name)
+	return d.Start(name)
+}
+
+// isRemote returns whether name refers to a flex daemon, rather than to
+// an image server.
+func isRemote(config *flex.Config, name string) bool {
+	_, ok := config.Remotes[name]
+	return ok || name == "" || name == "local"
+}
+
+// sameDaemon returns whether both clients talk to the same daemon.
+func sameDaemon(a, b *flex.Client) bool {
+	if a.Remote == nil || b.Remote == nil {
+		return a.Remote == b.Remote
+	}
+	return a.Remote.Addr == b.Remote.Addr
+}
+
+// copyImage copies the image with the provided fingerprint from the store
+// of src into the store of dst, unless it's there already.
+func copyImage(src, dst *flex.Client, fingerprint string) error {
+	_, err := dst.Image(fingerprint)
 	if err == nil {
-		fmt.Println(l)
+		return nil
+	}
+	if e, ok := err.(*flex.Error); !ok || e.StatusCode != http.StatusNotFound {
+		return err
 	}
+	r, w := io.Pipe()
+	go func() {
+		_, err := src.ExportImage(fingerprint, w)
+		w.CloseWithError(err)
+	}()
+	defer r.Close()
+	_, err = dst.ImportImage(r, fingerprint)
 	return err
 }
+
+var nameAdjectives = []string{
+	"amber", "bold", "brave", "calm", "clever", "crisp", "eager", "fancy",
+	"gentle", "happy", "jolly", "keen", "lively", "lucky", "mellow", "noble",
+	"proud", "quick", "quiet", "rapid", "shiny", "steady", "sunny", "swift",
+	"tidy", "vivid", "warm", "wise",
+}
+
+var nameNouns = []string{
+	"badger", "beaver", "bison", "crane", "dingo", "eagle", "ferret", "finch",
+	"gecko", "heron", "ibis", "jackal", "koala", "lemur", "lynx", "marten",
+	"newt", "otter", "panda", "quail", "raven", "robin", "salmon", "tapir",
+	"toucan", "walrus", "wombat", "yak",
+}
+
+// randomName returns a random container name which isn't in use in the
+// daemon yet.
+func randomName(d *flex.Client) (string, error) {
+	list, err := d.List()
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool)
+	for _, ct := range list {
+		used[ct.Name] = true
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 100; i++ {
+		name := nameAdjectives[rnd.Intn(len(nameAdjectives))] + "-" + nameNouns[rnd.Intn(len(nameNouns))]
+		if i >= 50 {
+			name += fmt.Sprintf("-%d", rnd.Intn(1000))
+		}
+		if !used[name] {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find an unused container name")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"code.google.com/p/go.crypto/ssh/terminal"
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type execCmd struct {
+	env  envFlag
+	cwd  string
+	mode string
+}
+
+const execUsage = `
+flex exec [remote:]<container> [--env KEY=VALUE]... [--cwd <dir>] [--mode auto|interactive|non-interactive] -- <command> [<arg>...]
+
+Runs a command inside a running container, and exits with its exit status.
+
+In interactive mode the command runs on a terminal, and its output and
+errors are both written to stdout. Otherwise stdin, stdout and stderr are
+kept apart. The default is interactive mode if both stdin and stdout are
+terminals.
+`
+
+func (c *execCmd) usage() string {
+	return execUsage
+}
+
+func (c *execCmd) flags() {
+	gnuflag.Var(&c.env, "env", "Environment variable to set, as KEY=VALUE")
+	gnuflag.StringVar(&c.cwd, "cwd", "", "Working directory of the command")
+	gnuflag.StringVar(&c.mode, "mode", "auto", "Terminal mode: auto, interactive or non-interactive")
+}
+
+// envFlag collects the environment variables given with repeated --env flags.
+type envFlag map[string]string
+
+func (f *envFlag) String() string {
+	var kvs []string
+	for k, v := range *f {
+		kvs = append(kvs, k+"="+v)
+	}
+	return strings.Join(kvs, " ")
+}
+
+func (f *envFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("environment variable must be in the KEY=VALUE form: %q", s)
+	}
+	if *f == nil {
+		*f = make(envFlag)
+	}
+	(*f)[kv[0]] = kv[1]
+	return nil
+}
+
+// forwardControl returns a channel delivering the control messages for a
+// command run inside a container: the signals received by flex which are
+// meant for the command, and terminal resizes if the command is interactive.
+// The returned function stops the forwarding.
+func forwardControl(interactive bool) (<-chan flex.ExecControl, func()) {
+	ch := make(chan flex.ExecControl)
+	sigs := make(chan os.Signal, 8)
+	if interactive {
+		// Interrupts reach the command through the terminal.
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGWINCH)
+	} else {
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			var msg flex.ExecControl
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGWINCH {
+					width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+					if err != nil {
+						continue
+					}
+					msg = flex.ExecControl{Command: "window-resize", Width: width, Height: height}
+				} else {
+					msg = flex.ExecControl{Command: "signal", Signal: int(sig.(syscall.Signal))}
+				}
+			case <-done:
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch, func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// exitCodeError makes the command exit with the status it holds.
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("command exited with status %d", int(e))
+}
+
+func (c *execCmd) run(args []string) error {
+	if len(args) < 2 {
+		return errArgs
+	}
+
+	var interactive bool
+	switch c.mode {
+	case "auto":
+		interactive = terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stdout.Fd()))
+	case "interactive":
+		interactive = true
+	case "non-interactive":
+	default:
+		return fmt.Errorf("unknown terminal mode: %q", c.mode)
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+
+	opts := flex.ExecOptions{
+		Env:         c.env,
+		Cwd:         c.cwd,
+		Interactive: interactive,
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+	}
+	if interactive {
+		if _, ok := opts.Env["TERM"]; !ok {
+			if opts.Env == nil {
+				opts.Env = make(map[string]string)
+			}
+			opts.Env["TERM"] = os.Getenv("TERM")
+		}
+		opts.Width, opts.Height, _ = terminal.GetSize(int(os.Stdout.Fd()))
+		cfd := int(os.Stdin.Fd())
+		if terminal.IsTerminal(cfd) {
+			oldttystate, err := terminal.MakeRaw(cfd)
+			if err != nil {
+				return err
+			}
+			defer terminal.Restore(cfd, oldttystate)
+		}
+	}
+	control, stop := forwardControl(interactive)
+	defer stop()
+	opts.Control = control
+
+	code, err := d.Exec(name, args[1:], opts)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return exitCodeError(code)
+	}
+	return nil
+}
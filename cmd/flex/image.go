@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type imageCmd struct {
+	alias  string
+	public bool
+}
+
+const imageUsage = `
+Manage the images in the store of flex daemons
+
+flex image import <tarball> [remote:] [--alias=<alias>] [--public]
+                                                  Import an image tarball.
+flex image export [remote:]<image> [<dir>]        Export an image tarball.
+flex image list [remote:]                         List images.
+flex image info [remote:]<image>                  Show the details of an image.
+flex image delete [remote:]<image>                Delete an image.
+flex image public [remote:]<image>                Make an image public.
+flex image private [remote:]<image>               Make an image private again.
+flex image alias list [remote:]                   List image aliases.
+flex image alias create [remote:]<alias> <image>  Create an alias for an image.
+flex image alias delete [remote:]<alias>          Delete an image alias.
+
+Images are referred to by an alias, or by their fingerprint, which may be
+abbreviated to a unique prefix. Containers are created from images with
+"flex create".
+
+Public images may be listed and exported by untrusted clients, and other
+daemons may create containers from them, as in:
+
+    flex create otherhost:ubuntu/trusty c1
+
+in which case the daemon creating the container downloads the image from
+otherhost into its own store first, resuming interrupted downloads.
+
+Image tarballs may be compressed with gzip, bzip2 or xz, and hold:
+
+    metadata.yaml   The image metadata, described below.
+    rootfs/         The root filesystem of containers, with files owned
+                    by the ids seen from within them.
+    templates/      Optional templates of files in the root filesystem,
+                    rendered when containers are created.
+
+For example, this metadata.yaml renders templates/hostname.tpl into the
+/etc/hostname file of every container created from the image:
+
+    architecture: x86_64
+    creation_date: 1400000000
+    properties:
+      os: ubuntu
+      release: trusty
+      description: Ubuntu 14.04 LTS
+    templates:
+      /etc/hostname:
+        when: [create]
+        template: hostname.tpl
+
+Templates use the Go text/template syntax, with {{.Name}} holding the
+container name, {{.Architecture}} the image architecture, and
+{{.Properties}} the image properties. The fingerprint of an image is the
+SHA-256 hash of its tarball, and it's verified when importing and
+exporting images. Exported tarballs are named after it.
+`
+
+func (c *imageCmd) usage() string {
+	return imageUsage
+}
+
+func (c *imageCmd) flags() {
+	gnuflag.StringVar(&c.alias, "alias", "", "Alias for the imported image")
+	gnuflag.BoolVar(&c.public, "public", false, "Make the imported image public")
+}
+
+func (c *imageCmd) run(args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+	switch args[0] {
+	case "alias":
+		return c.runAlias(args[1:])
+	case "import":
+		return c.runImport(args[1:])
+	case "export":
+		return c.runExport(args[1:])
+	}
+	nargs := map[string]int{"list": 1, "info": 1, "delete": 1, "public": 1, "private": 1}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown image subcommand: %s", args[0])
+	}
+	if args[0] == "list" && len(args) == 1 {
+		args = append(args, "")
+	}
+	if len(args)-1 != n {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, ref, err := flex.NewClient(config, args[1])
+	if err != nil {
+		return err
+	}
+	if args[0] != "list" && ref == "" {
+		return errArgs
+	}
+
+	switch args[0] {
+	case "list":
+		images, err := d.Images()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ALIASES\tFINGERPRINT\tPUBLIC\tDESCRIPTION\tARCH\tSIZE\tUPLOADED")
+		for _, image := range images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", strings.Join(image.Aliases, ","), image.Fingerprint[:12], formatBool(image.Public),
+				image.Properties["description"], image.Architecture, formatSize(uint64(image.Size)), formatTime(image.UploadedAt))
+		}
+		return w.Flush()
+	case "info":
+		fingerprint, err := resolveImage(d, ref)
+		if err != nil {
+			return err
+		}
+		image, err := d.Image(fingerprint)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Fingerprint: %s\n", image.Fingerprint)
+		fmt.Printf("Size: %s\n", formatSize(uint64(image.Size)))
+		fmt.Printf("Architecture: %s\n", image.Architecture)
+		fmt.Printf("Public: %s\n", formatBool(image.Public))
+		fmt.Printf("Created: %s\n", formatTime(image.CreatedAt))
+		fmt.Printf("Uploaded: %s\n", formatTime(image.UploadedAt))
+		if len(image.Properties) > 0 {
+			keys := make([]string, 0, len(image.Properties))
+			for key := range image.Properties {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			fmt.Printf("Properties:\n")
+			for _, key := range keys {
+				fmt.Printf("  %s: %s\n", key, image.Properties[key])
+			}
+		}
+		if len(image.Aliases) > 0 {
+			fmt.Printf("Aliases: %s\n", strings.Join(image.Aliases, ", "))
+		}
+		return nil
+	case "delete":
+		fingerprint, err := resolveImage(d, ref)
+		if err != nil {
+			return err
+		}
+		return d.DeleteImage(fingerprint)
+	case "public", "private":
+		fingerprint, err := resolveImage(d, ref)
+		if err != nil {
+			return err
+		}
+		return d.SetImagePublic(fingerprint, args[0] == "public")
+	}
+	panic("unreachable")
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// runImport imports the image tarball in args[0] into the daemon in
+// args[1], if provided.
+func (c *imageCmd) runImport(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	remote := config.DefaultRemote
+	if len(args) == 2 {
+		remote = args[1]
+	}
+	d, _, err := flex.NewClient(config, remote)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	image, err := d.ImportImage(f, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Image imported with fingerprint: %s\n", image.Fingerprint)
+	if c.public {
+		err = d.SetImagePublic(image.Fingerprint, true)
+		if err != nil {
+			return err
+		}
+	}
+	if c.alias != "" {
+		return d.CreateImageAlias(c.alias, image.Fingerprint, "")
+	}
+	return nil
+}
+
+// runExport writes the tarball of the image in args[0] into the directory
+// in args[1], or the current one.
+func (c *imageCmd) runExport(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errArgs
+	}
+	dir := "."
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, ref, err := flex.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+	if ref == "" {
+		return errArgs
+	}
+	fingerprint, err := resolveImage(d, ref)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".export_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	filename, err := d.ExportImage(fingerprint, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, filename)
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Image exported to: %s\n", path)
+	return nil
+}
+
+// runAlias runs the image alias subcommand in args[0].
+func (c *imageCmd) runAlias(args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+	nargs := map[string]int{"list": 1, "create": 2, "delete": 1}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown image alias subcommand: %s", args[0])
+	}
+	if args[0] == "list" && len(args) == 1 {
+		args = append(args, "")
+	}
+	if len(args)-1 != n {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, args[1])
+	if err != nil {
+		return err
+	}
+	if args[0] != "list" && name == "" {
+		return errArgs
+	}
+
+	switch args[0] {
+	case "list":
+		aliases, err := d.ImageAliases()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ALIAS\tFINGERPRINT\tDESCRIPTION")
+		for _, alias := range aliases {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", alias.Name, alias.Target[:12], alias.Description)
+		}
+		return w.Flush()
+	case "create":
+		fingerprint, err := resolveImage(d, args[2])
+		if err != nil {
+			return err
+		}
+		return d.CreateImageAlias(name, fingerprint, "")
+	case "delete":
+		return d.DeleteImageAlias(name)
+	}
+	panic("unreachable")
+}
+
+// resolveImage returns the fingerprint of the image referred to by ref,
+// which is either an alias or a fingerprint, possibly abbreviated.
+func resolveImage(d *flex.Client, ref string) (string, error) {
+	alias, err := d.ImageAlias(ref)
+	if err == nil {
+		return alias.Target, nil
+	}
+	if e, ok := err.(*flex.Error); ok && e.StatusCode == http.StatusNotFound {
+		return ref, nil
+	}
+	return "", err
+}
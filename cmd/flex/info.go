@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/niemeyer/flex"
+)
+
+type infoCmd struct{}
+
+const infoUsage = `
+flex info [remote:]<container>
+
+Shows the details of a container, and how it's doing if it's running.
+`
+
+func (c *infoCmd) usage() string {
+	return infoUsage
+}
+
+func (c *infoCmd) flags() {}
+
+func (c *infoCmd) run(args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+	info, err := d.Container(name)
+	if err != nil {
+		return err
+	}
+	state, err := d.Status(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name: %s\n", info.Name)
+	fmt.Printf("Status: %s\n", state.Status)
+	if info.Source != "" {
+		fmt.Printf("Source: %s\n", info.Source)
+	}
+	fmt.Printf("Created: %s\n", formatTime(info.CreatedAt))
+	fmt.Printf("Last used: %s\n", formatTime(info.LastUsedAt))
+	fmt.Printf("Profiles: %s\n", strings.Join(info.Profiles, ", "))
+	if len(info.Snapshots) > 0 {
+		snapshots, err := d.Snapshots(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Snapshots:\n")
+		for _, snapshot := range snapshots {
+			fmt.Printf("  %s (taken %s)\n", snapshot.Name, formatTime(snapshot.CreatedAt))
+		}
+	}
+	if state.Status != "RUNNING" {
+		return nil
+	}
+	fmt.Printf("Init PID: %d\n", state.InitPID)
+	fmt.Printf("Uptime: %s\n", time.Since(state.StartedAt).Truncate(time.Second))
+	fmt.Printf("Processes: %d\n", state.Processes)
+	if state.MemoryUsage > 0 {
+		fmt.Printf("Memory: %s\n", formatSize(state.MemoryUsage))
+	}
+	if state.CPUTime > 0 {
+		fmt.Printf("CPU time: %s\n", state.CPUTime.Truncate(time.Millisecond))
+	}
+	if len(state.Addresses) > 0 {
+		ifaces := make([]string, 0, len(state.Addresses))
+		for iface := range state.Addresses {
+			ifaces = append(ifaces, iface)
+		}
+		sort.Strings(ifaces)
+		fmt.Printf("Addresses:\n")
+		for _, iface := range ifaces {
+			fmt.Printf("  %s: %s\n", iface, strings.Join(state.Addresses[iface], ", "))
+		}
+	}
+	return nil
+}
+
+// formatTime returns t in the local time zone, or "never" if it's zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05 MST")
+}
+
+// formatSize returns size, in bytes, in the largest binary unit which
+// keeps it above one.
+func formatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
@@ -1,48 +1,172 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
 	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+	"gopkg.in/yaml.v2"
 )
 
-type listCmd struct{}
+type listCmd struct {
+	format  string
+	columns string
+}
 
 const listUsage = `
-flex list
+flex list [remote:] [<key>=<value>...]
+
+Lists the containers of the flex daemon, or only those matching all of
+the provided filters. Filters match the container name, its state, one
+of its profiles, or the value of a configuration key. For example:
 
-Gets a list of containers from the flex daemon
+    flex list state=RUNNING user.team=infra
+
+The list may be printed as a table, or as json, yaml or csv. Tables and
+csv hold the selected columns, out of name, state, ipv4, ipv6, pid,
+created and profiles, while json and yaml hold complete records.
 `
 
 func (c *listCmd) usage() string {
 	return listUsage
 }
 
-func (c *listCmd) flags() {}
+func (c *listCmd) flags() {
+	gnuflag.StringVar(&c.format, "format", "table", "Output format: table, json, yaml or csv")
+	gnuflag.StringVar(&c.columns, "columns", "name,state,ipv4,ipv6,profiles", "Comma-separated columns of tables and csv")
+}
 
-func (c *listCmd) run(args []string) error {
-	if len(args) > 1 {
-		return errArgs
+// listColumns holds the functions returning the value of each column for
+// a container.
+var listColumns = map[string]func(ct *flex.ContainerInfo) string{
+	"name":  func(ct *flex.ContainerInfo) string { return ct.Name },
+	"state": func(ct *flex.ContainerInfo) string { return ct.State },
+	"ipv4":  func(ct *flex.ContainerInfo) string { return listAddresses(ct, false) },
+	"ipv6":  func(ct *flex.ContainerInfo) string { return listAddresses(ct, true) },
+	"pid": func(ct *flex.ContainerInfo) string {
+		if ct.Runtime == nil || ct.Runtime.InitPID == 0 {
+			return ""
+		}
+		return strconv.Itoa(ct.Runtime.InitPID)
+	},
+	"created":  func(ct *flex.ContainerInfo) string { return formatTime(ct.CreatedAt) },
+	"profiles": func(ct *flex.ContainerInfo) string { return strings.Join(ct.Profiles, ",") },
+}
+
+// listAddresses returns the IPv4 or IPv6 addresses of the container, with
+// their interfaces, leaving out loopback ones.
+func listAddresses(ct *flex.ContainerInfo, ipv6 bool) string {
+	if ct.Runtime == nil {
+		return ""
+	}
+	var result []string
+	for iface, addrs := range ct.Runtime.Addresses {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || ip.IsLoopback() || (ip.To4() == nil) != ipv6 {
+				continue
+			}
+			result = append(result, fmt.Sprintf("%s (%s)", addr, iface))
+		}
 	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+func (c *listCmd) run(args []string) error {
 	config, err := flex.LoadConfig()
 	if err != nil {
 		return err
 	}
 
-	var remote string
-	if len(args) == 1 {
+	remote := config.DefaultRemote
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
 		remote = args[0]
-	} else {
-		remote = config.DefaultRemote
+		args = args[1:]
+	}
+	for _, arg := range args {
+		if !strings.Contains(arg, "=") {
+			return errArgs
+		}
+	}
+
+	columns := strings.Split(c.columns, ",")
+	for _, column := range columns {
+		if listColumns[column] == nil {
+			return fmt.Errorf("unknown column: %s", column)
+		}
+	}
+	switch c.format {
+	case "table", "json", "yaml", "csv":
+	default:
+		return fmt.Errorf("unknown format: %s", c.format)
 	}
 
 	d, _, err := flex.NewClient(config, remote)
 	if err != nil {
 		return err
 	}
-	l, err := d.List()
+	list, err := d.List(args...)
+	if err != nil {
+		return err
+	}
+
+	switch c.format {
+	case "json":
+		data, err := json.MarshalIndent(list, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	case "yaml":
+		return printYAML(list)
+	}
+
+	rows := [][]string{}
+	for i := range list {
+		row := make([]string, len(columns))
+		for j, column := range columns {
+			row[j] = listColumns[column](&list[i])
+		}
+		rows = append(rows, row)
+	}
+	if c.format == "csv" {
+		w := csv.NewWriter(os.Stdout)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// printYAML prints value as YAML, with the same keys as in its JSON form.
+func printYAML(value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+	data, err = yaml.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	fmt.Println(l)
+	_, err = os.Stdout.Write(data)
 	return err
 }
@@ -12,6 +12,9 @@ import (
 
 func main() {
 	if err := run(); err != nil {
+		if code, ok := err.(exitCodeError); ok {
+			os.Exit(int(code))
+		}
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
@@ -55,29 +58,41 @@ type command interface {
 }
 
 var commands = map[string]command{
-	"version": &versionCmd{},
-	"help":    &helpCmd{},
-	"daemon":  &daemonCmd{},
-	"ping":    &pingCmd{},
-	"list":    &listCmd{},
-	"create":  &createCmd{},
-	"attach":  &attachCmd{},
-	"remote":  &remoteCmd{},
+	"version":    &versionCmd{},
+	"help":       &helpCmd{},
+	"daemon":     &daemonCmd{},
+	"ping":       &pingCmd{},
+	"list":       &listCmd{},
+	"info":       &infoCmd{},
+	"create":     &createCmd{},
+	"launch":     &createCmd{launch: true},
+	"attach":     &attachCmd{},
+	"exec":       &execCmd{},
+	"remote":     &remoteCmd{},
+	"config":     &configCmd{},
+	"profile":    &profileCmd{},
+	"image":      &imageCmd{},
+	"publish":    &publishCmd{},
+	"snapshot":   &snapshotCmd{},
+	"restore":    &restoreCmd{},
+	"checkpoint": &checkpointCmd{},
+	"delete":     &deleteCmd{},
+	"monitor":    &monitorCmd{},
 	"reboot": &byNameCmd{
 		"reboot",
-		func(c *flex.Client, name string) (string, error) { return c.Reboot(name) },
+		func(c *flex.Client, name string) error { return c.Reboot(name) },
 	},
 	"destroy": &byNameCmd{
 		"destroy",
-		func(c *flex.Client, name string) (string, error) { return c.Destroy(name) },
+		func(c *flex.Client, name string) error { return c.Destroy(name) },
 	},
 	"start": &byNameCmd{
 		"start",
-		func(c *flex.Client, name string) (string, error) { return c.Start(name) },
+		func(c *flex.Client, name string) error { return c.Start(name) },
 	},
 	"stop": &byNameCmd{
 		"stop",
-		func(c *flex.Client, name string) (string, error) { return c.Stop(name) },
+		func(c *flex.Client, name string) error { return c.Stop(name) },
 	},
 
 	// This is a demo command. Drop after ideas are understood.
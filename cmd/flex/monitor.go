@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type monitorCmd struct {
+	types string
+}
+
+const monitorUsage = `
+flex monitor [remote:]
+
+Prints events from the flex daemon as they happen.
+
+Events may be restricted to some types with --type, which takes a
+comma-separated list of "container" and "operation".
+`
+
+func (c *monitorCmd) usage() string {
+	return monitorUsage
+}
+
+func (c *monitorCmd) flags() {
+	gnuflag.StringVar(&c.types, "type", "", "Comma-separated event types to print")
+}
+
+func (c *monitorCmd) run(args []string) error {
+	if len(args) > 1 {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	var remote string
+	if len(args) == 1 {
+		remote = args[0]
+	} else {
+		remote = config.DefaultRemote
+	}
+
+	d, _, err := flex.NewClient(config, remote)
+	if err != nil {
+		return err
+	}
+
+	var types []string
+	if c.types != "" {
+		types = strings.Split(c.types, ",")
+	}
+	stream, err := d.Events(types...)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case e, ok := <-stream.Events:
+			if !ok {
+				return stream.Err()
+			}
+			fmt.Println(formatEvent(e))
+		case <-ch:
+			return nil
+		}
+	}
+}
+
+func formatEvent(e *flex.Event) string {
+	stamp := e.Timestamp.Local().Format(time.RFC3339)
+	switch e.Type {
+	case "container":
+		var ce flex.ContainerEvent
+		if json.Unmarshal(e.Metadata, &ce) == nil {
+			return fmt.Sprintf("%s container %s %s", stamp, ce.Name, ce.Action)
+		}
+	case "operation":
+		var op flex.Operation
+		if json.Unmarshal(e.Metadata, &op) == nil {
+			line := fmt.Sprintf("%s operation %s (%s) %s", stamp, op.ID, op.Description, op.Status)
+			if op.Progress != "" && !op.Done() {
+				line += ": " + op.Progress
+			}
+			if op.Error != "" {
+				line += ": " + op.Error
+			}
+			return line
+		}
+	}
+	return fmt.Sprintf("%s %s %s", stamp, e.Type, e.Metadata)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"strconv"
 
 	"github.com/niemeyer/flex"
 	"github.com/niemeyer/flex/internal/gnuflag"
@@ -64,32 +63,37 @@ func (c *moveCmd) run(args []string) error {
 		return fmt.Errorf("checkpointing to local remote not supported")
 	}
 
-	result, err := sourced.Checkpoint(name, c.stop, c.verbose)
+	op, err := sourced.CreateCheckpoint(name, c.stop, c.verbose)
 	if err != nil {
 		return err
 	}
-
-	// This is a hack right now: we're not returning errors as json, so we
-	// just try to convert the thing to an int (i.e. a checkpoint id) and
-	// if it fails, it must have been a string error message.
-	id, err := strconv.Atoi(result)
+	op, err = waitOperation(sourced, op)
 	if err != nil {
-		return fmt.Errorf("%s", result)
+		return err
 	}
-
-	result, err = sourced.SendContainer(targetd.Remote, name, id)
+	var checkpoint flex.CheckpointInfo
+	err = op.Result(&checkpoint)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(result)
-
-	result, err = targetd.Restore(name, id, c.verbose)
+	op, err = sourced.SendContainer(targetd.Remote, name, checkpoint.ID)
+	if err != nil {
+		return err
+	}
+	_, err = waitOperation(sourced, op)
+	if err != nil {
+		return err
+	}
+	err = targetd.ReceiveContainer(name)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(result)
-
-	return nil
+	op, err = targetd.RestoreCheckpoint(name, checkpoint.ID, c.verbose)
+	if err != nil {
+		return err
+	}
+	_, err = waitOperation(targetd, op)
+	return err
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/niemeyer/flex"
+)
+
+// waitOperation waits until the background operation op finishes, reporting
+// its progress on stderr, and returns an error if it did not succeed.
+//
+// Interrupting the command with Ctrl-C cancels the operation if it supports
+// that, or otherwise leaves it running in the background.
+func waitOperation(d *flex.Client, op *flex.Operation) (*flex.Operation, error) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	progress := ""
+	cancelled := false
+	for !op.Done() {
+		if op.Progress != progress {
+			progress = op.Progress
+			fmt.Fprintf(os.Stderr, "%s: %s\n", op.Description, progress)
+		}
+
+		select {
+		case <-interrupt:
+			if !op.MayCancel {
+				return nil, fmt.Errorf("interrupted; operation %s continues in the background", op.ID)
+			}
+			if !cancelled {
+				err := d.CancelOperation(op.ID)
+				if err != nil {
+					return nil, err
+				}
+				cancelled = true
+			}
+		default:
+		}
+
+		var err error
+		op, err = d.WaitForOperation(op.ID, time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Status {
+	case flex.OperationSuccess:
+		return op, nil
+	case flex.OperationCancelled:
+		return nil, fmt.Errorf("%s: cancelled", op.Description)
+	}
+	return nil, fmt.Errorf("%s", op.Error)
+}
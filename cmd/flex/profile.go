@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"code.google.com/p/go.crypto/ssh/terminal"
+	"github.com/niemeyer/flex"
+	"gopkg.in/yaml.v2"
+)
+
+type profileCmd struct{}
+
+const profileUsage = `
+Manage configuration profiles
+
+flex profile list [remote:]                             List profiles.
+flex profile create [remote:]<profile>                  Create an empty profile.
+flex profile edit [remote:]<profile>                    Edit the profile configuration.
+flex profile apply [remote:]<container> <profile>[,...] Apply profiles to a container.
+flex profile delete [remote:]<profile>                  Delete a profile.
+
+Profiles hold configuration keys and devices, as described in "flex help
+config", which are shared by the containers they're applied to. Profiles
+are applied in order, and the keys and devices set in the container itself
+take precedence over theirs. Containers use the "default" profile unless
+others are requested.
+
+The profile is edited with $EDITOR, as YAML. If stdin is not a terminal,
+the new profile is read from it instead.
+
+"flex profile apply" with an empty list of profiles removes them all.
+`
+
+func (c *profileCmd) usage() string {
+	return profileUsage
+}
+
+func (c *profileCmd) flags() {}
+
+func (c *profileCmd) run(args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+	nargs := map[string]int{"list": 1, "create": 1, "edit": 1, "apply": 2, "delete": 1}
+	n, ok := nargs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown profile subcommand: %s", args[0])
+	}
+	if args[0] == "list" && len(args) == 1 {
+		args = append(args, "")
+	}
+	if len(args)-1 != n {
+		return errArgs
+	}
+
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, args[1])
+	if err != nil {
+		return err
+	}
+	if args[0] != "list" && name == "" {
+		return errArgs
+	}
+
+	switch args[0] {
+	case "list":
+		profiles, err := d.Profiles()
+		if err != nil {
+			return err
+		}
+		for _, profile := range profiles {
+			fmt.Println(profile.Name)
+		}
+		return nil
+	case "create":
+		return d.CreateProfile(name, nil, nil)
+	case "edit":
+		return editProfile(d, name)
+	case "apply":
+		var profiles []string
+		if args[2] != "" {
+			profiles = strings.Split(args[2], ",")
+		}
+		return d.ApplyProfiles(name, profiles)
+	case "delete":
+		return d.DeleteProfile(name)
+	}
+	panic("unreachable")
+}
+
+const profileEditHeader = `### This is the profile %q, in YAML format. Keys and devices
+### are described in "flex help config". For example:
+###
+### config:
+###   limits.memory: 512MB
+###   environment.http_proxy: http://proxy:3128/
+### devices:
+###   data:
+###     type: disk
+###     source: /srv/data
+###     path: /data
+`
+
+// profileDoc is the document edited by "flex profile edit".
+type profileDoc struct {
+	Config  map[string]string      `yaml:"config"`
+	Devices map[string]flex.Device `yaml:"devices"`
+}
+
+// editProfile replaces the configuration and devices of the named profile
+// by those read from stdin, or edited by the user if stdin is a terminal.
+func editProfile(d *flex.Client, name string) error {
+	var data []byte
+	var err error
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		data, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		profile, err := d.Profile(name)
+		if err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(&profileDoc{profile.Config, profile.Devices})
+		if err != nil {
+			return err
+		}
+		data, err = editText(append([]byte(fmt.Sprintf(profileEditHeader, name)), data...))
+		if err != nil {
+			return err
+		}
+	}
+	var doc profileDoc
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Errorf("cannot parse profile: %v", err)
+	}
+	return d.UpdateProfile(name, doc.Config, doc.Devices)
+}
+
+// editText runs the editor in $EDITOR, or vi, on a temporary file holding
+// text, and returns the edited text.
+func editText(text []byte) ([]byte, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	f, err := ioutil.TempFile("", "flex_edit_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(text)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$0"`, f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("editor failed: %v", err)
+	}
+	text, err = ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(text), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
+)
+
+type publishCmd struct {
+	alias      string
+	public     bool
+	properties configFlag
+}
+
+const publishUsage = `
+flex publish [remote:]<container>[/<snapshot>] [--alias=<alias>] [--public] [--property <key>=<value>]...
+
+Adds an image made of the root filesystem of a container, or of its
+snapshot, to the store of the daemon holding it, so that other
+containers may be created from it. Unless a snapshot is published, the
+container is stopped while its root filesystem is packed if it's
+running, and started again afterwards.
+
+File owners are shifted back to the ids seen from within the container,
+so the image may be used by other daemons. The architecture and the os
+and release properties of the image are taken from the image the
+container was created from, when known.
+`
+
+func (c *publishCmd) usage() string {
+	return publishUsage
+}
+
+func (c *publishCmd) flags() {
+	gnuflag.StringVar(&c.alias, "alias", "", "Alias for the published image")
+	gnuflag.BoolVar(&c.public, "public", false, "Make the published image public")
+	gnuflag.Var(&c.properties, "property", "Image property to set, as KEY=VALUE")
+}
+
+func (c *publishCmd) run(args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return err
+	}
+	d, name, err := flex.NewClient(config, args[0])
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errArgs
+	}
+	op, err := d.Publish(name, c.alias, c.public, c.properties)
+	if err != nil {
+		return err
+	}
+	op, err = waitOperation(d, op)
+	if err != nil {
+		return err
+	}
+	var image flex.ImageInfo
+	err = op.Result(&image)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Image published with fingerprint: %s\n", image.Fingerprint)
+	return nil
+}
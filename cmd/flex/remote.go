@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"strings"
+
+	"code.google.com/p/go.crypto/ssh/terminal"
 	"github.com/niemeyer/flex"
+	"github.com/niemeyer/flex/internal/gnuflag"
 )
 
 type remoteCmd struct {
-	httpAddr string
+	password   string
+	acceptCert bool
 }
 
 const remoteUsage = `
@@ -19,13 +26,22 @@ flex remote rename <old> <new>       Rename remote <old> to <new>.
 flex remote set-url <name> <url>     Update <name>'s url to <url>.
 
 Manage remote flex servers.
+
+When adding a remote, the fingerprint of the certificate presented by
+its daemon is shown for confirmation, and the certificate is pinned so
+that later connections to a different daemon are refused. If the daemon
+doesn't trust the client yet, its trust password is requested. That
+password is set with "flex config trust password" on the remote host.
 `
 
 func (c *remoteCmd) usage() string {
 	return remoteUsage
 }
 
-func (c *remoteCmd) flags() {}
+func (c *remoteCmd) flags() {
+	gnuflag.StringVar(&c.password, "password", "", "Trust password of the remote daemon")
+	gnuflag.BoolVar(&c.acceptCert, "accept-certificate", false, "Accept the remote certificate without confirmation")
+}
 
 func (c *remoteCmd) run(args []string) error {
 	if len(args) < 1 {
@@ -50,7 +66,10 @@ func (c *remoteCmd) run(args []string) error {
 		if config.Remotes == nil {
 			config.Remotes = make(map[string]flex.RemoteConfig)
 		}
-		config.Remotes[args[1]] = flex.RemoteConfig{args[2]}
+		err := c.addRemote(config, args[1], args[2])
+		if err != nil {
+			return err
+		}
 	case "rm":
 		if len(args) != 2 {
 			return errArgs
@@ -88,12 +107,90 @@ func (c *remoteCmd) run(args []string) error {
 		if len(args) != 3 {
 			return errArgs
 		}
-		_, ok := config.Remotes[args[1]]
+		rc, ok := config.Remotes[args[1]]
 		if !ok {
 			return fmt.Errorf("remote %s doesn't exist", args[1])
 		}
-		config.Remotes[args[1]] = flex.RemoteConfig{args[2]}
+		// The pinned certificate still applies, so the daemon must
+		// be the same one reached at a different address.
+		rc.Addr = args[2]
+		config.Remotes[args[1]] = rc
+	default:
+		return fmt.Errorf("unknown remote subcommand: %s", args[0])
 	}
 
 	return flex.SaveConfig(config)
 }
+
+// addRemote adds the daemon at addr to config as the remote name, after
+// confirming its certificate and getting the client trusted by it.
+func (c *remoteCmd) addRemote(config *flex.Config, name string, addr string) error {
+	cert, err := flex.RemoteCert(addr)
+	if err != nil {
+		return fmt.Errorf("cannot get certificate of %s: %v", addr, err)
+	}
+	fingerprint := flex.CertFingerprint(cert)
+	fmt.Printf("Certificate fingerprint: %s\n", fingerprint)
+	if !c.acceptCert {
+		answer, err := prompt("Accept certificate? (y/n): ")
+		if err != nil {
+			return err
+		}
+		if answer != "y" && answer != "yes" {
+			return fmt.Errorf("certificate not accepted")
+		}
+	}
+	config.Remotes[name] = flex.RemoteConfig{Addr: addr, CertFingerprint: fingerprint}
+
+	d, _, err := flex.NewClient(config, name+":")
+	if err != nil {
+		return err
+	}
+	info, err := d.APIInfo()
+	if err != nil {
+		return err
+	}
+	if info.Auth == "trusted" {
+		return nil
+	}
+
+	password := c.password
+	if password == "" {
+		password, err = promptPassword(fmt.Sprintf("Trust password for %s: ", name))
+		if err != nil {
+			return err
+		}
+	}
+	err = d.RequestTrust(password)
+	if err != nil {
+		return fmt.Errorf("cannot get trusted by %s: %v", name, err)
+	}
+	fmt.Println("Client certificate trusted by the remote daemon.")
+	return nil
+}
+
+// prompt prints msg and returns the line then typed on stdin.
+func prompt(msg string) (string, error) {
+	fmt.Print(msg)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("cannot read answer: %v", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// promptPassword is like prompt, but doesn't echo what's typed if stdin
+// is a terminal.
+func promptPassword(msg string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return prompt(msg)
+	}
+	fmt.Print(msg)
+	data, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("cannot read password: %v", err)
+	}
+	return string(data), nil
+}
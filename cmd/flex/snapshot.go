@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/niemeyer/flex"
+)
+
+type snapshotCmd struct{}
+
+const snapshotUsage = `
+flex snapshot [remote:]<container> [<snapshot>]
+
+Takes a snapshot of the root filesystem of a container, along with its
+profiles, configuration and devices. The container is stopped while
+that happens if it's running, and started again afterwards. Snapshots
+are named snap0, snap1, ... unless a name is provided.
+
+Snapshots are listed by "flex info", brought back with "flex restore",
+published as images with "flex publish <container>/<snapshot>", and
+deleted with "flex delete <container>/<snapshot>".
+`
+
+func (c *snapshotCmd) usage() string {
+	return snapshotUsage
+}
+
+func (c *snapshotCmd) flags() {}
+
+func (c *snapshotCmd) run(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errArgs
+	}
+	d, name, err := containerClient(args[0])
+	if err != nil {
+		return err
+	}
+	snapshot := ""
+	if len(args) == 2 {
+		snapshot = args[1]
+	}
+	op, err := d.CreateSnapshot(name, snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = waitOperation(d, op)
+	return err
+}
+
+type restoreCmd struct{}
+
+const restoreUsage = `
+flex restore [remote:]<container> <snapshot>
+
+Brings a container back to the state recorded in its snapshot, replacing
+its root filesystem, profiles, configuration and devices. The container
+is stopped while that happens if it's running, and started again
+afterwards.
+`
+
+func (c *restoreCmd) usage() string {
+	return restoreUsage
+}
+
+func (c *restoreCmd) flags() {}
+
+func (c *restoreCmd) run(args []string) error {
+	if len(args) != 2 {
+		return errArgs
+	}
+	d, name, err := containerClient(args[0])
+	if err != nil {
+		return err
+	}
+	op, err := d.RestoreSnapshot(name, args[1])
+	if err != nil {
+		return err
+	}
+	_, err = waitOperation(d, op)
+	return err
+}
+
+type deleteCmd struct{}
+
+const deleteUsage = `
+flex delete [remote:]<container>[/<snapshot>]
+
+Deletes a snapshot of a container, or the container itself along with
+its snapshots, which must be stopped.
+`
+
+func (c *deleteCmd) usage() string {
+	return deleteUsage
+}
+
+func (c *deleteCmd) flags() {}
+
+func (c *deleteCmd) run(args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+	d, name, err := containerClient(args[0])
+	if err != nil {
+		return err
+	}
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return d.Destroy(name)
+	}
+	op, err := d.DeleteSnapshot(name[:i], name[i+1:])
+	if err != nil {
+		return err
+	}
+	_, err = waitOperation(d, op)
+	return err
+}
+
+// containerClient returns a client for the daemon holding the container
+// referred to by ref, along with the container name.
+func containerClient(ref string) (*flex.Client, string, error) {
+	config, err := flex.LoadConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	d, name, err := flex.NewClient(config, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	if name == "" {
+		return nil, "", errArgs
+	}
+	return d, name, nil
+}
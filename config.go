@@ -29,11 +29,28 @@ type Config struct {
 	// to listen on. If empty, the daemon will listen only on the local
 	// unix socket address.
 	ListenAddr string `yaml:"listen-addr"`
+
+	// Backend selects the driver the local daemon uses to manage
+	// containers. It may be "lxc" or "fake", the latter only pretending
+	// to run containers, for testing purposes. If empty it defaults
+	// to "lxc".
+	Backend string `yaml:"backend,omitempty"`
+
+	// ImageServers maps names to the addresses of servers publishing
+	// images in the simplestreams format, for the local daemon to
+	// create containers from, as in "images:ubuntu/trusty/amd64".
+	// Addresses are http, https or file URLs.
+	ImageServers map[string]string `yaml:"image-servers,omitempty"`
 }
 
 // RemoteConfig holds details for communication with a remote daemon.
 type RemoteConfig struct {
 	Addr string `yaml:"addr"`
+
+	// CertFingerprint holds the fingerprint of the certificate the
+	// remote daemon presented when it was added. Connections to a
+	// daemon presenting a different certificate are refused.
+	CertFingerprint string `yaml:"cert-fingerprint,omitempty"`
 }
 
 var configPath = "$HOME/.flex/config.yaml"
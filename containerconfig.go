@@ -0,0 +1,260 @@
+package flex
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// configKey describes a container configuration key. The value of a key
+// is always a string, which check validates if not nil.
+type configKey struct {
+	check func(value string) error
+}
+
+// containerConfigKeys holds the known container configuration keys.
+var containerConfigKeys = map[string]configKey{
+	"limits.cpu":           {checkCPULimit},
+	"limits.cpu.allowance": {checkCPUAllowance},
+	"limits.memory":        {checkSize},
+	"limits.memory.swap":   {checkBool},
+	"limits.processes":     {checkPositive},
+	"limits.disk.priority": {checkDiskPriority},
+
+	"security.nesting": {checkBool},
+
+	"boot.autostart":          {checkBool},
+	"boot.autostart.delay":    {checkUint},
+	"boot.autostart.priority": {checkInt},
+
+	"checkpoint.retain": {checkUint},
+}
+
+// containerConfigPrefixes holds the namespaces which accept any key with
+// the respective prefix, by prefix.
+var containerConfigPrefixes = map[string]configKey{
+	// Set in the environment of the container init and of commands
+	// run with exec.
+	"environment.": {nil},
+
+	// Free-form, left for users to annotate containers with.
+	"user.": {nil},
+}
+
+// lookupConfigKey returns the description of key, and whether it's known.
+func lookupConfigKey(key string) (configKey, bool) {
+	if k, ok := containerConfigKeys[key]; ok {
+		return k, true
+	}
+	for prefix, k := range containerConfigPrefixes {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return k, true
+		}
+	}
+	return configKey{}, false
+}
+
+// checkConfigKey returns an error if value is not valid for key.
+func checkConfigKey(key string, value string) error {
+	k, ok := lookupConfigKey(key)
+	if !ok {
+		return fmt.Errorf("unknown configuration key %q", key)
+	}
+	// Keys and values end up in LXC configuration files, where a newline
+	// would start a line of the caller's choosing.
+	if strings.IndexFunc(key, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid configuration key %q", key)
+	}
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid value for %s: %q has control characters", key, value)
+	}
+	if strings.HasPrefix(key, "environment.") && strings.Contains(key, "=") {
+		return fmt.Errorf("invalid environment variable name %q", strings.TrimPrefix(key, "environment."))
+	}
+	if k.check == nil {
+		return nil
+	}
+	if err := k.check(value); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return nil
+}
+
+// checkContainerConfig returns an error if any of the keys in config is
+// unknown or has an invalid value.
+func checkContainerConfig(config map[string]string) error {
+	for key, value := range config {
+		err := checkConfigKey(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBool(value string) error {
+	_, err := parseConfigBool(value)
+	return err
+}
+
+// parseConfigBool returns the boolean value of a configuration key, which
+// is false when the key is unset.
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "1", "yes", "on":
+		return true, nil
+	case "", "false", "0", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", value)
+}
+
+func checkInt(value string) error {
+	_, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	return nil
+}
+
+func checkUint(value string) error {
+	_, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a non-negative integer", value)
+	}
+	return nil
+}
+
+func checkPositive(value string) error {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n == 0 {
+		return fmt.Errorf("%q is not a positive integer", value)
+	}
+	return nil
+}
+
+func checkSize(value string) error {
+	_, err := parseSize(value)
+	return err
+}
+
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"B":   1,
+	"kB":  1000,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+var sizeExp = regexp.MustCompile(`^([0-9]+)\s*([a-zA-Z]*)$`)
+
+// parseSize returns the number of bytes in a size such as "512MB" or
+// "2GiB". Numbers without a unit are in bytes.
+func parseSize(value string) (uint64, error) {
+	m := sizeExp.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("%q is not a size", value)
+	}
+	unit, ok := sizeUnits[m[2]]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", m[2])
+	}
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil || n > (1<<64-1)/unit {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return n * unit, nil
+}
+
+var cpuSetExp = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// parseCPULimit parses the value of limits.cpu, which is either a number of
+// CPUs, or a set of them such as "0-3,6", where a single CPU is given as a
+// range such as "2-2". It returns the CPU set to use.
+func parseCPULimit(value string) (string, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n <= 0 {
+			return "", fmt.Errorf("number of CPUs must be positive")
+		}
+		if n == 1 {
+			return "0", nil
+		}
+		return fmt.Sprintf("0-%d", n-1), nil
+	}
+	if !cpuSetExp.MatchString(value) {
+		return "", fmt.Errorf("%q is neither a number of CPUs nor a CPU set", value)
+	}
+	return value, nil
+}
+
+func checkCPULimit(value string) error {
+	_, err := parseCPULimit(value)
+	return err
+}
+
+var cpuAllowanceExp = regexp.MustCompile(`^([0-9]+)ms/([0-9]+)ms$`)
+
+// parseCPUAllowance parses the value of limits.cpu.allowance, which is
+// either a percentage such as "50%", giving the share of CPU time the
+// container gets when the host is busy, or a hard limit such as
+// "25ms/100ms", giving the CPU time the container may use in each period.
+// It returns the CPU shares, or the quota and period in microseconds, with
+// the unused values set to zero.
+func parseCPUAllowance(value string) (shares int, quota int, period int, err error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, 0, 0, fmt.Errorf("%q is not a percentage between 1%% and 100%%", value)
+		}
+		// The default of 1024 shares is all the CPU time.
+		shares = 1024 * percent / 100
+		if shares < 2 {
+			shares = 2
+		}
+		return shares, 0, 0, nil
+	}
+	m := cpuAllowanceExp.FindStringSubmatch(value)
+	if m == nil {
+		return 0, 0, 0, fmt.Errorf("%q is neither a percentage nor a time such as 25ms/100ms", value)
+	}
+	quota, _ = strconv.Atoi(m[1])
+	period, _ = strconv.Atoi(m[2])
+	// The kernel accepts periods from 1ms to 1s, and quotas from 1ms.
+	if quota < 1 || period < 1 || period > 1000 {
+		return 0, 0, 0, fmt.Errorf("CPU time in %q out of range", value)
+	}
+	return 0, quota * 1000, period * 1000, nil
+}
+
+func checkCPUAllowance(value string) error {
+	_, _, _, err := parseCPUAllowance(value)
+	return err
+}
+
+func checkDiskPriority(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > 10 {
+		return fmt.Errorf("%q is not a priority between 0 and 10", value)
+	}
+	return nil
+}
+
+// containerEnv returns the environment variables set by the environment.*
+// keys in config, by name.
+func containerEnv(config map[string]string) map[string]string {
+	env := make(map[string]string)
+	for key, value := range config {
+		if strings.HasPrefix(key, "environment.") {
+			env[strings.TrimPrefix(key, "environment.")] = value
+		}
+	}
+	return env
+}
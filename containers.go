@@ -0,0 +1,788 @@
+package flex
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerInfo describes a container known to the daemon.
+type ContainerInfo struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+
+	// Source describes what the container was created from, if known.
+	Source string `json:"source,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// LastUsedAt holds when the container was last started through
+	// the daemon, and is zero if it never was.
+	LastUsedAt time.Time `json:"last_used_at"`
+
+	// Profiles holds the names of the profiles applied to the container,
+	// in the order they're applied.
+	Profiles []string `json:"profiles"`
+
+	// Config holds the container configuration keys that are set locally.
+	Config map[string]string `json:"config"`
+
+	// Devices holds the devices of the container set locally, by name.
+	Devices map[string]Device `json:"devices"`
+
+	// ExpandedConfig and ExpandedDevices hold the configuration and
+	// devices in effect, resulting from applying the profiles followed
+	// by the local settings.
+	ExpandedConfig  map[string]string `json:"expanded_config"`
+	ExpandedDevices map[string]Device `json:"expanded_devices"`
+
+	// Snapshots holds the names of the snapshots of the container, in
+	// the order they were taken.
+	Snapshots []string `json:"snapshots"`
+
+	// Runtime holds the runtime state of the container. It's only
+	// set in container lists.
+	Runtime *ContainerState `json:"runtime,omitempty"`
+}
+
+// ContainerState holds the runtime state of a container. All but the
+// status is only set while the container runs.
+type ContainerState struct {
+	Status string `json:"status"`
+
+	// InitPID is the host process id of the container init.
+	InitPID int `json:"init_pid,omitempty"`
+
+	// Addresses holds the IP addresses of the container, by interface.
+	Addresses map[string][]string `json:"addresses,omitempty"`
+
+	// MemoryUsage is the memory used by the container, in bytes, or zero
+	// if unknown.
+	MemoryUsage uint64 `json:"memory_usage,omitempty"`
+
+	// CPUTime is the CPU time used by the container since it started, or
+	// zero if unknown.
+	CPUTime time.Duration `json:"cpu_time,omitempty"`
+
+	// Processes is the number of processes running in the container.
+	Processes int `json:"processes,omitempty"`
+
+	// StartedAt is when the container init started.
+	StartedAt time.Time `json:"started_at"`
+}
+
+// resource holds the handlers for the HTTP methods supported at an API path.
+type resource struct {
+	get    func(r *http.Request) response
+	put    func(r *http.Request) response
+	post   func(r *http.Request) response
+	delete func(r *http.Request) response
+}
+
+// serve dispatches r to the handler registered for its method.
+func (res *resource) serve(r *http.Request) response {
+	var f func(r *http.Request) response
+	switch r.Method {
+	case "GET":
+		f = res.get
+	case "PUT":
+		f = res.put
+	case "POST":
+		f = res.post
+	case "DELETE":
+		f = res.delete
+	}
+	if f == nil {
+		return errorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+	}
+	return f(r)
+}
+
+// readJSON unmarshals the json document in the body of r into v.
+func readJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// containerPath splits the path of a request under /1.0/containers/ into the
+// container name and the path of the resource within it, if any.
+func containerPath(r *http.Request) (name string, sub string) {
+	elems := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/1.0/containers/"), "/", 2)
+	if len(elems) == 2 {
+		return elems[0], elems[1]
+	}
+	return elems[0], ""
+}
+
+func (d *Daemon) serveContainers(r *http.Request) response {
+	res := &resource{
+		get:  d.containersGet,
+		post: d.containersPost,
+	}
+	return res.serve(r)
+}
+
+// serveContainer serves the resources under /1.0/containers/<name>.
+func (d *Daemon) serveContainer(r *http.Request) response {
+	name, sub := containerPath(r)
+	if name == "" {
+		return notFound("missing container name in %s", r.URL.Path)
+	}
+	var res *resource
+	switch sub {
+	case "":
+		res = &resource{get: d.containerGet, put: d.containerPut, delete: d.containerDelete}
+	case "state":
+		res = &resource{get: d.containerStateGet, put: d.containerStatePut}
+	case "exec":
+		res = &resource{post: d.containerExecPost}
+	case "snapshots":
+		res = &resource{get: d.containerSnapshotsGet, post: d.containerSnapshotsPost}
+	case "checkpoints":
+		res = &resource{get: d.containerCheckpointsGet, post: d.containerCheckpointsPost}
+	default:
+		if strings.HasPrefix(sub, "snapshots/") {
+			return d.serveSnapshot(r)
+		}
+		if strings.HasPrefix(sub, "checkpoints/") {
+			return d.serveCheckpoint(r)
+		}
+		return notFound("unknown container resource %q", sub)
+	}
+	return res.serve(r)
+}
+
+// containerInfo returns the details of the named container, which fails
+// with ErrNoSuchContainer if it's unknown to either the database or the
+// backend.
+func (d *Daemon) containerInfo(name string) (*ContainerInfo, error) {
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return nil, err
+	}
+	return d.recordInfo(rec)
+}
+
+func (d *Daemon) recordInfo(rec *containerRecord) (*ContainerInfo, error) {
+	state, err := d.backend.State(rec.name)
+	if err != nil {
+		return nil, err
+	}
+	info := &ContainerInfo{
+		Name:       rec.name,
+		State:      state,
+		Source:     rec.source,
+		CreatedAt:  rec.createdAt,
+		LastUsedAt: rec.lastUsedAt,
+	}
+	err = d.fillConfig(rec, info)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := dbSnapshots(d.db, rec.id)
+	if err != nil {
+		return nil, err
+	}
+	info.Snapshots = []string{}
+	for _, snapshot := range snapshots {
+		info.Snapshots = append(info.Snapshots, snapshot.name)
+	}
+	return info, nil
+}
+
+// fillConfig fills the profiles, configuration and devices of info from
+// the database record of the container, rec.
+func (d *Daemon) fillConfig(rec *containerRecord, info *ContainerInfo) error {
+	var err error
+	info.Profiles, err = dbContainerProfiles(d.db, rec.id)
+	if err != nil {
+		return err
+	}
+	info.Config, err = dbContainerConfig(d.db, rec.id)
+	if err != nil {
+		return err
+	}
+	info.Devices, err = dbContainerDevices(d.db, rec.id)
+	if err != nil {
+		return err
+	}
+	var configs []map[string]string
+	var devices []map[string]Device
+	for _, name := range info.Profiles {
+		profile, err := dbProfile(d.db, name)
+		if err != nil {
+			return fmt.Errorf("cannot read profile %q: %v", name, err)
+		}
+		configs = append(configs, profile.Config)
+		devices = append(devices, profile.Devices)
+	}
+	info.ExpandedConfig = expandConfig(configs, info.Config)
+	info.ExpandedDevices = expandDevices(devices, info.Devices)
+	return nil
+}
+
+var containerNameExp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,62}$`)
+
+// checkContainerName returns an error if name isn't a valid container
+// name. Names are used as hostnames and as file names by the backends, so
+// they're limited to the hostname characters, which keeps them from
+// referring to other directories.
+func checkContainerName(name string) error {
+	if !containerNameExp.MatchString(name) {
+		return fmt.Errorf("invalid container name %q", name)
+	}
+	return nil
+}
+
+// checkContainer returns an error response if the named container is not
+// in the database, and nil otherwise.
+func (d *Daemon) checkContainer(name string, action string) response {
+	_, err := dbContainer(d.db, name)
+	if err != nil {
+		return containerError(name, action, err)
+	}
+	return nil
+}
+
+// containerFilter selects containers in lists by the value of key, which
+// is either "name", "state", "profile" or a configuration key.
+type containerFilter struct {
+	key, value string
+}
+
+// parseContainerFilters parses filters in the key=value form.
+func parseContainerFilters(filters []string) ([]containerFilter, error) {
+	var result []containerFilter
+	for _, filter := range filters {
+		fields := strings.SplitN(filter, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("filter must be in the key=value form: %q", filter)
+		}
+		key := fields[0]
+		if _, ok := lookupConfigKey(key); !ok && key != "name" && key != "state" && key != "profile" {
+			return nil, fmt.Errorf("unknown filter key %q", key)
+		}
+		result = append(result, containerFilter{key, fields[1]})
+	}
+	return result, nil
+}
+
+// match returns whether the container described by info passes the
+// filter. Configuration keys match their expanded values, and unset keys
+// match the empty value.
+func (f containerFilter) match(info *ContainerInfo) bool {
+	switch f.key {
+	case "name":
+		return info.Name == f.value
+	case "state":
+		return strings.EqualFold(info.State, f.value)
+	case "profile":
+		for _, profile := range info.Profiles {
+			if profile == f.value {
+				return true
+			}
+		}
+		return false
+	}
+	return info.ExpandedConfig[f.key] == f.value
+}
+
+// containersGet lists the containers passing all filters given as filter
+// query parameters, along with their runtime state.
+func (d *Daemon) containersGet(r *http.Request) response {
+	Debugf("responding to list")
+	filters, err := parseContainerFilters(r.URL.Query()["filter"])
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	recs, err := dbContainers(d.db)
+	if err != nil {
+		return internalError("cannot list containers: %v", err)
+	}
+	result := make([]*ContainerInfo, 0, len(recs))
+NextContainer:
+	for _, rec := range recs {
+		info, err := d.recordInfo(rec)
+		if err == nil {
+			info.Runtime, err = d.backend.RuntimeState(rec.name)
+		}
+		if err == ErrNoSuchContainer {
+			// Still being created, or destroyed meanwhile.
+			continue
+		}
+		if err != nil {
+			return containerError(rec.name, "inspect", err)
+		}
+		for _, filter := range filters {
+			if !filter.match(info) {
+				continue NextContainer
+			}
+		}
+		result = append(result, info)
+	}
+	return &syncResponse{result}
+}
+
+// containersPostReq holds the details of a container to create, either
+// from an image in the store, or from the root filesystem downloaded by
+// LXC for Distro, Release and Arch.
+type containersPostReq struct {
+	Name     string            `json:"name"`
+	Profiles []string          `json:"profiles"`
+	Config   map[string]string `json:"config"`
+	Image    string            `json:"image"`
+
+	// Server and Certificate identify the daemon holding Image in
+	// its store, if it's not this one, by its address and the
+	// fingerprint of its certificate. The image must be public.
+	Server      string `json:"server"`
+	Certificate string `json:"certificate"`
+
+	Distro  string `json:"distro"`
+	Release string `json:"release"`
+	Arch    string `json:"arch"`
+}
+
+func (d *Daemon) containersPost(r *http.Request) response {
+	Debugf("responding to create")
+
+	var req containersPostReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if req.Name == "" {
+		return badRequest("missing container name")
+	}
+	if err := checkContainerName(req.Name); err != nil {
+		return badRequest("%v", err)
+	}
+	switch {
+	case req.Server != "" && req.Image == "":
+		return badRequest("missing image")
+	case req.Image != "":
+	case req.Distro == "":
+		return badRequest("missing distro")
+	case req.Release == "":
+		return badRequest("missing release")
+	case req.Arch == "":
+		return badRequest("missing arch")
+	}
+	if err := checkContainerConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+
+	opts := CreateOptions{
+		Distro:  req.Distro,
+		Release: req.Release,
+		Arch:    req.Arch,
+	}
+	source := fmt.Sprintf("%s/%s/%s", req.Distro, req.Release, req.Arch)
+	progress := "downloading " + source
+	var remote *remoteImage
+	if req.Server != "" {
+		var err error
+		remote, err = d.findDaemonImage(req.Server, req.Certificate, req.Image)
+		if err != nil {
+			return imageError(req.Server+":"+req.Image, "inspect", err)
+		}
+		source = remote.fingerprint
+		progress = "downloading image " + remote.ref
+	} else if i := strings.Index(req.Image, ":"); i >= 0 {
+		// Published by an image server, and downloaded into the
+		// store unless it's there already.
+		var err error
+		remote, err = d.findRemoteImage(req.Image[:i], req.Image[i+1:])
+		if err != nil {
+			return imageError(req.Image, "inspect", err)
+		}
+		source = remote.fingerprint
+		progress = "downloading image " + req.Image
+	} else if req.Image != "" {
+		image, err := d.resolveImage(req.Image)
+		if err != nil {
+			return imageError(req.Image, "inspect", err)
+		}
+		opts = imageCreateOptions(image)
+		source = image.Fingerprint
+		progress = "unpacking image " + source
+	}
+	if req.Profiles == nil {
+		req.Profiles = defaultProfiles
+	}
+	if resp := d.checkProfiles(req.Profiles); resp != nil {
+		return resp
+	}
+	if _, err := d.backend.State(req.Name); err != ErrNoSuchContainer {
+		if err == nil {
+			err = ErrContainerExists
+		}
+		return containerError(req.Name, "create", err)
+	}
+	// Reserve the name right away, so that concurrent requests for the
+	// same container fail early.
+	err := dbContainerCreate(d.db, req.Name, source, req.Profiles, req.Config)
+	if err != nil {
+		return containerError(req.Name, "create", err)
+	}
+
+	// Downloads may be cancelled, but not the creation itself.
+	op, err := d.newOperation(fmt.Sprintf("create %s", req.Name), remote != nil)
+	if err != nil {
+		dbContainerDelete(d.db, req.Name)
+		return internalError("%v", err)
+	}
+	return d.runOperation(op, func(op *operation) (interface{}, error) {
+		op.progress("%s", progress)
+		if remote != nil {
+			ctx, cancel := op.context()
+			image, err := d.fetchImage(ctx, remote)
+			cancel()
+			if err != nil {
+				d.abandonContainer(req.Name)
+				return nil, fmt.Errorf("cannot create container %q: %v", req.Name, err)
+			}
+			opts = imageCreateOptions(image)
+			op.progress("unpacking image %s", image.Fingerprint)
+		}
+		d.beginChange(req.Name)
+		err := d.createContainer(req.Name, opts)
+		d.endChange(req.Name, "created", err)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create container %q: %v", req.Name, err)
+		}
+		return nil, nil
+	})
+}
+
+// createContainer creates the named container in the backend, once it's
+// in the database, and removes it from the database again if that fails.
+func (d *Daemon) createContainer(name string, opts CreateOptions) error {
+	err := d.backend.Create(name, opts)
+	if err != nil {
+		d.abandonContainer(name)
+	}
+	return err
+}
+
+// abandonContainer removes the named container from the database after
+// its creation failed.
+func (d *Daemon) abandonContainer(name string) {
+	if err := dbContainerDelete(d.db, name); err != nil {
+		Logf("cannot remove container %q from database: %v", name, err)
+	}
+}
+
+// imageCreateOptions returns the options for creating a container from
+// the image in the store.
+func imageCreateOptions(image *ImageInfo) CreateOptions {
+	return CreateOptions{
+		Image:   imagePath(image.Fingerprint),
+		Distro:  image.Properties["os"],
+		Release: image.Properties["release"],
+		Arch:    image.Architecture,
+	}
+}
+
+func (d *Daemon) containerGet(r *http.Request) response {
+	name, _ := containerPath(r)
+	info, err := d.containerInfo(name)
+	if err != nil {
+		return containerError(name, "inspect", err)
+	}
+	return &syncResponse{info}
+}
+
+// containerPutReq holds the new configuration, devices and profiles of a
+// container. Those left out are not changed.
+type containerPutReq struct {
+	Config   map[string]string `json:"config"`
+	Devices  map[string]Device `json:"devices"`
+	Profiles []string          `json:"profiles"`
+}
+
+func (d *Daemon) containerPut(r *http.Request) response {
+	name, _ := containerPath(r)
+
+	var req containerPutReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if err := checkContainerConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := checkDevices(req.Devices); err != nil {
+		return badRequest("%v", err)
+	}
+	if resp := d.checkProfiles(req.Profiles); resp != nil {
+		return resp
+	}
+	old, err := d.containerInfo(name)
+	if err != nil {
+		return containerError(name, "configure", err)
+	}
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return containerError(name, "configure", err)
+	}
+	err = dbContainerUpdate(d.db, rec.id, req.Config, req.Devices, req.Profiles)
+	if err != nil {
+		return containerError(name, "configure", err)
+	}
+	d.events.publish("container", &ContainerEvent{Name: name, Action: "configured"})
+
+	err = d.applyConfig(old)
+	if err != nil {
+		return internalError("configuration of container %q saved, but not applied: %v", name, err)
+	}
+	return emptySyncResponse
+}
+
+// applyConfig applies the changes made in the database to the container
+// described by old, if it's running. Devices are hotplugged as far as the
+// backend allows and limits are updated, while everything else is
+// changed when the container is next started.
+func (d *Daemon) applyConfig(old *ContainerInfo) error {
+	if old.State != "RUNNING" {
+		return nil
+	}
+	rec, err := dbContainer(d.db, old.Name)
+	if err != nil {
+		return err
+	}
+	info := &ContainerInfo{}
+	err = d.fillConfig(rec, info)
+	if err != nil {
+		return err
+	}
+	err = d.hotplugDevices(old.Name, old.ExpandedDevices, info.ExpandedDevices)
+	if err != nil {
+		return err
+	}
+	return d.backend.UpdateLimits(old.Name, info.ExpandedConfig)
+}
+
+// hotplugDevices changes the devices of the named running container from
+// those in from to those in to, as far as the backend allows. Devices which
+// can't be changed while the container runs are changed when it's next
+// started.
+func (d *Daemon) hotplugDevices(name string, from map[string]Device, to map[string]Device) error {
+	for _, devname := range sortedDeviceNames(from) {
+		dev := from[devname]
+		if todev, ok := to[devname]; ok && deviceEqual(dev, todev) {
+			continue
+		}
+		err := d.backend.RemoveDevice(name, devname, dev)
+		if err == ErrHotplugUnsupported {
+			Debugf("device %q of container %q will be removed on next start", devname, name)
+		} else if err != nil {
+			return fmt.Errorf("cannot remove device %q: %v", devname, err)
+		}
+	}
+	for _, devname := range sortedDeviceNames(to) {
+		dev := to[devname]
+		if fromdev, ok := from[devname]; ok && deviceEqual(dev, fromdev) {
+			continue
+		}
+		err := d.backend.AddDevice(name, devname, dev)
+		if err == ErrHotplugUnsupported {
+			Debugf("device %q of container %q will be added on next start", devname, name)
+		} else if err != nil {
+			return fmt.Errorf("cannot add device %q: %v", devname, err)
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) containerDelete(r *http.Request) response {
+	name, _ := containerPath(r)
+	if resp := d.checkContainer(name, "destroy"); resp != nil {
+		return resp
+	}
+	err := d.changeState(name, d.backend.Destroy, "destroyed")
+	if err != nil {
+		return containerError(name, "destroy", err)
+	}
+	return emptySyncResponse
+}
+
+func (d *Daemon) containerStateGet(r *http.Request) response {
+	name, _ := containerPath(r)
+	if resp := d.checkContainer(name, "inspect"); resp != nil {
+		return resp
+	}
+	state, err := d.backend.RuntimeState(name)
+	if err != nil {
+		return containerError(name, "inspect", err)
+	}
+	return &syncResponse{state}
+}
+
+type containerStatePutReq struct {
+	Action string `json:"action"`
+}
+
+func (d *Daemon) containerStatePut(r *http.Request) response {
+	name, _ := containerPath(r)
+
+	var req containerStatePutReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+
+	var f func(name string) error
+	var action string
+	switch req.Action {
+	case "start":
+		f, action = d.backend.Start, "started"
+	case "stop":
+		f, action = d.backend.Stop, "stopped"
+	case "restart":
+		f, action = d.backend.Reboot, "restarted"
+	case "":
+		return badRequest("missing state action")
+	default:
+		return badRequest("unknown state action %q", req.Action)
+	}
+	if resp := d.checkContainer(name, req.Action); resp != nil {
+		return resp
+	}
+	err := d.changeState(name, f, action)
+	if err != nil {
+		return containerError(name, req.Action, err)
+	}
+	return emptySyncResponse
+}
+
+// changeState runs f on the named container, reporting action as having
+// happened to it if f succeeds, and updates the database accordingly:
+// containers started are recorded as used, and destroyed ones are dropped.
+// The container configuration is applied before it's started.
+func (d *Daemon) changeState(name string, f func(name string) error, action string) error {
+	d.beginChange(name)
+	var err error
+	if action == "started" || action == "restarted" {
+		err = d.configureContainer(name)
+	}
+	if err == nil {
+		err = f(name)
+	}
+	d.endChange(name, action, err)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "started", "restarted":
+		err = dbContainerUsed(d.db, name)
+	case "destroyed":
+		err = dbContainerDelete(d.db, name)
+		if rerr := os.RemoveAll(varPath("checkpoints", name)); rerr != nil {
+			Logf("cannot remove checkpoints of container %q: %v", name, rerr)
+		}
+	}
+	if err != nil {
+		Logf("cannot update container %q in database: %v", name, err)
+	}
+	return nil
+}
+
+// stopForChange stops the named container if it's running, and returns a
+// function which starts it again in that case, for calling once the change
+// that requires it to be stopped is done.
+func (d *Daemon) stopForChange(op *operation, name string) (restart func(), err error) {
+	state, err := d.backend.State(name)
+	if err != nil {
+		return nil, err
+	}
+	if state != "RUNNING" {
+		return func() {}, nil
+	}
+	op.progress("stopping container")
+	err = d.changeState(name, d.backend.Stop, "stopped")
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		op.progress("starting container")
+		err := d.changeState(name, d.backend.Start, "started")
+		if err != nil {
+			Logf("cannot start container %q again: %v", name, err)
+		}
+	}, nil
+}
+
+// configureContainer applies the configuration and devices in effect for
+// the named container, as recorded in the database, to the backend.
+func (d *Daemon) configureContainer(name string) error {
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return err
+	}
+	info := &ContainerInfo{}
+	err = d.fillConfig(rec, info)
+	if err != nil {
+		return err
+	}
+	err = d.backend.Configure(name, info.ExpandedConfig, info.ExpandedDevices)
+	if err != nil {
+		return fmt.Errorf("cannot apply configuration: %v", err)
+	}
+	return nil
+}
+
+// autostartEntry is a container to be started by autostart.
+type autostartEntry struct {
+	name     string
+	priority int
+	delay    time.Duration
+}
+
+// autostart starts the stopped containers which have boot.autostart set,
+// by decreasing boot.autostart.priority, waiting for boot.autostart.delay
+// seconds after starting each one.
+func (d *Daemon) autostart() error {
+	recs, err := dbContainers(d.db)
+	if err != nil {
+		Logf("cannot autostart containers: %v", err)
+		return nil
+	}
+	var entries []autostartEntry
+	for _, rec := range recs {
+		info := &ContainerInfo{}
+		err := d.fillConfig(rec, info)
+		if err != nil {
+			Logf("cannot autostart container %q: %v", rec.name, err)
+			continue
+		}
+		config := info.ExpandedConfig
+		if on, _ := parseConfigBool(config["boot.autostart"]); !on {
+			continue
+		}
+		priority, _ := strconv.Atoi(config["boot.autostart.priority"])
+		delay, _ := strconv.Atoi(config["boot.autostart.delay"])
+		entries = append(entries, autostartEntry{rec.name, priority, time.Duration(delay) * time.Second})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].priority > entries[j].priority })
+	for _, e := range entries {
+		if state, err := d.backend.State(e.name); err != nil || state != "STOPPED" {
+			continue
+		}
+		Logf("autostarting container %q", e.name)
+		err := d.changeState(e.name, d.backend.Start, "started")
+		if err != nil {
+			Logf("cannot autostart container %q: %v", e.name, err)
+			continue
+		}
+		select {
+		case <-time.After(e.delay):
+		case <-d.tomb.Dying():
+			return nil
+		}
+	}
+	return nil
+}
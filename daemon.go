@@ -1,18 +1,18 @@
 package flex
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 
-	"gopkg.in/lxc/go-lxc.v2"
 	"gopkg.in/tomb.v2"
-
-	"github.com/kr/pty"
 )
 
 // A Daemon can respond to requests from a flex client.
@@ -21,9 +21,39 @@ type Daemon struct {
 	config  Config
 	unixl   net.Listener
 	tcpl    net.Listener
-	id_map  *idmap
 	lxcpath string
+	backend Backend
 	mux     *http.ServeMux
+	server  *http.Server
+
+	// db holds the records of containers and their configuration,
+	// which persist across daemon restarts.
+	db *sql.DB
+
+	opsMu sync.Mutex
+	ops   map[string]*operation
+
+	events *eventHub
+
+	// states holds the last known state of containers by name, and
+	// changing the containers being changed through the daemon.
+	statesMu sync.Mutex
+	states   map[string]string
+	changing map[string]int
+
+	// downloads holds the images being downloaded into the store, by
+	// fingerprint, with channels closed once their downloads end.
+	downloadsMu sync.Mutex
+	downloads   map[string]chan struct{}
+
+	// checkpointsMu is held while ids are allocated for new checkpoints.
+	checkpointsMu sync.Mutex
+
+	// certs holds the trusted client certificates by fingerprint, and
+	// trustFailures the invalid trust passwords provided by host.
+	certsMu       sync.Mutex
+	certs         map[string]*x509.Certificate
+	trustFailures map[string]*trustFailure
 }
 
 // varPath returns the provided path elements joined by a slash and
@@ -40,48 +70,108 @@ func varPath(path ...string) string {
 
 // StartDaemon starts the flex daemon with the provided configuration.
 func StartDaemon(config *Config) (*Daemon, error) {
-	d := &Daemon{config: *config}
+	d := &Daemon{
+		config:        *config,
+		ops:           make(map[string]*operation),
+		events:        newEventHub(),
+		changing:      make(map[string]int),
+		downloads:     make(map[string]chan struct{}),
+		trustFailures: make(map[string]*trustFailure),
+	}
 	d.mux = http.NewServeMux()
-	d.mux.HandleFunc("/ping", d.servePing)
-	d.mux.HandleFunc("/list", d.serveList)
-	d.mux.HandleFunc("/create", d.serveCreate)
-	d.mux.HandleFunc("/attach", d.serveAttach)
-	d.mux.HandleFunc("/checkpoint", d.serveCheckpoint)
-	d.mux.HandleFunc("/restore", d.serveRestore)
-	d.mux.HandleFunc("/sendContainer", d.serveSendContainer)
-
-	var err error
-	d.id_map, err = newIdmap()
+	d.server = &http.Server{Handler: d.mux}
+	d.mux.HandleFunc("/ping", d.handleUntrusted(d.servePing))
+	d.mux.HandleFunc("/1.0", d.handleUntrusted(d.serveAPI))
+	d.mux.HandleFunc("/attach", d.handle(d.serveAttach))
+	d.mux.HandleFunc("/sendContainer", d.handle(d.serveSendContainer))
+	d.mux.HandleFunc("/receiveContainer", d.handle(d.serveReceiveContainer))
+
+	d.mux.HandleFunc("/1.0/containers", d.handle(d.serveContainers))
+	d.mux.HandleFunc("/1.0/containers/", d.handle(d.serveContainer))
+	d.mux.HandleFunc("/1.0/operations", d.handle(d.serveOperations))
+	d.mux.HandleFunc("/1.0/operations/", d.handle(d.serveOperation))
+	d.mux.HandleFunc("/1.0/profiles", d.handle(d.serveProfiles))
+	d.mux.HandleFunc("/1.0/profiles/", d.handle(d.serveProfile))
+	d.mux.HandleFunc("/1.0/images", d.handleUntrusted(d.serveImages))
+	d.mux.HandleFunc("/1.0/images/", d.handleUntrusted(d.serveImage))
+	d.mux.HandleFunc("/1.0/events", d.handle(d.serveEvents))
+	d.mux.HandleFunc("/1.0/certificates", d.handleUntrusted(d.serveCertificates))
+	d.mux.HandleFunc("/1.0/certificates/", d.handleUntrusted(d.serveCertificate))
+	d.mux.HandleFunc("/1.0/trust-password", d.handle(d.serveTrustPassword))
+
+	// Deprecated routes predating the /1.0 API, kept around so that older
+	// clients continue to work for one more release.
+	d.mux.HandleFunc("/list", d.handle(deprecated(d.containersGet)))
+	d.mux.HandleFunc("/create", d.handle(deprecated(d.serveCreate)))
+	d.mux.HandleFunc("/start", d.handle(deprecated(buildByNameServe("start", "started", func(b Backend, name string) error { return b.Start(name) }, d))))
+	d.mux.HandleFunc("/stop", d.handle(deprecated(buildByNameServe("stop", "stopped", func(b Backend, name string) error { return b.Stop(name) }, d))))
+	d.mux.HandleFunc("/reboot", d.handle(deprecated(buildByNameServe("reboot", "restarted", func(b Backend, name string) error { return b.Reboot(name) }, d))))
+	d.mux.HandleFunc("/destroy", d.handle(deprecated(buildByNameServe("destroy", "destroyed", func(b Backend, name string) error { return b.Destroy(name) }, d))))
+	d.mux.HandleFunc("/checkpoint", d.handle(deprecated(d.serveLegacyCheckpoint)))
+	d.mux.HandleFunc("/restore", d.handle(deprecated(d.serveLegacyRestore)))
+
+	d.lxcpath = varPath("lxc")
+	err := os.MkdirAll(varPath("/"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(d.lxcpath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(varPath("images"), 0700)
 	if err != nil {
 		return nil, err
 	}
-	Debugf("idmap is %d %d %d %d\n",
-		d.id_map.uidmin,
-		d.id_map.uidrange,
-		d.id_map.gidmin,
-		d.id_map.gidrange)
 
-	d.mux.HandleFunc("/start", buildByNameServe("start", func(c *lxc.Container) error { return c.Start() }, d))
-	d.mux.HandleFunc("/stop", buildByNameServe("stop", func(c *lxc.Container) error { return c.Stop() }, d))
-	d.mux.HandleFunc("/reboot", buildByNameServe("reboot", func(c *lxc.Container) error { return c.Reboot() }, d))
-	d.mux.HandleFunc("/destroy", buildByNameServe("destroy", func(c *lxc.Container) error { return c.Destroy() }, d))
+	d.backend, err = newBackend(config, d.lxcpath)
+	if err != nil {
+		return nil, err
+	}
+	d.states, err = d.containerStates()
+	if err != nil {
+		return nil, err
+	}
 
-	d.lxcpath = varPath("lxc")
-	err = os.MkdirAll(varPath("/"), 0755)
+	err = d.loadTrustedCerts()
 	if err != nil {
 		return nil, err
 	}
-	err = os.MkdirAll(d.lxcpath, 0755)
+
+	d.db, err = openDB(varPath("flex.db"))
 	if err != nil {
 		return nil, err
 	}
+	err = d.syncDB()
+	if err != nil {
+		d.db.Close()
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if d.config.ListenAddr != "" {
+		cert, err := loadCert(varPath("server.crt"), varPath("server.key"))
+		if err != nil {
+			d.db.Close()
+			return nil, err
+		}
+		// Clients may present a certificate, which is then checked
+		// against the trust store for each request (see isTrusted).
+		// Those without one may still get the public images.
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
 
 	unixAddr, err := net.ResolveUnixAddr("unix", varPath("unix.socket"))
 	if err != nil {
+		d.db.Close()
 		return nil, fmt.Errorf("cannot resolve unix socket address: %v", err)
 	}
 	unixl, err := net.ListenUnix("unix", unixAddr)
 	if err != nil {
+		d.db.Close()
 		return nil, fmt.Errorf("cannot listen on unix socket: %v", err)
 	}
 	d.unixl = unixl
@@ -91,18 +181,22 @@ func StartDaemon(config *Config) (*Daemon, error) {
 		tcpAddr, err := net.ResolveTCPAddr("tcp", d.config.ListenAddr)
 		if err != nil {
 			d.unixl.Close()
-			return nil, fmt.Errorf("cannot resolve unix socket address: %v", err)
+			d.db.Close()
+			return nil, fmt.Errorf("cannot resolve tcp address: %v", err)
 		}
 		tcpl, err := net.ListenTCP("tcp", tcpAddr)
 		if err != nil {
 			d.unixl.Close()
-			return nil, fmt.Errorf("cannot listen on unix socket: %v", err)
+			d.db.Close()
+			return nil, fmt.Errorf("cannot listen on tcp address: %v", err)
 		}
-		d.tcpl = tcpl
-		d.tomb.Go(func() error { return http.Serve(d.tcpl, d.mux) })
+		d.tcpl = tls.NewListener(tcpl, tlsConfig)
+		d.tomb.Go(func() error { return d.server.Serve(d.tcpl) })
 	}
 
-	d.tomb.Go(func() error { return http.Serve(d.unixl, d.mux) })
+	d.tomb.Go(func() error { return d.server.Serve(d.unixl) })
+	d.tomb.Go(d.monitorStates)
+	d.tomb.Go(d.autostart)
 	return d, nil
 }
 
@@ -111,11 +205,12 @@ var errStop = fmt.Errorf("requested stop")
 // Stop stops the flex daemon.
 func (d *Daemon) Stop() error {
 	d.tomb.Kill(errStop)
-	d.unixl.Close()
-	if d.tcpl != nil {
-		d.tcpl.Close()
-	}
+	// Closing the server closes the listeners as well as the connections
+	// being served, so that nothing reaches the handlers from now on.
+	d.server.Close()
 	err := d.tomb.Wait()
+	d.stopOperations()
+	d.db.Close()
 	if err == errStop {
 		return nil
 	}
@@ -128,378 +223,179 @@ func (d *Daemon) Stop() error {
 //
 // Then, all of those issues that prevent the request from being served properly
 // for any reason (bad parameters or any other local error) should be notified
-// back to the client by writing an error json document to w, which in turn will
-// be read by the client and returned via the API as an error result. These
-// errors then surface via the CLI (cmd/flex/*) in os.Stderr.
+// back to the client by returning an error response (see badRequest, notFound
+// and internalError), which is rendered as an error json document with the
+// respective HTTP status code. That document is read by the client and returned
+// via the API as an *Error. These errors then surface via the CLI (cmd/flex/*)
+// in os.Stderr.
 //
 // Together, these ideas ensure that we have a proper daemon, and a proper client,
 // which can both be used independently and also embedded into other applications.
 
-func (d *Daemon) servePing(w http.ResponseWriter, r *http.Request) {
-	remoteAddr := r.RemoteAddr
-	if remoteAddr == "@" {
-		remoteAddr = "unix socket"
+// handle adapts a daemon handler into an http.HandlerFunc which renders the
+// handler's response as a json document. Requests from untrusted clients
+// are rejected without reaching the handler.
+func (d *Daemon) handle(f func(r *http.Request) response) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resp response
+		if d.isTrusted(r) {
+			resp = f(r)
+		} else {
+			Debugf("rejecting request from untrusted client %s", r.RemoteAddr)
+			resp = errUntrusted
+		}
+		err := resp.render(w)
+		if err != nil {
+			Logf("cannot write response to %s: %v", r.URL.Path, err)
+		}
 	}
-	Debugf("responding to ping from %s", remoteAddr)
-	w.Write([]byte("pong"))
 }
 
-// FIXME(niemeyer): These methods should be returning json to the client.
-// They may be easily converted by replacing:
-//
-//     fmt.Fprintf(w, "Port: %d", port)
-//
-// with:
-//
-//     type jmap map[string]interface{}
-//     err := json.NewEncoder(w).Encode(jmap{"port": port})
-//
-// Common results may also be done with a struct. For example, for errors
-// something like this might be convenient:
-//
-//     type jerror struct {
-//         Error string `json:"error"`
-//     }
-//
-// It may then be used as:
-//
-//     err := json.NewEncoder(w).Encode(jerror{"message"})
-//
-// I suggest establishing a few strong conventions early on for how an error
-// document looks like, etc.
-
-func (d *Daemon) serveList(w http.ResponseWriter, r *http.Request) {
-	Debugf("responding to list")
-	c := lxc.DefinedContainers(d.lxcpath)
-	for i := range c {
-		fmt.Fprintf(w, "%d: %s (%s)\n", i, c[i].Name(), c[i].State())
+// handleUntrusted is like handle, but lets requests from untrusted clients
+// through. The handler is responsible for checking trust where necessary.
+func (d *Daemon) handleUntrusted(f func(r *http.Request) response) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := f(r).render(w)
+		if err != nil {
+			Logf("cannot write response to %s: %v", r.URL.Path, err)
+		}
 	}
+}
 
+// deprecated wraps the handler of a route which is only kept for
+// compatibility with older clients.
+func deprecated(f func(r *http.Request) response) func(r *http.Request) response {
+	return func(r *http.Request) response {
+		Debugf("deprecated route %s used; see the /1.0 API instead", r.URL.Path)
+		return f(r)
+	}
 }
 
-func (d *Daemon) serveAttach(w http.ResponseWriter, r *http.Request) {
-	Debugf("responding to attach")
+// APIInfo describes the API served by the daemon.
+type APIInfo struct {
+	APIVersion string `json:"api_version"`
 
-	name := r.FormValue("name")
-	if name == "" {
-		fmt.Fprintf(w, "failed parsing name")
-		return
-	}
+	// Auth is "trusted" if the client making the request is trusted,
+	// and "untrusted" otherwise.
+	Auth string `json:"auth"`
+}
 
-	command := r.FormValue("command")
-	if command == "" {
-		fmt.Fprintf(w, "failed parsing command")
-		return
-	}
+func (d *Daemon) serveAPI(r *http.Request) response {
+	res := &resource{get: d.apiGet}
+	return res.serve(r)
+}
 
-	secret := r.FormValue("secret")
-	if secret == "" {
-		fmt.Fprintf(w, "failed parsing secret")
-		return
+func (d *Daemon) apiGet(r *http.Request) response {
+	info := &APIInfo{APIVersion: "1.0", Auth: "untrusted"}
+	if d.isTrusted(r) {
+		info.Auth = "trusted"
 	}
+	return &syncResponse{info}
+}
 
-	addr := ":0"
-	// tcp6 doesn't seem to work with Dial("tcp", ) at the client
-	l, err := net.Listen("tcp4", addr)
-	if err != nil {
-		fmt.Fprintf(w, "failed listening")
-		return
+func (d *Daemon) servePing(r *http.Request) response {
+	remoteAddr := r.RemoteAddr
+	if remoteAddr == "@" {
+		remoteAddr = "unix socket"
 	}
-	fmt.Fprintf(w, "%s", l.Addr().String())
-
-	go func(l net.Listener, name string, command string, secret string) {
-		conn, err := l.Accept()
-		l.Close()
-		if err != nil {
-			Debugf(err.Error())
-			return
-		}
-		defer conn.Close()
-
-		// FIXME(niemeyer): This likely works okay because the kernel tends to
-		// be sane enough to not break down such a small amount of data into
-		// multiple operations. That said, if we were to make it work
-		// independent of the good will of the kernel and network layers, we'd
-		// have to take into account that Read might also return a single byte,
-		// for example, and then return more when it was next called. Or, it
-		// might return a password plus more data that the client delivered
-		// anticipating it would have a successful authentication.
-		//
-		// We could easily handle it using buffered io (bufio package), but that
-		// would spoil the use of conn directly below when binding it to
-		// the pty. So, given it's a trivial amount of data, I suggest calling
-		// a local helper function that will read byte by byte until it finds
-		// a predefined delimiter ('\n'?) and returns (data string, err error).
-		//
-		b := make([]byte, 100)
-		n, err := conn.Read(b)
-		if err != nil {
-			Debugf("bad read: %s", err.Error())
-			return
-		}
-		if n != len(secret) {
-			Debugf("read %d characters, secret is %d", n, len(secret))
-			return
-		}
-		if string(b[:n]) != secret {
-			Debugf("Wrong secret received from attach client")
-			return
-		}
-		Debugf("Attaching")
-
-		c, err := lxc.NewContainer(name, d.lxcpath)
-		if err != nil {
-			Debugf("%s", err.Error())
-		}
-
-		pty, tty, err := pty.Open()
-
-		if err != nil {
-			Debugf("Failed opening getting a tty: %q", err.Error())
-			return
-		}
+	Debugf("responding to ping from %s", remoteAddr)
+	return &syncResponse{"pong"}
+}
 
-		defer pty.Close()
-		defer tty.Close()
-
-		/*
-		 * The pty will be passed to the container's Attach.  The two
-		 * below goroutines will copy output from the socket to the
-		 * pty.stdin, and from pty.std{out,err} to the socket
-		 * If the RunCommand exits, we want ourselves (the gofunc) and
-		 * the copy-goroutines to exit.  If the connection closes, we
-		 * also want to exit
-		 */
-		go func() {
-			io.Copy(pty, conn)
-			Debugf("conn->pty exiting")
-			return
-		}()
-		go func() {
-			io.Copy(conn, pty)
-			Debugf("pty->conn exiting")
-			return
-		}()
-
-		options := lxc.DefaultAttachOptions
-
-		options.StdinFd = tty.Fd()
-		options.StdoutFd = tty.Fd()
-		options.StderrFd = tty.Fd()
-
-		options.ClearEnv = true
-
-		_, err = c.RunCommand([]string{command}, options)
-		if err != nil {
-			return
-		}
+// containerError returns the error response appropriate for err, which was
+// obtained from the backend while trying to perform action on the named
+// container.
+func containerError(name string, action string, err error) response {
+	switch err {
+	case ErrNoSuchContainer:
+		return notFound("container %q not found", name)
+	case ErrContainerExists:
+		return errorf(http.StatusConflict, "container %q already exists", name)
+	}
+	return internalError("cannot %s container %q: %v", action, name, err)
+}
 
-		Debugf("RunCommand exited, stopping console")
-	}(l, name, command, secret)
+// serveAttach used to attach clients to a container through a separate
+// TCP connection. That's now done with websockets over the API connection.
+func (d *Daemon) serveAttach(r *http.Request) response {
+	return errorf(http.StatusGone, "attach has moved to POST /1.0/containers/<name>/exec")
 }
 
-func (d *Daemon) serveCreate(w http.ResponseWriter, r *http.Request) {
+func (d *Daemon) serveCreate(r *http.Request) response {
 	Debugf("responding to create")
 
 	name := r.FormValue("name")
 	if name == "" {
-		fmt.Fprintf(w, "failed parsing name")
-		return
+		return badRequest("missing container name")
+	}
+	if err := checkContainerName(name); err != nil {
+		return badRequest("%v", err)
 	}
 
 	distro := r.FormValue("distro")
 	if distro == "" {
-		fmt.Fprintf(w, "failed parsing distro")
-		return
+		return badRequest("missing distro")
 	}
 
 	release := r.FormValue("release")
 	if release == "" {
-		fmt.Fprintf(w, "failed parsing release")
-		return
+		return badRequest("missing release")
 	}
 
 	arch := r.FormValue("arch")
 	if arch == "" {
-		fmt.Fprintf(w, "failed parsing arch")
-		return
+		return badRequest("missing arch")
 	}
 
-	opts := lxc.TemplateOptions{
-		Template: "download",
-		Distro:   distro,
-		Release:  release,
-		Arch:     arch,
+	opts := CreateOptions{
+		Distro:  distro,
+		Release: release,
+		Arch:    arch,
 	}
 
-	c, err := lxc.NewContainer(name, d.lxcpath)
-	if err != nil {
-		return
-	}
-
-	/*
-	 * Set the id mapping. This may not be how we want to do it, but it's a
-	 * start.  First, we remove any id_map lines in the config which might
-	 * have come from ~/.config/lxc/default.conf.  Then add id mapping based
-	 * on Domain.id_map
-	 */
-	if d.id_map != nil {
-		Debugf("setting custom idmap")
-		err = c.SetConfigItem("lxc.id_map", "")
-		if err != nil {
-			fmt.Fprintf(w, "Failed to clear id mapping, continuing")
+	if _, err := d.backend.State(name); err != ErrNoSuchContainer {
+		if err == nil {
+			err = ErrContainerExists
 		}
-		uidstr := fmt.Sprintf("u 0 %d %d\n", d.id_map.uidmin, d.id_map.uidrange)
-		Debugf("uidstr is %s\n", uidstr)
-		err = c.SetConfigItem("lxc.id_map", uidstr)
-		if err != nil {
-			fmt.Fprintf(w, "Failed to set uid mapping")
-			return
-		}
-		gidstr := fmt.Sprintf("g 0 %d %d\n", d.id_map.gidmin, d.id_map.gidrange)
-		err = c.SetConfigItem("lxc.id_map", gidstr)
-		if err != nil {
-			fmt.Fprintf(w, "Failed to set gid mapping")
-			return
-		}
-		c.SaveConfigFile("/tmp/c")
+		return containerError(name, "create", err)
 	}
-
-	/*
-	 * Actually create the container
-	 */
-	err = c.Create(opts)
+	err := dbContainerCreate(d.db, name, fmt.Sprintf("%s/%s/%s", distro, release, arch), defaultProfiles, nil)
+	if err != nil {
+		return containerError(name, "create", err)
+	}
+	d.beginChange(name)
+	err = d.createContainer(name, opts)
+	d.endChange(name, "created", err)
 	if err != nil {
-		fmt.Fprintf(w, "fail!")
-	} else {
-		fmt.Fprintf(w, "success!")
+		return containerError(name, "create", err)
 	}
+	return emptySyncResponse
 }
 
-type byname func(*lxc.Container) error
+type byname func(b Backend, name string) error
 
-func buildByNameServe(function string, f byname, d *Daemon) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
+// buildByNameServe returns a handler which runs f on the container named in
+// the request, and reports it as a container event with the provided action.
+func buildByNameServe(function string, action string, f byname, d *Daemon) func(r *http.Request) response {
+	return func(r *http.Request) response {
 		Debugf("responding to %s", function)
 
 		name := r.FormValue("name")
 		if name == "" {
-			fmt.Fprintf(w, "failed parsing name")
-			return
+			return badRequest("missing container name")
 		}
 
-		c, err := lxc.NewContainer(name, d.lxcpath)
-		if err != nil {
-			fmt.Fprintf(w, "failed getting container")
-			return
+		if resp := d.checkContainer(name, function); resp != nil {
+			return resp
 		}
-
-		err = f(c)
+		err := d.changeState(name, func(name string) error { return f(d.backend, name) }, action)
 		if err != nil {
-			fmt.Fprintf(w, "operation failed")
-			return
+			return containerError(name, function, err)
 		}
+		return emptySyncResponse
 	}
 }
 
-func makeCheckpointPath(name string, id string) string {
-	return varPath("checkpoints", name, id)
-}
-
-func (d *Daemon) serveCheckpoint(w http.ResponseWriter, r *http.Request) {
-	name := r.FormValue("name")
-	if name == "" {
-		fmt.Fprintf(w, "failed parsing name")
-		return
-	}
-
-	c, err := lxc.NewContainer(name, d.lxcpath)
-	if err != nil {
-		fmt.Fprintf(w, "failed getting container")
-		return
-	}
-
-	err = os.MkdirAll(varPath("checkpoints", name), 0700)
-	if err != nil {
-		fmt.Fprintf(w, "failed making checkpoint directory")
-		return
-	}
-
-	path := ""
-	id := -1
-	/* We probably want to be a bit smarter here... */
-	for i := 0; i < 1000; i++ {
-		tmp := makeCheckpointPath(name, string(i))
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			path = tmp
-			id = i
-			break
-		}
-	}
-
-	if id < 0 {
-		fmt.Fprintf(w, "Too many checkpoints?")
-		return
-	}
-
-	err = os.MkdirAll(path, 0700)
-	if err != nil {
-		fmt.Fprintf(w, "Failed making checkpoint dir")
-		return
-	}
-
-	stop := r.FormValue("stop") == ""
-	verbose := r.FormValue("verbose") == ""
-
-
-	err = c.Checkpoint(lxc.CheckpointOpts{path, stop, verbose})
-	if err != nil {
-		fmt.Fprintf(w, "Checkpoint failed")
-		return
-	}
-
-	fmt.Fprintf(w, string(id))
-}
-
-func (d *Daemon) serveRestore(w http.ResponseWriter, r *http.Request) {
-
-	name := r.FormValue("name")
-	if name == "" {
-		fmt.Fprintf(w, "failed parsing name")
-		return
-	}
-
-	c, err := lxc.NewContainer(name, d.lxcpath)
-	if err != nil {
-		fmt.Fprintf(w, "failed getting container")
-		return
-	}
-
-	id := r.FormValue("id")
-
-	path := makeCheckpointPath(name, id)
-	fi, err := os.Stat(path)
-	if err != nil {
-		fmt.Fprintf(w, "checkpoint doesn't exist!")
-		return
-	}
-
-	if !fi.IsDir() {
-		fmt.Fprintf(w, "checkpoint isn't a directory")
-		return
-	}
-
-	verbose := r.FormValue("verbose") == ""
-
-	err = c.Restore(lxc.RestoreOpts{path, verbose})
-	if err != nil {
-		fmt.Fprintf(w, "restore failed!")
-		return
-	}
-
-	fmt.Fprintf(w, "restore success!")
-}
-
 /*
  * This probably isn't how we want to do this forever, because it requires
  * ssh keys be exchanged between the servers, which isn't ideal. I wasn't sure
@@ -512,21 +408,23 @@ func (d *Daemon) serveRestore(w http.ResponseWriter, r *http.Request) {
  * them).
  */
 
-func doRsync(remote string, p string) error {
+func doRsync(op *operation, remote string, p string) error {
 	/* rsync needs the trailing / to sync directories... */
 	rsyncPath := p + "/"
 	remotePath := remote + ":" + rsyncPath
 	cmd := exec.Command("rsync", "-rltzha", "--devices", "--rsync-path=\"sudo rsync\"", rsyncPath, remotePath)
 
-	return cmd.Run()
+	return runCommand(op, cmd)
 }
 
-func (d *Daemon) serveSendContainer(w http.ResponseWriter, r *http.Request) {
+func (d *Daemon) serveSendContainer(r *http.Request) response {
 
 	name := r.FormValue("name")
 	if name == "" {
-		fmt.Fprintf(w, "no name?")
-		return
+		return badRequest("missing container name")
+	}
+	if err := checkContainerName(name); err != nil {
+		return badRequest("%v", err)
 	}
 
 	/* It is ok to not provide a checkpoint id, that just means you're
@@ -535,35 +433,68 @@ func (d *Daemon) serveSendContainer(w http.ResponseWriter, r *http.Request) {
 
 	remote := r.FormValue("remote")
 	if remote == "" {
-		fmt.Fprintf(w, "error parsing remote")
-		return
+		return badRequest("missing remote")
 	}
 
+	var path string
 	if checkpoint != "" {
-		id := r.FormValue("id")
-
-		path := makeCheckpointPath(name, id)
-		fi, err := os.Stat(path)
+		id, err := parseCheckpointID(checkpoint)
+		if err == nil {
+			_, err = readCheckpoint(name, id)
+		}
 		if err != nil {
-			fmt.Fprintf(w, "checkpoint doesn't exist!")
-			return
+			return checkpointError(name, checkpoint, "send", err)
 		}
+		path = checkpointDir(name, id)
+	}
 
-		if !fi.IsDir() {
-			fmt.Fprintf(w, "checkpoint isn't a directory")
-			return
+	return d.startOperation(fmt.Sprintf("send %s to %s", name, remote), true, func(op *operation) (interface{}, error) {
+		if path != "" {
+			op.progress("sending checkpoint")
+			if err := doRsync(op, remote, path); err != nil {
+				return nil, fmt.Errorf("cannot rsync checkpoint: %v", err)
+			}
 		}
 
-		if doRsync(remote, path) != nil {
-			fmt.Fprintf(w, "rsync of checkpoint failed!")
-			return
+		op.progress("sending container")
+		if err := doRsync(op, remote, filepath.Join(d.lxcpath, name)); err != nil {
+			return nil, fmt.Errorf("cannot rsync container: %v", err)
 		}
-	}
+		return nil, nil
+	})
+}
 
-	if doRsync(remote, filepath.Join(d.lxcpath, name)) != nil {
-		fmt.Fprintf(w, "rsync of container failed!")
-		return
+// serveReceiveContainer records in the database the container another
+// daemon sent with /sendContainer, so that it may be restored from its
+// checkpoint right away rather than once container states are next checked.
+func (d *Daemon) serveReceiveContainer(r *http.Request) response {
+	name := r.FormValue("name")
+	if name == "" {
+		return badRequest("missing container name")
+	}
+	if err := checkContainerName(name); err != nil {
+		return badRequest("%v", err)
+	}
+	state, err := d.backend.State(name)
+	if err != nil {
+		return containerError(name, "receive", err)
 	}
 
-	fmt.Fprintf(w, "send successful!")
+	d.statesMu.Lock()
+	_, known := d.states[name]
+	err = dbContainerCreate(d.db, name, "", defaultProfiles, nil)
+	if err == ErrContainerExists {
+		err = nil
+	}
+	if err == nil && !known {
+		d.states[name] = state
+	}
+	d.statesMu.Unlock()
+	if err != nil {
+		return containerError(name, "receive", err)
+	}
+	if !known {
+		d.events.publish("container", &ContainerEvent{Name: name, Action: "created", State: state})
+	}
+	return emptySyncResponse
 }
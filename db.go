@@ -0,0 +1,1006 @@
+package flex
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dbUpdates holds the statements which update the database schema, in
+// order. Applying the first n of them to an empty database results in
+// schema version n. Entries must never be changed once released; new
+// changes are made by appending to the list.
+var dbUpdates = []string{
+	// Version 1: containers and their configuration.
+	`
+CREATE TABLE containers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	name TEXT NOT NULL UNIQUE,
+	source TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME NOT NULL
+);
+CREATE TABLE containers_config (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	container_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (container_id, key),
+	FOREIGN KEY (container_id) REFERENCES containers (id) ON DELETE CASCADE
+);
+`,
+	// Version 2: profiles, with existing containers using the default one.
+	`
+CREATE TABLE profiles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE profiles_config (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	profile_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (profile_id, key),
+	FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE CASCADE
+);
+CREATE TABLE containers_profiles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	container_id INTEGER NOT NULL,
+	profile_id INTEGER NOT NULL,
+	apply_order INTEGER NOT NULL,
+	UNIQUE (container_id, profile_id),
+	FOREIGN KEY (container_id) REFERENCES containers (id) ON DELETE CASCADE,
+	FOREIGN KEY (profile_id) REFERENCES profiles (id)
+);
+INSERT INTO profiles (name) VALUES ('default');
+INSERT INTO containers_profiles (container_id, profile_id, apply_order)
+	SELECT containers.id, profiles.id, 0 FROM containers, profiles WHERE profiles.name = 'default';
+`,
+	// Version 3: devices of containers and profiles, one property per row.
+	`
+CREATE TABLE containers_devices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	container_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (container_id, name, key),
+	FOREIGN KEY (container_id) REFERENCES containers (id) ON DELETE CASCADE
+);
+CREATE TABLE profiles_devices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	profile_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (profile_id, name, key),
+	FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE CASCADE
+);
+`,
+	// Version 4: images in the store, their properties and aliases.
+	`
+CREATE TABLE images (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	fingerprint TEXT NOT NULL UNIQUE,
+	size INTEGER NOT NULL,
+	architecture TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	uploaded_at DATETIME NOT NULL
+);
+CREATE TABLE images_properties (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	image_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (image_id, key),
+	FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+);
+CREATE TABLE images_aliases (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	name TEXT NOT NULL UNIQUE,
+	image_id INTEGER NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+);
+`,
+	// Version 5: images may be public, and served to untrusted clients.
+	`
+ALTER TABLE images ADD COLUMN public INTEGER NOT NULL DEFAULT 0;
+`,
+	// Version 6: snapshots of containers, with a copy of their profiles,
+	// configuration and devices.
+	`
+CREATE TABLE snapshots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	container_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	backend_name TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	UNIQUE (container_id, name),
+	FOREIGN KEY (container_id) REFERENCES containers (id) ON DELETE CASCADE
+);
+CREATE TABLE snapshots_config (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	snapshot_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (snapshot_id, key),
+	FOREIGN KEY (snapshot_id) REFERENCES snapshots (id) ON DELETE CASCADE
+);
+CREATE TABLE snapshots_devices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	snapshot_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (snapshot_id, name, key),
+	FOREIGN KEY (snapshot_id) REFERENCES snapshots (id) ON DELETE CASCADE
+);
+CREATE TABLE snapshots_profiles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	snapshot_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	apply_order INTEGER NOT NULL,
+	UNIQUE (snapshot_id, name),
+	FOREIGN KEY (snapshot_id) REFERENCES snapshots (id) ON DELETE CASCADE
+);
+`,
+}
+
+// openDB opens the daemon database at path, creating it or updating its
+// schema as necessary.
+func openDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %v", err)
+	}
+	// SQLite doesn't cope well with concurrent writers, and the daemon
+	// makes no heavy use of the database, so serialize all access.
+	db.SetMaxOpenConns(1)
+	err = dbUpdateSchema(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// dbSchemaVersion returns the version of the database schema, which is
+// zero for an empty database.
+func dbSchemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema (version INTEGER NOT NULL UNIQUE, updated_at DATETIME NOT NULL)")
+	if err != nil {
+		return 0, fmt.Errorf("cannot create schema table: %v", err)
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// dbUpdateSchema applies the pending entries in dbUpdates to db, each one
+// within its own transaction.
+func dbUpdateSchema(db *sql.DB) error {
+	version, err := dbSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(dbUpdates) {
+		return fmt.Errorf("database schema version %d is newer than the supported %d", version, len(dbUpdates))
+	}
+	for ; version < len(dbUpdates); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(dbUpdates[version])
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema (version, updated_at) VALUES (?, ?)", version+1, time.Now().UTC())
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return fmt.Errorf("cannot update database schema to version %d: %v", version+1, err)
+		}
+		Debugf("updated database schema to version %d", version+1)
+	}
+	return nil
+}
+
+// containerRecord holds what the daemon database knows about a container.
+type containerRecord struct {
+	id         int64
+	name       string
+	source     string
+	createdAt  time.Time
+	lastUsedAt time.Time
+}
+
+const containerColumns = "id, name, source, created_at, last_used_at"
+
+func scanContainer(row interface {
+	Scan(dest ...interface{}) error
+}) (*containerRecord, error) {
+	var rec containerRecord
+	err := row.Scan(&rec.id, &rec.name, &rec.source, &rec.createdAt, &rec.lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// dbContainers returns all containers in the database, ordered by name.
+func dbContainers(db *sql.DB) ([]*containerRecord, error) {
+	rows, err := db.Query("SELECT " + containerColumns + " FROM containers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*containerRecord
+	for rows.Next() {
+		rec, err := scanContainer(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rec)
+	}
+	return result, rows.Err()
+}
+
+// dbContainer returns the named container, or ErrNoSuchContainer if it's
+// not in the database.
+func dbContainer(db *sql.DB, name string) (*containerRecord, error) {
+	rec, err := scanContainer(db.QueryRow("SELECT "+containerColumns+" FROM containers WHERE name=?", name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchContainer
+	}
+	return rec, err
+}
+
+// dbContainerCreate adds the named container to the database, using the
+// provided profiles, or fails with ErrContainerExists if it's there already.
+func dbContainerCreate(db *sql.DB, name string, source string, profiles []string, config map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM containers WHERE name=?", name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrContainerExists
+	}
+	res, err := tx.Exec("INSERT INTO containers (name, source, created_at, last_used_at) VALUES (?, ?, ?, ?)",
+		name, source, time.Now().UTC(), time.Time{})
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	err = txSetContainerProfiles(tx, id, profiles)
+	if err != nil {
+		return err
+	}
+	err = txSetConfig(tx, "containers_config", "container_id", id, config)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbContainerDelete removes the named container and its configuration from
+// the database, if it's there.
+func dbContainerDelete(db *sql.DB, name string) error {
+	_, err := db.Exec("DELETE FROM containers WHERE name=?", name)
+	return err
+}
+
+// dbContainerUsed records the named container as last started now.
+func dbContainerUsed(db *sql.DB, name string) error {
+	_, err := db.Exec("UPDATE containers SET last_used_at=? WHERE name=?", time.Now().UTC(), name)
+	return err
+}
+
+// dbContainerConfig returns the configuration of the container with the
+// provided database id.
+func dbContainerConfig(db *sql.DB, id int64) (map[string]string, error) {
+	return dbConfig(db, "SELECT key, value FROM containers_config WHERE container_id=?", id)
+}
+
+// dbConfig returns the configuration keys and values selected by query.
+func dbConfig(db *sql.DB, query string, args ...interface{}) (map[string]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	config := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		err := rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		config[key] = value
+	}
+	return config, rows.Err()
+}
+
+// dbContainerUpdate replaces the configuration, devices and profiles of
+// the container with the provided database id, leaving alone those which
+// are nil.
+func dbContainerUpdate(db *sql.DB, id int64, config map[string]string, devices map[string]Device, profiles []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if config != nil {
+		err = txSetConfig(tx, "containers_config", "container_id", id, config)
+		if err != nil {
+			return err
+		}
+	}
+	if devices != nil {
+		err = txSetDevices(tx, "containers_devices", "container_id", id, devices)
+		if err != nil {
+			return err
+		}
+	}
+	if profiles != nil {
+		_, err = tx.Exec("DELETE FROM containers_profiles WHERE container_id=?", id)
+		if err != nil {
+			return err
+		}
+		err = txSetContainerProfiles(tx, id, profiles)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// txSetConfig replaces the configuration held in table for the row in the
+// table it refers to through column with the provided id.
+func txSetConfig(tx *sql.Tx, table string, column string, id int64, config map[string]string) error {
+	_, err := tx.Exec("DELETE FROM "+table+" WHERE "+column+"=?", id)
+	if err != nil {
+		return err
+	}
+	for key, value := range config {
+		_, err = tx.Exec("INSERT INTO "+table+" ("+column+", key, value) VALUES (?, ?, ?)", id, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txSetDevices replaces the devices held in table for the row in the table
+// it refers to through column with the provided id.
+func txSetDevices(tx *sql.Tx, table string, column string, id int64, devices map[string]Device) error {
+	_, err := tx.Exec("DELETE FROM "+table+" WHERE "+column+"=?", id)
+	if err != nil {
+		return err
+	}
+	for name, dev := range devices {
+		for key, value := range dev {
+			_, err = tx.Exec("INSERT INTO "+table+" ("+column+", name, key, value) VALUES (?, ?, ?, ?)", id, name, key, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dbDevices returns the devices whose names, keys and values are selected
+// by query.
+func dbDevices(db *sql.DB, query string, args ...interface{}) (map[string]Device, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make(map[string]Device)
+	for rows.Next() {
+		var name, key, value string
+		err := rows.Scan(&name, &key, &value)
+		if err != nil {
+			return nil, err
+		}
+		if devices[name] == nil {
+			devices[name] = make(Device)
+		}
+		devices[name][key] = value
+	}
+	return devices, rows.Err()
+}
+
+// dbContainerDevices returns the devices of the container with the provided
+// database id.
+func dbContainerDevices(db *sql.DB, id int64) (map[string]Device, error) {
+	return dbDevices(db, "SELECT name, key, value FROM containers_devices WHERE container_id=?", id)
+}
+
+// txSetContainerProfiles applies the named profiles, in order, to the
+// container with the provided database id, which must have none yet.
+func txSetContainerProfiles(tx *sql.Tx, id int64, profiles []string) error {
+	for i, name := range profiles {
+		var profileID int64
+		err := tx.QueryRow("SELECT id FROM profiles WHERE name=?", name).Scan(&profileID)
+		if err == sql.ErrNoRows {
+			return errNoSuchProfile
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO containers_profiles (container_id, profile_id, apply_order) VALUES (?, ?, ?)", id, profileID, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbContainerProfiles returns the names of the profiles applied to the
+// container with the provided database id, in order.
+func dbContainerProfiles(db *sql.DB, id int64) ([]string, error) {
+	return dbNames(db, "SELECT profiles.name FROM containers_profiles JOIN profiles ON profiles.id = containers_profiles.profile_id WHERE container_id=? ORDER BY apply_order", id)
+}
+
+var errSnapshotExists = errors.New("snapshot already exists")
+
+// snapshotRecord is a snapshot of a container, as recorded in the database.
+// The backend knows it by backendName.
+type snapshotRecord struct {
+	id          int64
+	name        string
+	backendName string
+	createdAt   time.Time
+}
+
+const snapshotColumns = "id, name, backend_name, created_at"
+
+func scanSnapshot(row interface {
+	Scan(dest ...interface{}) error
+}) (*snapshotRecord, error) {
+	var rec snapshotRecord
+	err := row.Scan(&rec.id, &rec.name, &rec.backendName, &rec.createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// dbSnapshots returns the snapshots of the container with the provided
+// database id, in the order they were taken.
+func dbSnapshots(db *sql.DB, containerID int64) ([]*snapshotRecord, error) {
+	rows, err := db.Query("SELECT "+snapshotColumns+" FROM snapshots WHERE container_id=? ORDER BY created_at, id", containerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*snapshotRecord
+	for rows.Next() {
+		rec, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rec)
+	}
+	return result, rows.Err()
+}
+
+// dbSnapshot returns the named snapshot of the container with the provided
+// database id, or ErrNoSuchSnapshot if it's not in the database.
+func dbSnapshot(db *sql.DB, containerID int64, name string) (*snapshotRecord, error) {
+	rec, err := scanSnapshot(db.QueryRow("SELECT "+snapshotColumns+" FROM snapshots WHERE container_id=? AND name=?", containerID, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchSnapshot
+	}
+	return rec, err
+}
+
+// dbSnapshotCreate records the named snapshot of the container with the
+// provided database id, along with a copy of the profiles, configuration
+// and devices the container has now, or fails with errSnapshotExists if
+// the container has a snapshot with that name already.
+func dbSnapshotCreate(db *sql.DB, containerID int64, name string, backendName string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM snapshots WHERE container_id=? AND name=?", containerID, name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errSnapshotExists
+	}
+	res, err := tx.Exec("INSERT INTO snapshots (container_id, name, backend_name, created_at) VALUES (?, ?, ?, ?)",
+		containerID, name, backendName, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"INSERT INTO snapshots_config (snapshot_id, key, value) SELECT ?, key, value FROM containers_config WHERE container_id=?",
+		"INSERT INTO snapshots_devices (snapshot_id, name, key, value) SELECT ?, name, key, value FROM containers_devices WHERE container_id=?",
+		"INSERT INTO snapshots_profiles (snapshot_id, name, apply_order) SELECT ?, profiles.name, apply_order FROM containers_profiles JOIN profiles ON profiles.id = containers_profiles.profile_id WHERE container_id=?",
+	} {
+		_, err = tx.Exec(stmt, id, containerID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dbSnapshotRestore replaces the profiles, configuration and devices of the
+// container with the provided database id with those recorded in its
+// snapshot. Profiles deleted since the snapshot was taken are left out.
+func dbSnapshotRestore(db *sql.DB, containerID int64, snapshotID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"DELETE FROM containers_config WHERE container_id=?",
+		"DELETE FROM containers_devices WHERE container_id=?",
+		"DELETE FROM containers_profiles WHERE container_id=?",
+	} {
+		_, err = tx.Exec(stmt, containerID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []string{
+		"INSERT INTO containers_config (container_id, key, value) SELECT ?, key, value FROM snapshots_config WHERE snapshot_id=?",
+		"INSERT INTO containers_devices (container_id, name, key, value) SELECT ?, name, key, value FROM snapshots_devices WHERE snapshot_id=?",
+		"INSERT INTO containers_profiles (container_id, profile_id, apply_order) SELECT ?, profiles.id, apply_order FROM snapshots_profiles JOIN profiles ON profiles.name = snapshots_profiles.name WHERE snapshot_id=?",
+	} {
+		_, err = tx.Exec(stmt, containerID, snapshotID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dbSnapshotDelete removes the snapshot with the provided database id.
+func dbSnapshotDelete(db *sql.DB, id int64) error {
+	_, err := db.Exec("DELETE FROM snapshots WHERE id=?", id)
+	return err
+}
+
+// dbSnapshotConfig returns the configuration recorded in the snapshot with
+// the provided database id.
+func dbSnapshotConfig(db *sql.DB, id int64) (map[string]string, error) {
+	return dbConfig(db, "SELECT key, value FROM snapshots_config WHERE snapshot_id=?", id)
+}
+
+// dbSnapshotDevices returns the devices recorded in the snapshot with the
+// provided database id.
+func dbSnapshotDevices(db *sql.DB, id int64) (map[string]Device, error) {
+	return dbDevices(db, "SELECT name, key, value FROM snapshots_devices WHERE snapshot_id=?", id)
+}
+
+// dbSnapshotProfiles returns the names of the profiles recorded in the
+// snapshot with the provided database id, in order.
+func dbSnapshotProfiles(db *sql.DB, id int64) ([]string, error) {
+	return dbNames(db, "SELECT name FROM snapshots_profiles WHERE snapshot_id=? ORDER BY apply_order", id)
+}
+
+// dbProfileContainers returns the names of the containers the named
+// profile is applied to, in order.
+func dbProfileContainers(db *sql.DB, name string) ([]string, error) {
+	return dbNames(db, "SELECT containers.name FROM containers_profiles JOIN containers ON containers.id = containers_profiles.container_id JOIN profiles ON profiles.id = containers_profiles.profile_id WHERE profiles.name=? ORDER BY containers.name", name)
+}
+
+// dbNames returns the single column of names selected by query.
+func dbNames(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+var (
+	errNoSuchProfile = errors.New("no such profile")
+	errProfileExists = errors.New("profile already exists")
+	errProfileInUse  = errors.New("profile is in use")
+)
+
+// dbProfiles returns the names of all profiles, in order.
+func dbProfiles(db *sql.DB) ([]string, error) {
+	return dbNames(db, "SELECT name FROM profiles ORDER BY name")
+}
+
+// dbProfile returns the named profile, or errNoSuchProfile if it doesn't
+// exist.
+func dbProfile(db *sql.DB, name string) (*ProfileInfo, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM profiles WHERE name=?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchProfile
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile := &ProfileInfo{Name: name}
+	profile.Config, err = dbConfig(db, "SELECT key, value FROM profiles_config WHERE profile_id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	profile.Devices, err = dbDevices(db, "SELECT name, key, value FROM profiles_devices WHERE profile_id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// dbProfileCreate adds the named profile with the provided configuration
+// and devices, or fails with errProfileExists if it's there already.
+func dbProfileCreate(db *sql.DB, name string, config map[string]string, devices map[string]Device) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM profiles WHERE name=?", name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errProfileExists
+	}
+	res, err := tx.Exec("INSERT INTO profiles (name) VALUES (?)", name)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	err = txSetConfig(tx, "profiles_config", "profile_id", id, config)
+	if err != nil {
+		return err
+	}
+	err = txSetDevices(tx, "profiles_devices", "profile_id", id, devices)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbProfileUpdate replaces the configuration and devices of the named
+// profile, leaving alone those which are nil.
+func dbProfileUpdate(db *sql.DB, name string, config map[string]string, devices map[string]Device) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRow("SELECT id FROM profiles WHERE name=?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNoSuchProfile
+	}
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		err = txSetConfig(tx, "profiles_config", "profile_id", id, config)
+		if err != nil {
+			return err
+		}
+	}
+	if devices != nil {
+		err = txSetDevices(tx, "profiles_devices", "profile_id", id, devices)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dbProfileDelete removes the named profile, unless it's applied to any
+// containers, in which case it fails with errProfileInUse.
+func dbProfileDelete(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRow("SELECT id FROM profiles WHERE name=?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNoSuchProfile
+	}
+	if err != nil {
+		return err
+	}
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM containers_profiles WHERE profile_id=?", id).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errProfileInUse
+	}
+	_, err = tx.Exec("DELETE FROM profiles WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var (
+	errNoSuchImage      = errors.New("no such image")
+	errImageExists      = errors.New("image already exists")
+	errAmbiguousImage   = errors.New("ambiguous image fingerprint")
+	errNoSuchImageAlias = errors.New("no such image alias")
+	errImageAliasExists = errors.New("image alias already exists")
+)
+
+const imageColumns = "id, fingerprint, size, architecture, public, created_at, uploaded_at"
+
+// dbImages returns the fingerprints of all images, in order.
+func dbImages(db *sql.DB) ([]string, error) {
+	return dbNames(db, "SELECT fingerprint FROM images ORDER BY fingerprint")
+}
+
+// dbImage returns the image with the provided fingerprint, which may be
+// abbreviated to a unique prefix. It fails with errNoSuchImage if there's
+// no such image, and errAmbiguousImage if the prefix isn't unique.
+func dbImage(db *sql.DB, fingerprint string) (*ImageInfo, error) {
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images WHERE substr(fingerprint, 1, ?)=? LIMIT 2", len(fingerprint), fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	var images []*ImageInfo
+	for rows.Next() {
+		var image ImageInfo
+		err := rows.Scan(&id, &image.Fingerprint, &image.Size, &image.Architecture, &image.Public, &image.CreatedAt, &image.UploadedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		images = append(images, &image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(images) == 0 || fingerprint == "":
+		return nil, errNoSuchImage
+	case len(images) > 1:
+		return nil, errAmbiguousImage
+	}
+	image := images[0]
+	image.Properties, err = dbConfig(db, "SELECT key, value FROM images_properties WHERE image_id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	image.Aliases, err = dbNames(db, "SELECT name FROM images_aliases WHERE image_id=? ORDER BY name", id)
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// dbImageCreate adds image to the database, or fails with errImageExists if
+// it's there already. Its aliases are not added.
+func dbImageCreate(db *sql.DB, image *ImageInfo) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM images WHERE fingerprint=?", image.Fingerprint).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errImageExists
+	}
+	res, err := tx.Exec("INSERT INTO images (fingerprint, size, architecture, public, created_at, uploaded_at) VALUES (?, ?, ?, ?, ?, ?)",
+		image.Fingerprint, image.Size, image.Architecture, image.Public, image.CreatedAt.UTC(), image.UploadedAt.UTC())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	err = txSetConfig(tx, "images_properties", "image_id", id, image.Properties)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbImageSetPublic sets whether the image with the provided fingerprint is
+// public, or fails with errNoSuchImage if it doesn't exist.
+func dbImageSetPublic(db *sql.DB, fingerprint string, public bool) error {
+	res, err := db.Exec("UPDATE images SET public=? WHERE fingerprint=?", public, fingerprint)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoSuchImage
+	}
+	return nil
+}
+
+// dbImageDelete removes the image with the provided fingerprint, along with
+// its aliases.
+func dbImageDelete(db *sql.DB, fingerprint string) error {
+	_, err := db.Exec("DELETE FROM images WHERE fingerprint=?", fingerprint)
+	return err
+}
+
+const imageAliasColumns = "images_aliases.name, images_aliases.description, images.fingerprint"
+
+func scanImageAlias(row interface {
+	Scan(dest ...interface{}) error
+}) (*ImageAlias, error) {
+	var alias ImageAlias
+	err := row.Scan(&alias.Name, &alias.Description, &alias.Target)
+	if err != nil {
+		return nil, err
+	}
+	return &alias, nil
+}
+
+// dbImageAliases returns all image aliases, ordered by name.
+func dbImageAliases(db *sql.DB) ([]*ImageAlias, error) {
+	rows, err := db.Query("SELECT " + imageAliasColumns + " FROM images_aliases JOIN images ON images.id = images_aliases.image_id ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []*ImageAlias{}
+	for rows.Next() {
+		alias, err := scanImageAlias(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, alias)
+	}
+	return result, rows.Err()
+}
+
+// dbImageAlias returns the named image alias, or errNoSuchImageAlias if
+// it doesn't exist.
+func dbImageAlias(db *sql.DB, name string) (*ImageAlias, error) {
+	alias, err := scanImageAlias(db.QueryRow("SELECT "+imageAliasColumns+" FROM images_aliases JOIN images ON images.id = images_aliases.image_id WHERE name=?", name))
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchImageAlias
+	}
+	return alias, err
+}
+
+// dbImageAliasCreate adds alias, which must target the complete fingerprint
+// of an image, or fails with errImageAliasExists if it's there already.
+func dbImageAliasCreate(db *sql.DB, alias *ImageAlias) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM images_aliases WHERE name=?", alias.Name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errImageAliasExists
+	}
+	var id int64
+	err = tx.QueryRow("SELECT id FROM images WHERE fingerprint=?", alias.Target).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errNoSuchImage
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO images_aliases (name, image_id, description) VALUES (?, ?, ?)", alias.Name, id, alias.Description)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbImageAliasDelete removes the named image alias, or fails with
+// errNoSuchImageAlias if it doesn't exist.
+func dbImageAliasDelete(db *sql.DB, name string) error {
+	res, err := db.Exec("DELETE FROM images_aliases WHERE name=?", name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoSuchImageAlias
+	}
+	return nil
+}
+
+// syncDB makes the database agree with the containers the backend knows
+// about, for when they were created or destroyed without the daemon's
+// involvement, such as while it wasn't running.
+func (d *Daemon) syncDB() error {
+	names, err := d.backend.List()
+	if err != nil {
+		return fmt.Errorf("cannot list containers: %v", err)
+	}
+	recs, err := dbContainers(d.db)
+	if err != nil {
+		return fmt.Errorf("cannot list containers in database: %v", err)
+	}
+	known := make(map[string]bool)
+	for _, rec := range recs {
+		known[rec.name] = true
+	}
+	for _, name := range names {
+		if known[name] {
+			delete(known, name)
+			continue
+		}
+		Logf("adding unknown container %q to the database", name)
+		err := dbContainerCreate(d.db, name, "", defaultProfiles, nil)
+		if err != nil && err != ErrContainerExists {
+			return fmt.Errorf("cannot add container %q to database: %v", name, err)
+		}
+	}
+	for name := range known {
+		Logf("removing missing container %q from the database", name)
+		err := dbContainerDelete(d.db, name)
+		if err != nil {
+			return fmt.Errorf("cannot remove container %q from database: %v", name, err)
+		}
+	}
+	return nil
+}
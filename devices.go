@@ -0,0 +1,198 @@
+package flex
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Device holds the properties of a device made available to a container,
+// such as a host directory or a network interface. The "type" property
+// defines which other properties are accepted:
+//
+//	disk        source (host path), path (container path), readonly
+//	nic         nictype (bridged, macvlan or physical), parent (host
+//	            bridge or interface), name, hwaddr, mtu
+//	unix-char   path (container path), source (host path, defaults to
+//	unix-block  path), major, minor (default to those of source)
+type Device map[string]string
+
+// deviceKeys holds the properties accepted for each device type, with
+// their validation functions, which may be nil.
+var deviceKeys = map[string]map[string]func(string) error{
+	"disk": {
+		"source":   checkAbsPath,
+		"path":     checkAbsPath,
+		"readonly": checkBool,
+	},
+	"nic": {
+		"nictype": checkNICType,
+		"parent":  checkInterfaceName,
+		"name":    checkInterfaceName,
+		"hwaddr":  checkHWAddr,
+		"mtu":     checkUint,
+	},
+	"unix-char": {
+		"source": checkAbsPath,
+		"path":   checkAbsPath,
+		"major":  checkUint,
+		"minor":  checkUint,
+	},
+	"unix-block": {
+		"source": checkAbsPath,
+		"path":   checkAbsPath,
+		"major":  checkUint,
+		"minor":  checkUint,
+	},
+}
+
+// requiredDeviceKeys holds the properties that must be set for each
+// device type.
+var requiredDeviceKeys = map[string][]string{
+	"disk":       {"source", "path"},
+	"nic":        {"nictype", "parent"},
+	"unix-char":  {"path"},
+	"unix-block": {"path"},
+}
+
+// checkAbsPath returns an error unless value is a clean absolute path
+// other than the root directory, fit for the mount entries of LXC.
+func checkAbsPath(value string) error {
+	if !filepath.IsAbs(value) {
+		return fmt.Errorf("%q is not an absolute path", value)
+	}
+	if value == "/" {
+		return fmt.Errorf("%q is the root directory", value)
+	}
+	// Clean absolute paths have no ".." elements.
+	if filepath.Clean(value) != value {
+		return fmt.Errorf("%q is not a clean path", value)
+	}
+	if strings.IndexFunc(value, isSpaceOrControl) >= 0 {
+		return fmt.Errorf("%q has spaces or control characters", value)
+	}
+	return nil
+}
+
+func isSpaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+var interfaceNameExp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+func checkInterfaceName(value string) error {
+	if !interfaceNameExp.MatchString(value) {
+		return fmt.Errorf("%q is not a network interface name", value)
+	}
+	return nil
+}
+
+func checkNICType(value string) error {
+	switch value {
+	case "bridged", "macvlan", "physical":
+		return nil
+	}
+	return fmt.Errorf("unknown nic type %q", value)
+}
+
+var hwaddrExp = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+
+func checkHWAddr(value string) error {
+	if !hwaddrExp.MatchString(value) {
+		return fmt.Errorf("%q is not a MAC address", value)
+	}
+	return nil
+}
+
+// checkDevice returns an error if the properties of dev are not valid for
+// its type.
+func checkDevice(name string, dev Device) error {
+	keys, ok := deviceKeys[dev["type"]]
+	if !ok {
+		if dev["type"] == "" {
+			return fmt.Errorf("missing type of device %q", name)
+		}
+		return fmt.Errorf("unknown type of device %q: %q", name, dev["type"])
+	}
+	for key, value := range dev {
+		if key == "type" {
+			continue
+		}
+		check, ok := keys[key]
+		if !ok {
+			return fmt.Errorf("unknown property of %s device %q: %q", dev["type"], name, key)
+		}
+		if check == nil {
+			continue
+		}
+		if err := check(value); err != nil {
+			return fmt.Errorf("invalid %s of device %q: %v", key, name, err)
+		}
+	}
+	for _, key := range requiredDeviceKeys[dev["type"]] {
+		if dev[key] == "" {
+			return fmt.Errorf("missing %s of device %q", key, name)
+		}
+	}
+	return nil
+}
+
+// checkDevices returns an error if any of devices is not valid.
+func checkDevices(devices map[string]Device) error {
+	for name, dev := range devices {
+		if name == "" {
+			return fmt.Errorf("missing device name")
+		}
+		if err := checkDevice(name, dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandDevices returns the devices resulting from applying the provided
+// profile devices in order, followed by local, with later devices taking
+// the place of earlier ones with the same name.
+func expandDevices(profiles []map[string]Device, local map[string]Device) map[string]Device {
+	expanded := make(map[string]Device)
+	for _, devices := range append(profiles, local) {
+		for name, dev := range devices {
+			expanded[name] = dev
+		}
+	}
+	return expanded
+}
+
+// sortedDeviceNames returns the names of devices in order.
+func sortedDeviceNames(devices map[string]Device) []string {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deviceEqual returns whether a and b have the same properties.
+func deviceEqual(a, b Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// deviceSource returns the host path of the disk or unix device dev.
+func deviceSource(dev Device) string {
+	if dev["source"] != "" {
+		return dev["source"]
+	}
+	return dev["path"]
+}
@@ -0,0 +1,359 @@
+package flex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event describes something that happened in the daemon. The content of
+// the metadata depends on the event type:
+//
+//	"container"    a *ContainerEvent
+//	"operation"    the *Operation as of the event time
+type Event struct {
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// ContainerEvent reports a change to a container. Action is one of
+// "created", "started", "stopped", "restarted", "destroyed", "crashed",
+// "checkpointed", "snapshotted", "restored", "configured" or "changed".
+// Containers that stop without being requested to through the daemon are
+// reported as crashed, and "restored" is reported both for checkpoints and
+// snapshots.
+type ContainerEvent struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	State  string `json:"state,omitempty"`
+}
+
+// eventTypes holds the known event types.
+var eventTypes = map[string]bool{
+	"container": true,
+	"operation": true,
+}
+
+// eventListenerBuffer defines how many events may be queued for a listener
+// before it's considered too slow and dropped.
+const eventListenerBuffer = 64
+
+type eventListener struct {
+	types map[string]bool
+	ch    chan *Event
+}
+
+// eventHub distributes the events published by the daemon to all the
+// currently connected listeners.
+type eventHub struct {
+	mu        sync.Mutex
+	listeners map[*eventListener]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{listeners: make(map[*eventListener]bool)}
+}
+
+// listen registers a new listener for events of the provided types, or all
+// events if no types are provided.
+func (h *eventHub) listen(types []string) *eventListener {
+	l := &eventListener{ch: make(chan *Event, eventListenerBuffer)}
+	if len(types) > 0 {
+		l.types = make(map[string]bool)
+		for _, t := range types {
+			l.types[t] = true
+		}
+	}
+	h.mu.Lock()
+	h.listeners[l] = true
+	h.mu.Unlock()
+	return l
+}
+
+// forget unregisters l and closes its channel, unless that was done already.
+func (h *eventHub) forget(l *eventListener) {
+	h.mu.Lock()
+	if h.listeners[l] {
+		delete(h.listeners, l)
+		close(l.ch)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends an event with the provided type and metadata to all
+// interested listeners. Listeners which can't keep up are dropped.
+func (h *eventHub) publish(t string, metadata interface{}) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		Logf("cannot marshal %s event: %v", t, err)
+		return
+	}
+	e := &Event{Type: t, Timestamp: time.Now().UTC(), Metadata: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for l := range h.listeners {
+		if l.types != nil && !l.types[t] {
+			continue
+		}
+		select {
+		case l.ch <- e:
+		default:
+			Logf("dropping slow event listener")
+			delete(h.listeners, l)
+			close(l.ch)
+		}
+	}
+}
+
+// beginChange marks the named container as being changed through the
+// daemon, so that the state monitor leaves it alone until endChange is
+// called to report the outcome.
+func (d *Daemon) beginChange(name string) {
+	d.statesMu.Lock()
+	d.changing[name]++
+	d.statesMu.Unlock()
+}
+
+// endChange records the resulting state of the named container after a
+// change started with beginChange, and if err is nil publishes action as
+// having happened to it.
+func (d *Daemon) endChange(name string, action string, err error) {
+	d.statesMu.Lock()
+	state, serr := d.backend.State(name)
+	if serr == nil {
+		d.states[name] = state
+	} else {
+		delete(d.states, name)
+	}
+	d.changing[name]--
+	if d.changing[name] <= 0 {
+		delete(d.changing, name)
+	}
+	d.statesMu.Unlock()
+	if err == nil {
+		d.events.publish("container", &ContainerEvent{Name: name, Action: action, State: state})
+	}
+}
+
+// monitorInterval defines how often the daemon looks for changes in the
+// state of containers that were not requested through it.
+var monitorInterval = 5 * time.Second
+
+// monitorStates periodically compares the state of all containers with the
+// last one recorded, and publishes events for any changes found, until the
+// daemon is stopped.
+func (d *Daemon) monitorStates() error {
+	for {
+		d.checkStates()
+		select {
+		case <-time.After(monitorInterval):
+		case <-d.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// containerStates returns the current state of all containers by name.
+func (d *Daemon) containerStates() (map[string]string, error) {
+	names, err := d.backend.List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list containers: %v", err)
+	}
+	states := make(map[string]string)
+	for _, name := range names {
+		state, err := d.backend.State(name)
+		if err == nil {
+			states[name] = state
+		}
+	}
+	return states, nil
+}
+
+func (d *Daemon) checkStates() {
+	var events []*ContainerEvent
+
+	d.statesMu.Lock()
+	current, err := d.containerStates()
+	if err != nil {
+		d.statesMu.Unlock()
+		Logf("%v", err)
+		return
+	}
+	for name := range d.changing {
+		// Reported by endChange instead.
+		if state, ok := d.states[name]; ok {
+			current[name] = state
+		} else {
+			delete(current, name)
+		}
+	}
+	for name, state := range current {
+		prev, ok := d.states[name]
+		var action string
+		switch {
+		case !ok:
+			action = "created"
+		case prev == state:
+			continue
+		case state == "RUNNING":
+			action = "started"
+		case prev == "RUNNING" && state == "STOPPED":
+			action = "crashed"
+		default:
+			action = "changed"
+		}
+		events = append(events, &ContainerEvent{Name: name, Action: action, State: state})
+	}
+	for name := range d.states {
+		if _, ok := current[name]; !ok {
+			events = append(events, &ContainerEvent{Name: name, Action: "destroyed"})
+		}
+	}
+	d.states = current
+	d.statesMu.Unlock()
+
+	for _, e := range events {
+		d.recordEvent(e)
+		d.events.publish("container", e)
+	}
+}
+
+// recordEvent updates the database with a container creation or
+// destruction that happened without the daemon's involvement.
+func (d *Daemon) recordEvent(e *ContainerEvent) {
+	var err error
+	switch e.Action {
+	case "created":
+		err = dbContainerCreate(d.db, e.Name, "", defaultProfiles, nil)
+		if err == ErrContainerExists {
+			err = nil
+		}
+	case "destroyed":
+		err = dbContainerDelete(d.db, e.Name)
+	}
+	if err != nil {
+		Logf("cannot update container %q in database: %v", e.Name, err)
+	}
+}
+
+// eventsResponse streams events to the client as json documents, one per
+// line, until the client goes away or the daemon is stopped.
+type eventsResponse struct {
+	d     *Daemon
+	r     *http.Request
+	types []string
+}
+
+func (resp *eventsResponse) render(w http.ResponseWriter) error {
+	l := resp.d.events.listen(resp.types)
+	defer resp.d.events.forget(l)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e, ok := <-l.ch:
+			if !ok {
+				return nil
+			}
+			err := enc.Encode(e)
+			if err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-resp.r.Context().Done():
+			return nil
+		case <-resp.d.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (d *Daemon) serveEvents(r *http.Request) response {
+	res := &resource{get: d.eventsGet}
+	return res.serve(r)
+}
+
+// eventsGet streams events of the types listed in the comma-separated type
+// parameter, or of all types if that's empty.
+func (d *Daemon) eventsGet(r *http.Request) response {
+	var types []string
+	if s := r.FormValue("type"); s != "" {
+		types = strings.Split(s, ",")
+		for _, t := range types {
+			if !eventTypes[t] {
+				return badRequest("unknown event type %q", t)
+			}
+		}
+	}
+	return &eventsResponse{d, r, types}
+}
+
+// EventStream delivers the events sent by the daemon.
+type EventStream struct {
+	// Events delivers the events received. It's closed when the stream
+	// is closed or fails, in which case Err reports the reason.
+	Events <-chan *Event
+
+	resp      *http.Response
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	err       error
+}
+
+// Close stops receiving events.
+func (s *EventStream) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.resp.Body.Close()
+}
+
+// Err returns the error that interrupted the stream, if any.
+func (s *EventStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *EventStream) loop(ch chan<- *Event) {
+	defer close(ch)
+	dec := json.NewDecoder(s.resp.Body)
+	for {
+		var e Event
+		err := dec.Decode(&e)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				if err == io.EOF {
+					err = fmt.Errorf("event stream closed by daemon")
+				} else {
+					err = fmt.Errorf("cannot read event: %v", err)
+				}
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+			}
+			return
+		}
+		select {
+		case ch <- &e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package flex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/kr/pty"
+)
+
+// ExecOptions holds the environment for a command run with Client.Exec.
+type ExecOptions struct {
+	// Env holds environment variables for the command, in addition to
+	// the default PATH and HOME and those in the environment.* keys of
+	// the container configuration, which it may override.
+	Env map[string]string
+
+	// Cwd holds the working directory of the command inside the
+	// container. If empty, it's the root directory.
+	Cwd string
+
+	// Interactive runs the command on a terminal allocated by the
+	// daemon. Both its output and errors are then written to Stdout.
+	Interactive bool
+
+	// Width and Height define the initial size of the terminal of
+	// interactive commands, if not zero.
+	Width  int
+	Height int
+
+	// Control delivers messages to be sent to the daemon while the
+	// command runs, such as terminal resizes and signals.
+	Control <-chan ExecControl
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExecResult is the result of a finished exec operation.
+type ExecResult struct {
+	// Return holds the exit status of the command.
+	Return int `json:"return"`
+}
+
+// ExecControl is a message sent to the daemon over the control websocket
+// of an exec operation. Command is either "window-resize", which resizes
+// the terminal of an interactive command to Width and Height, or "signal",
+// which sends Signal to the command.
+type ExecControl struct {
+	Command string `json:"command"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Signal  int    `json:"signal,omitempty"`
+}
+
+// execSockets is the metadata of a running exec operation. FDs holds the
+// secrets for connecting to the websockets carrying the standard streams
+// of the command, by file descriptor number, and the control messages,
+// as "control". Interactive commands have a single websocket for their
+// standard streams, "0", carrying both input and output.
+type execSockets struct {
+	FDs map[string]string `json:"fds"`
+}
+
+// execEnv holds the environment variables set by default for commands.
+var execEnv = map[string]string{
+	"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME": "/root",
+}
+
+type containerExecReq struct {
+	Command     []string          `json:"command"`
+	Environment map[string]string `json:"environment"`
+	Cwd         string            `json:"cwd"`
+	Interactive bool              `json:"interactive"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+}
+
+func (d *Daemon) containerExecPost(r *http.Request) response {
+	name, _ := containerPath(r)
+
+	var req containerExecReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if len(req.Command) == 0 {
+		return badRequest("missing command")
+	}
+	if req.Width < 0 || req.Height < 0 || req.Width > 0xffff || req.Height > 0xffff {
+		return badRequest("invalid terminal size %dx%d", req.Width, req.Height)
+	}
+	info, err := d.containerInfo(name)
+	if err != nil {
+		return containerError(name, "exec in", err)
+	}
+	if info.State != "RUNNING" {
+		return errorf(http.StatusConflict, "container %q is not running", name)
+	}
+
+	env := make(map[string]string)
+	for k, v := range execEnv {
+		env[k] = v
+	}
+	for k, v := range containerEnv(info.ExpandedConfig) {
+		env[k] = v
+	}
+	for k, v := range req.Environment {
+		if k == "" || strings.Contains(k, "=") {
+			return badRequest("invalid environment variable name %q", k)
+		}
+		env[k] = v
+	}
+	opts := AttachOptions{Cwd: req.Cwd}
+	for k, v := range env {
+		opts.Env = append(opts.Env, k+"="+v)
+	}
+	sort.Strings(opts.Env)
+
+	fds := []string{"0", "1", "2", "control"}
+	if req.Interactive {
+		fds = []string{"0", "control"}
+	}
+	sockets, err := newWebsocketSet(fds...)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	op, err := d.newOperation(fmt.Sprintf("exec %s", name), false)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	op.sockets = sockets
+	op.doc.Metadata, err = json.Marshal(&execSockets{sockets.secrets})
+	if err != nil {
+		return internalError("cannot marshal operation metadata: %v", err)
+	}
+
+	return d.runOperation(op, func(op *operation) (interface{}, error) {
+		conns, err := sockets.wait(d, op)
+		defer sockets.close()
+		if err != nil {
+			return nil, err
+		}
+		signals := make(chan os.Signal, 8)
+		opts.Signals = signals
+		var code int
+		if req.Interactive {
+			code, err = d.execInteractive(name, &req, opts, conns, signals)
+		} else {
+			stop := startExecControl(conns["control"], nil, signals)
+			code, err = d.execPipes(name, req.Command, opts, conns)
+			stop()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot exec in container %q: %v", name, err)
+		}
+		return &ExecResult{Return: code}, nil
+	})
+}
+
+// execPipes runs argv in the named container with its standard streams
+// connected to the websockets in conns.
+func (d *Daemon) execPipes(name string, argv []string, opts AttachOptions, conns map[string]*websocket.Conn) (int, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	pipe := func() (r *os.File, w *os.File, err error) {
+		r, w, err = os.Pipe()
+		if err == nil {
+			files = append(files, r, w)
+		}
+		return r, w, err
+	}
+	stdinr, stdinw, err := pipe()
+	if err != nil {
+		return -1, err
+	}
+	stdoutr, stdoutw, err := pipe()
+	if err != nil {
+		return -1, err
+	}
+	stderrr, stderrw, err := pipe()
+	if err != nil {
+		return -1, err
+	}
+
+	stdinDone := make(chan struct{})
+	go func() {
+		err := wsReadStream(stdinw, conns["0"])
+		if err != nil {
+			Debugf("exec stdin interrupted: %v", err)
+		}
+		stdinw.Close()
+		close(stdinDone)
+	}()
+	var wg sync.WaitGroup
+	for fd, r := range map[string]*os.File{"1": stdoutr, "2": stderrr} {
+		wg.Add(1)
+		go func(conn *websocket.Conn, r *os.File) {
+			defer wg.Done()
+			err := wsWriteStream(conn, r)
+			if err != nil {
+				Debugf("exec output interrupted: %v", err)
+			}
+			wsCloseStream(conn)
+		}(conns[fd], r)
+	}
+
+	opts.Stdin = stdinr
+	opts.Stdout = stdoutw
+	opts.Stderr = stderrw
+	code, err := d.backend.Attach(name, argv, opts)
+
+	// Deliver what's left of the output once the command is gone.
+	stdinr.Close()
+	stdoutw.Close()
+	stderrw.Close()
+	wg.Wait()
+	conns["0"].Close()
+	<-stdinDone
+	return code, err
+}
+
+// execInteractive runs argv in the named container on a new terminal, with
+// its input and output going through the websocket "0" in conns, and
+// resizes and signals for it received on the "control" one.
+func (d *Daemon) execInteractive(name string, req *containerExecReq, opts AttachOptions, conns map[string]*websocket.Conn, signals chan<- os.Signal) (int, error) {
+	ptm, tty, err := pty.Open()
+	if err != nil {
+		return -1, fmt.Errorf("cannot allocate terminal: %v", err)
+	}
+	if req.Width > 0 && req.Height > 0 {
+		err := resizeTerminal(ptm, req.Width, req.Height)
+		if err != nil {
+			ptm.Close()
+			tty.Close()
+			return -1, err
+		}
+	}
+	stopControl := startExecControl(conns["control"], ptm, signals)
+
+	conn := conns["0"]
+	inputDone := make(chan struct{})
+	go func() {
+		err := wsReadStream(ptm, conn)
+		if err != nil {
+			Debugf("exec terminal input interrupted: %v", err)
+		}
+		close(inputDone)
+	}()
+	outputDone := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once the terminal is closed on the
+		// container side, so the error is not interesting.
+		wsWriteStream(conn, ptm)
+		wsCloseStream(conn)
+		close(outputDone)
+	}()
+
+	opts.Stdin = tty
+	opts.Stdout = tty
+	opts.Stderr = tty
+	code, err := d.backend.Attach(name, req.Command, opts)
+
+	// Deliver what's left of the output, and then make sure that nothing
+	// touches the terminal once it's closed.
+	tty.Close()
+	<-outputDone
+	stopControl()
+	conn.Close()
+	ptm.Close()
+	<-inputDone
+	return code, err
+}
+
+// startExecControl runs execControl in the background, and returns a
+// function which stops it and waits for it to return.
+func startExecControl(conn *websocket.Conn, ptm *os.File, signals chan<- os.Signal) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		execControl(conn, ptm, signals)
+		close(done)
+	}()
+	return func() {
+		conn.Close()
+		<-done
+	}
+}
+
+// execControl applies the control messages received from conn to the
+// command being run, until conn is closed. Terminal resizes are applied
+// to ptm, unless it's nil, and signals are sent to signals.
+func execControl(conn *websocket.Conn, ptm *os.File, signals chan<- os.Signal) {
+	for {
+		var msg ExecControl
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				Debugf("exec control interrupted: %v", err)
+			}
+			return
+		}
+		switch msg.Command {
+		case "window-resize":
+			if ptm == nil {
+				continue
+			}
+			err := resizeTerminal(ptm, msg.Width, msg.Height)
+			if err != nil {
+				Debugf("%v", err)
+			}
+		case "signal":
+			if msg.Signal <= 0 {
+				Debugf("ignoring invalid signal %d", msg.Signal)
+				continue
+			}
+			select {
+			case signals <- syscall.Signal(msg.Signal):
+			default:
+				Debugf("dropping signal %d", msg.Signal)
+			}
+		default:
+			Debugf("ignoring unknown exec control command %q", msg.Command)
+		}
+	}
+}
+
+func resizeTerminal(ptm *os.File, width int, height int) error {
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff {
+		return fmt.Errorf("invalid terminal size %dx%d", width, height)
+	}
+	err := pty.Setsize(ptm, &pty.Winsize{Rows: uint16(height), Cols: uint16(width)})
+	if err != nil {
+		return fmt.Errorf("cannot resize terminal: %v", err)
+	}
+	return nil
+}
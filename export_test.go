@@ -0,0 +1,20 @@
+package flex
+
+import (
+	"time"
+)
+
+var (
+	LXCConfigItems = lxcConfigItems
+	CgroupLimits   = cgroupLimits
+	CgroupDefaults = cgroupDefaults
+	WriteResponse  = writeResponse
+)
+
+// SetTrustPasswordDelay changes the delay after an invalid trust password
+// until restore is called.
+func SetTrustPasswordDelay(delay time.Duration) (restore func()) {
+	old := trustPasswordDelay
+	trustPasswordDelay = delay
+	return func() { trustPasswordDelay = old }
+}
@@ -0,0 +1,538 @@
+package flex
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kr/pty"
+)
+
+// fakeBackend is a backend which allows exercising the daemon without root
+// privileges or liblxc. Containers are just entries in a file, which keeps
+// them across daemon restarts. Commands attached to are not really run,
+// but emulated as follows:
+//
+//	echo ARGS...   writes ARGS to stdout
+//	warn ARGS...   writes ARGS to stderr
+//	cat            copies stdin to stdout
+//	env            writes the environment to stdout
+//	pwd            writes the working directory to stdout
+//	exit CODE      exits with CODE
+//	size           writes the terminal size of stdout as "ROWS COLS"
+//	winch          waits for the terminal size to change, then acts as size
+//	wait-signal    waits for a signal, and dies of it
+//	config         writes the configuration applied to the container
+//	devices        writes the names and types of the container devices
+//	read PATH      writes the file at PATH in the root filesystem to stdout
+//	write PATH     writes stdin to the file at PATH in the root filesystem
+//
+// Containers have their root filesystem next to the file, unpacked from
+// their image if they were created from one, or empty otherwise. Their
+// snapshots are copies of it. Checkpoints just dump the container entry.
+//
+// As with LXC, only unix devices and physical network interfaces may be
+// added to and removed from running containers.
+//
+// Any other command writes its arguments to stdout.
+type fakeBackend struct {
+	mu         sync.Mutex
+	path       string
+	containers map[string]*fakeContainer
+}
+
+type fakeContainer struct {
+	State     string            `json:"state"`
+	StartedAt time.Time         `json:"started_at"`
+	Config    map[string]string `json:"config,omitempty"`
+	Devices   map[string]Device `json:"devices,omitempty"`
+}
+
+// newFakeBackend returns a fake backend keeping its containers in a file
+// within dir.
+func newFakeBackend(dir string) (*fakeBackend, error) {
+	b := &fakeBackend{
+		path:       filepath.Join(dir, "fake.json"),
+		containers: make(map[string]*fakeContainer),
+	}
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &b.containers)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", b.path, err)
+	}
+	return b, nil
+}
+
+// save writes the containers to disk. The caller must hold b.mu.
+func (b *fakeBackend) save() error {
+	data, err := json.Marshal(b.containers)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.path, data, 0600)
+}
+
+// container returns the named container. The caller must hold b.mu.
+func (b *fakeBackend) container(name string) (*fakeContainer, error) {
+	c, ok := b.containers[name]
+	if !ok {
+		return nil, ErrNoSuchContainer
+	}
+	return c, nil
+}
+
+// setState moves the named container from one of the states in from into
+// state to, or fails if it's not in any of them.
+func (b *fakeBackend) setState(name string, to string, from ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	for _, state := range from {
+		if c.State == state {
+			c.State = to
+			if to == "RUNNING" {
+				c.StartedAt = time.Now()
+			}
+			return b.save()
+		}
+	}
+	return fmt.Errorf("container is %s", strings.ToLower(c.State))
+}
+
+func (b *fakeBackend) Create(name string, opts CreateOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.containers[name]; ok {
+		return ErrContainerExists
+	}
+	dir := filepath.Join(filepath.Dir(b.path), name)
+	err := os.MkdirAll(filepath.Join(dir, "rootfs"), 0755)
+	if err == nil && opts.Image != "" {
+		err = unpackImage(opts.Image, dir, name)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	b.containers[name] = &fakeContainer{State: "STOPPED"}
+	return b.save()
+}
+
+func (b *fakeBackend) Start(name string) error {
+	return b.setState(name, "RUNNING", "STOPPED")
+}
+
+func (b *fakeBackend) Stop(name string) error {
+	return b.setState(name, "STOPPED", "RUNNING")
+}
+
+func (b *fakeBackend) Reboot(name string) error {
+	return b.setState(name, "RUNNING", "RUNNING")
+}
+
+func (b *fakeBackend) Destroy(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if c.State != "STOPPED" {
+		return fmt.Errorf("container is %s", strings.ToLower(c.State))
+	}
+	delete(b.containers, name)
+	err = os.RemoveAll(filepath.Join(filepath.Dir(b.path), name))
+	if err != nil {
+		return err
+	}
+	return b.save()
+}
+
+func (b *fakeBackend) Configure(name string, config map[string]string, devices map[string]Device) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	c.Config = make(map[string]string)
+	for k, v := range config {
+		c.Config[k] = v
+	}
+	c.Devices = make(map[string]Device)
+	for k, v := range devices {
+		c.Devices[k] = v
+	}
+	return b.save()
+}
+
+func (b *fakeBackend) UpdateLimits(name string, config map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if c.Config == nil {
+		c.Config = make(map[string]string)
+	}
+	for k := range c.Config {
+		if strings.HasPrefix(k, "limits.") {
+			delete(c.Config, k)
+		}
+	}
+	for k, v := range config {
+		if strings.HasPrefix(k, "limits.") {
+			c.Config[k] = v
+		}
+	}
+	return b.save()
+}
+
+// hotplug adds dev to the named container, or removes it if remove is set.
+func (b *fakeBackend) hotplug(name string, devname string, dev Device, remove bool) error {
+	if dev["type"] != "unix-char" && dev["type"] != "unix-block" && dev["nictype"] != "physical" {
+		return ErrHotplugUnsupported
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if remove {
+		delete(c.Devices, devname)
+	} else {
+		if c.Devices == nil {
+			c.Devices = make(map[string]Device)
+		}
+		c.Devices[devname] = dev
+	}
+	return b.save()
+}
+
+func (b *fakeBackend) AddDevice(name string, devname string, dev Device) error {
+	return b.hotplug(name, devname, dev, false)
+}
+
+func (b *fakeBackend) RemoveDevice(name string, devname string, dev Device) error {
+	return b.hotplug(name, devname, dev, true)
+}
+
+func (b *fakeBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.containers))
+	for name := range b.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *fakeBackend) State(name string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return "", err
+	}
+	return c.State, nil
+}
+
+// RuntimeState reports the daemon itself as the init of running
+// containers, as that's where their commands are emulated. Each nic
+// device gets an address of its own.
+func (b *fakeBackend) RuntimeState(name string) (*ContainerState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return nil, err
+	}
+	state := &ContainerState{Status: c.State}
+	if c.State != "RUNNING" {
+		return state, nil
+	}
+	state.InitPID = os.Getpid()
+	state.Addresses = map[string][]string{"lo": {"127.0.0.1", "::1"}}
+	n := 0
+	for _, devname := range sortedDeviceNames(c.Devices) {
+		dev := c.Devices[devname]
+		if dev["type"] != "nic" {
+			continue
+		}
+		iface := dev["name"]
+		if iface == "" {
+			iface = fmt.Sprintf("eth%d", n)
+		}
+		state.Addresses[iface] = []string{fmt.Sprintf("10.0.3.%d", n+2)}
+		n++
+	}
+	state.MemoryUsage = 4 << 20
+	state.CPUTime = time.Since(c.StartedAt) / 100
+	state.Processes = 1
+	state.StartedAt = c.StartedAt
+	return state, nil
+}
+
+func (b *fakeBackend) Attach(name string, argv []string, opts AttachOptions) (int, error) {
+	b.mu.Lock()
+	c, err := b.container(name)
+	if err == nil && c.State != "RUNNING" {
+		err = fmt.Errorf("container is %s", strings.ToLower(c.State))
+	}
+	var config, devices []string
+	if err == nil {
+		for k, v := range c.Config {
+			config = append(config, k+"="+v)
+		}
+		sort.Strings(config)
+		for _, name := range sortedDeviceNames(c.Devices) {
+			devices = append(devices, name+" "+c.Devices[name]["type"])
+		}
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	if len(argv) == 0 {
+		return -1, fmt.Errorf("missing command")
+	}
+	args := strings.Join(argv[1:], " ")
+	switch argv[0] {
+	case "echo":
+		_, err = fmt.Fprintln(opts.Stdout, args)
+	case "warn":
+		_, err = fmt.Fprintln(opts.Stderr, args)
+	case "cat":
+		_, err = io.Copy(opts.Stdout, opts.Stdin)
+	case "env":
+		for _, kv := range opts.Env {
+			_, err = fmt.Fprintln(opts.Stdout, kv)
+			if err != nil {
+				break
+			}
+		}
+	case "read":
+		var data []byte
+		data, err = ioutil.ReadFile(filepath.Join(filepath.Dir(b.path), name, "rootfs", filepath.Clean("/"+args)))
+		if err == nil {
+			_, err = opts.Stdout.Write(data)
+		}
+	case "write":
+		var data []byte
+		data, err = ioutil.ReadAll(opts.Stdin)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(filepath.Dir(b.path), name, "rootfs", filepath.Clean("/"+args)), data, 0644)
+		}
+	case "config", "devices":
+		lines := config
+		if argv[0] == "devices" {
+			lines = devices
+		}
+		for _, line := range lines {
+			_, err = fmt.Fprintln(opts.Stdout, line)
+			if err != nil {
+				break
+			}
+		}
+	case "pwd":
+		cwd := opts.Cwd
+		if cwd == "" {
+			cwd = "/"
+		}
+		_, err = fmt.Fprintln(opts.Stdout, cwd)
+	case "exit":
+		code, err := strconv.Atoi(args)
+		if err != nil {
+			return -1, fmt.Errorf("invalid exit code %q", args)
+		}
+		return code, nil
+	case "size", "winch":
+		rows, cols, err := pty.Getsize(opts.Stdout)
+		if err != nil {
+			return -1, err
+		}
+		for argv[0] == "winch" {
+			time.Sleep(10 * time.Millisecond)
+			r, c, err := pty.Getsize(opts.Stdout)
+			if err != nil {
+				return -1, err
+			}
+			if r != rows || c != cols {
+				rows, cols = r, c
+				break
+			}
+		}
+		_, err = fmt.Fprintf(opts.Stdout, "%d %d\n", rows, cols)
+	case "wait-signal":
+		sig, ok := (<-opts.Signals).(syscall.Signal)
+		if !ok {
+			return -1, fmt.Errorf("unsupported signal")
+		}
+		return 128 + int(sig), nil
+	default:
+		_, err = fmt.Fprintln(opts.Stdout, strings.Join(argv, " "))
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// stopped returns an error unless the named container is stopped.
+func (b *fakeBackend) stopped(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.container(name)
+	if err == nil && c.State != "STOPPED" {
+		err = fmt.Errorf("container is %s", strings.ToLower(c.State))
+	}
+	return err
+}
+
+// snapshotPath returns the path of the named snapshot of a container,
+// which holds its root filesystem.
+func (b *fakeBackend) snapshotPath(name string, snapshot string) string {
+	return filepath.Join(filepath.Dir(b.path), name, "snaps", snapshot)
+}
+
+func (b *fakeBackend) PackRootfs(name string, snapshot string, tw *tar.Writer) error {
+	dir := filepath.Join(filepath.Dir(b.path), name)
+	if snapshot != "" {
+		b.mu.Lock()
+		_, err := b.container(name)
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		dir = b.snapshotPath(name, snapshot)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return ErrNoSuchSnapshot
+		}
+	} else if err := b.stopped(name); err != nil {
+		return err
+	}
+	return packRootfs(tw, filepath.Join(dir, "rootfs"), nil)
+}
+
+// Snapshot names snapshots as LXC does, after the first unused index.
+func (b *fakeBackend) Snapshot(name string) (string, error) {
+	if err := b.stopped(name); err != nil {
+		return "", err
+	}
+	for i := 0; ; i++ {
+		snapshot := fmt.Sprintf("snap%d", i)
+		dir := b.snapshotPath(name, snapshot)
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			continue
+		}
+		err := copyRootfs(filepath.Join(filepath.Dir(b.path), name), dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		return snapshot, nil
+	}
+}
+
+func (b *fakeBackend) RestoreSnapshot(name string, snapshot string) error {
+	if err := b.stopped(name); err != nil {
+		return err
+	}
+	dir := b.snapshotPath(name, snapshot)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return ErrNoSuchSnapshot
+	}
+	rootfs := filepath.Join(filepath.Dir(b.path), name, "rootfs")
+	err := os.RemoveAll(rootfs)
+	if err != nil {
+		return err
+	}
+	return copyRootfs(dir, filepath.Dir(rootfs))
+}
+
+func (b *fakeBackend) DeleteSnapshot(name string, snapshot string) error {
+	b.mu.Lock()
+	_, err := b.container(name)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dir := b.snapshotPath(name, snapshot)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return ErrNoSuchSnapshot
+	}
+	return os.RemoveAll(dir)
+}
+
+// copyRootfs copies the rootfs directory within dir into the directory
+// to, preserving file owners and modes.
+func copyRootfs(dir string, to string) error {
+	err := os.MkdirAll(to, 0755)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("cp", "-a", filepath.Join(dir, "rootfs"), to).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot copy root filesystem: %s", outputErr(output, err))
+	}
+	return nil
+}
+
+// fakeDumpFile is the file within the dump directory written by
+// Checkpoint and required by Restore.
+const fakeDumpFile = "fake.img"
+
+func (b *fakeBackend) Checkpoint(name string, dir string, stop bool, verbose bool) error {
+	b.mu.Lock()
+	c, err := b.container(name)
+	if err == nil && c.State != "RUNNING" {
+		err = fmt.Errorf("container is %s", strings.ToLower(c.State))
+	}
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(c)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, fakeDumpFile), data, 0600)
+	if err != nil {
+		return err
+	}
+	if stop {
+		return b.setState(name, "STOPPED", "RUNNING")
+	}
+	return nil
+}
+
+func (b *fakeBackend) Restore(name string, dir string, verbose bool) error {
+	_, err := os.Stat(filepath.Join(dir, fakeDumpFile))
+	if err != nil {
+		return fmt.Errorf("cannot find container dump: %v", err)
+	}
+	return b.setState(name, "RUNNING", "STOPPED")
+}
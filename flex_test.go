@@ -1,9 +1,33 @@
 package flex_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 
@@ -39,17 +63,31 @@ func (s *FlexSuite) SetUpTest(c *C) {
 
 	os.Mkdir(filepath.Dir(s.confPath), 0700)
 
-	config := flex.Config{
-		ListenAddr: "localhost:43789",
-	}
-	daemon, err := flex.StartDaemon(&config)
-	c.Assert(err, IsNil)
-	client, err := flex.NewClient(&config)
+	s.startDaemon(c)
+	client, _, err := flex.NewClient(&testConfig, "")
 	c.Assert(err, IsNil)
 	s.client = client
+}
+
+var testConfig = flex.Config{
+	ListenAddr: "localhost:43789",
+	Backend:    "fake",
+}
+
+func (s *FlexSuite) startDaemon(c *C) {
+	daemon, err := flex.StartDaemon(&testConfig)
+	c.Assert(err, IsNil)
 	s.daemon = daemon
 }
 
+// restartDaemon stops the daemon and starts it again on the same
+// FLEX_DIR, as happens when it's upgraded.
+func (s *FlexSuite) restartDaemon(c *C) {
+	err := s.daemon.Stop()
+	c.Assert(err, IsNil)
+	s.startDaemon(c)
+}
+
 func (s *FlexSuite) TearDownTest(c *C) {
 	s.daemon.Stop()
 
@@ -57,20 +95,1900 @@ func (s *FlexSuite) TearDownTest(c *C) {
 	os.Setenv("FLEX_DIR", "")
 }
 
+// create creates a container with the provided name and waits until the
+// respective operation succeeds.
+func (s *FlexSuite) create(c *C, name string) {
+	op, err := s.client.Create(name, "ubuntu", "trusty", "amd64")
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+}
+
 func (s *FlexSuite) TestPing(c *C) {
 	// NewClient should have pinged already.
 	c.Assert(c.GetTestLog(), Matches, "(?s).*responding to ping from unix socket.*")
 }
 
-func (s *FlexSuite) TestRemotePing(c *C) {
-	config := flex.Config{
+// remoteConfig returns a configuration with the test daemon as the default
+// remote, with its certificate pinned.
+func (s *FlexSuite) remoteConfig(c *C) *flex.Config {
+	cert, err := flex.RemoteCert("localhost:43789")
+	c.Assert(err, IsNil)
+	return &flex.Config{
 		DefaultRemote: "test",
 		Remotes: map[string]flex.RemoteConfig{
-			"test": {Addr: "localhost:43789"},
+			"test": {Addr: "localhost:43789", CertFingerprint: flex.CertFingerprint(cert)},
 		},
 	}
-	_, err := flex.NewClient(&config)
+}
+
+// trustClient adds the client certificate to the daemon trust store.
+func (s *FlexSuite) trustClient(c *C) {
+	cert, err := flex.ClientCert()
+	c.Assert(err, IsNil)
+	err = s.client.AddCertificate(cert)
+	c.Assert(err, IsNil)
+}
+
+// request sends a request over the unix socket without going through
+// the flex client, and returns the response with its body read into it.
+func (s *FlexSuite) request(c *C, method string, path string, body string) (*http.Response, *flex.Response) {
+	return s.requestHeader(c, method, path, nil, body)
+}
+
+// requestHeader is like request, but sends the provided header as well.
+func (s *FlexSuite) requestHeader(c *C, method string, path string, header http.Header, body string) (*http.Response, *flex.Response) {
+	client := http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", filepath.Join(s.flexDir, "unix.socket"))
+		},
+	}}
+	req, err := http.NewRequest(method, "http://unix.socket"+path, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	var doc flex.Response
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	c.Assert(err, IsNil)
+	return resp, &doc
+}
+
+func (s *FlexSuite) TestRemotePing(c *C) {
+	s.trustClient(c)
+	_, _, err := flex.NewClient(s.remoteConfig(c), "")
 	c.Assert(err, IsNil)
 	// NewClient should have pinged already.
 	c.Assert(c.GetTestLog(), Matches, "(?s).*responding to ping from 127.0.0.1:.*")
 }
+
+func (s *FlexSuite) TestRemoteUntrusted(c *C) {
+	// Untrusted clients may ping the daemon, but do nothing else.
+	client, _, err := flex.NewClient(s.remoteConfig(c), "")
+	c.Assert(err, IsNil)
+	info, err := client.APIInfo()
+	c.Assert(err, IsNil)
+	c.Assert(info.Auth, Equals, "untrusted")
+	_, err = client.List()
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusForbidden)
+	_, err = client.Certificates()
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+	cert, err := flex.ClientCert()
+	c.Assert(err, IsNil)
+	err = client.AddCertificate(cert)
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+}
+
+func (s *FlexSuite) TestRemoteTrustedCertNotLeaf(c *C) {
+	s.trustClient(c)
+	trusted, err := flex.ClientCert()
+	c.Assert(err, IsNil)
+
+	// Present an untrusted leaf followed by the trusted certificate,
+	// whose key the client doesn't hold.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "intruder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{leaf, trusted.Raw},
+				PrivateKey:  key,
+			}},
+			InsecureSkipVerify: true,
+		},
+	}}
+	resp, err := client.Get("https://localhost:43789/1.0/containers")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *FlexSuite) TestRemoteCertMismatch(c *C) {
+	s.trustClient(c)
+	config := s.remoteConfig(c)
+	rc := config.Remotes["test"]
+	rc.CertFingerprint = strings.Repeat("0", 64)
+	config.Remotes["test"] = rc
+	_, _, err := flex.NewClient(config, "")
+	c.Assert(err, ErrorMatches, ".*daemon certificate fingerprint [0-9a-f]+ does not match the expected 0+")
+
+	config.Remotes["test"] = flex.RemoteConfig{Addr: "localhost:43789"}
+	_, _, err = flex.NewClient(config, "")
+	c.Assert(err, ErrorMatches, `remote "test" has no known certificate; .*`)
+}
+
+func (s *FlexSuite) TestTrustPassword(c *C) {
+	defer flex.SetTrustPasswordDelay(0)()
+	client, _, err := flex.NewClient(s.remoteConfig(c), "")
+	c.Assert(err, IsNil)
+
+	// No password set yet.
+	err = client.RequestTrust("")
+	c.Assert(err, ErrorMatches, "invalid trust password")
+
+	err = client.SetTrustPassword("sekrit")
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+	err = s.client.SetTrustPassword("sekrit")
+	c.Assert(err, IsNil)
+
+	err = client.RequestTrust("wrong")
+	c.Assert(err, ErrorMatches, "invalid trust password")
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusForbidden)
+
+	err = client.RequestTrust("sekrit")
+	c.Assert(err, IsNil)
+	info, err := client.APIInfo()
+	c.Assert(err, IsNil)
+	c.Assert(info.Auth, Equals, "trusted")
+	_, err = client.List()
+	c.Assert(err, IsNil)
+
+	// The password may only be used once.
+	err = client.RequestTrust("sekrit")
+	c.Assert(err, ErrorMatches, "invalid trust password")
+}
+
+func (s *FlexSuite) TestTrustPasswordDelay(c *C) {
+	defer flex.SetTrustPasswordDelay(200 * time.Millisecond)()
+	client, _, err := flex.NewClient(s.remoteConfig(c), "")
+	c.Assert(err, IsNil)
+	err = s.client.SetTrustPassword("sekrit")
+	c.Assert(err, IsNil)
+
+	// Even the right password is refused for a while after a wrong one.
+	err = client.RequestTrust("wrong")
+	c.Assert(err, ErrorMatches, "invalid trust password")
+	err = client.RequestTrust("sekrit")
+	c.Assert(err, ErrorMatches, `too many invalid trust passwords; try again in 1s`)
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusTooManyRequests)
+
+	// And for twice as long after another wrong one.
+	time.Sleep(300 * time.Millisecond)
+	err = client.RequestTrust("wrong")
+	c.Assert(err, ErrorMatches, "invalid trust password")
+	time.Sleep(300 * time.Millisecond)
+	err = client.RequestTrust("sekrit")
+	c.Assert(err, ErrorMatches, `too many invalid trust passwords; .*`)
+
+	time.Sleep(200 * time.Millisecond)
+	err = client.RequestTrust("sekrit")
+	c.Assert(err, IsNil)
+}
+
+func (s *FlexSuite) TestCertificates(c *C) {
+	s.trustClient(c)
+	cert, err := flex.ClientCert()
+	c.Assert(err, IsNil)
+	fingerprint := flex.CertFingerprint(cert)
+
+	certs, err := s.client.Certificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 1)
+	c.Assert(certs[0].Fingerprint, Equals, fingerprint)
+
+	err = s.client.RemoveCertificate(fingerprint)
+	c.Assert(err, IsNil)
+	certs, err = s.client.Certificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 0)
+
+	client, _, err := flex.NewClient(s.remoteConfig(c), "")
+	c.Assert(err, IsNil)
+	_, err = client.List()
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+}
+
+func (s *FlexSuite) TestErrorResponse(c *C) {
+	_, err := s.client.Create("", "ubuntu", "trusty", "amd64")
+	c.Assert(err, ErrorMatches, "missing container name")
+	flexErr, ok := err.(*flex.Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(flexErr.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *FlexSuite) TestInvalidContainerName(c *C) {
+	for _, name := range []string{"../x", "..", ".", "a/b", "-a", "a_b", strings.Repeat("a", 64)} {
+		body, err := json.Marshal(map[string]string{"name": name, "distro": "ubuntu", "release": "trusty", "arch": "amd64"})
+		c.Assert(err, IsNil)
+		resp, doc := s.request(c, "POST", "/1.0/containers", string(body))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+		c.Assert(doc.Error, Equals, fmt.Sprintf("invalid container name %q", name))
+	}
+	resp, _ := s.request(c, "GET", "/create?name=../x&distro=ubuntu&release=trusty&arch=amd64", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	resp, _ = s.request(c, "GET", "/receiveContainer?name=../x", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	resp, _ = s.request(c, "GET", "/sendContainer?name=../x&remote=otherhost", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *FlexSuite) TestLifecycle(c *C) {
+	s.create(c, "c1")
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Name, Equals, "c1")
+	c.Assert(list[0].State, Equals, "STOPPED")
+	c.Assert(list[0].Source, Equals, "ubuntu/trusty/amd64")
+	c.Assert(list[0].CreatedAt.IsZero(), Equals, false)
+	c.Assert(list[0].LastUsedAt.IsZero(), Equals, true)
+
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "RUNNING")
+
+	err = s.client.Reboot("c1")
+	c.Assert(err, IsNil)
+	err = s.client.Stop("c1")
+	c.Assert(err, IsNil)
+	err = s.client.Destroy("c1")
+	c.Assert(err, IsNil)
+	list, err = s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *FlexSuite) TestContainerState(c *C) {
+	s.create(c, "c1")
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state, DeepEquals, &flex.ContainerState{Status: "STOPPED"})
+
+	eth0 := flex.Device{"type": "nic", "nictype": "bridged", "parent": "flexbr0"}
+	err = s.client.SetDevices("c1", map[string]flex.Device{"eth0": eth0})
+	c.Assert(err, IsNil)
+	before := time.Now()
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+	state, err = s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "RUNNING")
+	c.Assert(state.InitPID, Equals, os.Getpid())
+	c.Assert(state.Addresses, DeepEquals, map[string][]string{
+		"lo":   {"127.0.0.1", "::1"},
+		"eth0": {"10.0.3.2"},
+	})
+	c.Assert(state.MemoryUsage > 0, Equals, true)
+	c.Assert(state.Processes, Equals, 1)
+	c.Assert(state.StartedAt.Before(before), Equals, false)
+	c.Assert(state.StartedAt.After(time.Now()), Equals, false)
+
+	_, err = s.client.Status("c2")
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+}
+
+func (s *FlexSuite) TestListFilters(c *C) {
+	s.create(c, "c1")
+	s.create(c, "c2")
+	s.create(c, "c3")
+	err := s.client.SetConfig("c1", map[string]string{"user.team": "infra"})
+	c.Assert(err, IsNil)
+	err = s.client.SetConfig("c2", map[string]string{"user.team": "infra"})
+	c.Assert(err, IsNil)
+	err = s.client.Start("c2")
+	c.Assert(err, IsNil)
+	err = s.client.Start("c3")
+	c.Assert(err, IsNil)
+
+	names := func(filters ...string) []string {
+		list, err := s.client.List(filters...)
+		c.Assert(err, IsNil)
+		names := []string{}
+		for _, ct := range list {
+			names = append(names, ct.Name)
+		}
+		return names
+	}
+	c.Assert(names(), DeepEquals, []string{"c1", "c2", "c3"})
+	c.Assert(names("state=RUNNING"), DeepEquals, []string{"c2", "c3"})
+	c.Assert(names("state=running", "user.team=infra"), DeepEquals, []string{"c2"})
+	c.Assert(names("user.team="), DeepEquals, []string{"c3"})
+	c.Assert(names("name=c1"), DeepEquals, []string{"c1"})
+	c.Assert(names("profile=default", "state=STOPPED"), DeepEquals, []string{"c1"})
+
+	list, err := s.client.List("name=c2")
+	c.Assert(err, IsNil)
+	c.Assert(list[0].Runtime, NotNil)
+	c.Assert(list[0].Runtime.InitPID, Equals, os.Getpid())
+
+	_, err = s.client.List("team")
+	c.Assert(err, ErrorMatches, `filter must be in the key=value form: "team"`)
+	_, err = s.client.List("team=infra")
+	c.Assert(err, ErrorMatches, `unknown filter key "team"`)
+}
+
+func (s *FlexSuite) TestCreateExisting(c *C) {
+	s.create(c, "c1")
+	_, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	c.Assert(err, ErrorMatches, `container "c1" already exists`)
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusConflict)
+}
+
+func (s *FlexSuite) TestDatabasePersists(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	before := list[0]
+	c.Assert(before.LastUsedAt.IsZero(), Equals, false)
+
+	s.restartDaemon(c)
+
+	list, err = s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Name, Equals, "c1")
+	c.Assert(list[0].State, Equals, "RUNNING")
+	c.Assert(list[0].Source, Equals, before.Source)
+	c.Assert(list[0].CreatedAt.Equal(before.CreatedAt), Equals, true)
+	c.Assert(list[0].LastUsedAt.Equal(before.LastUsedAt), Equals, true)
+}
+
+func (s *FlexSuite) TestDatabaseSync(c *C) {
+	s.create(c, "c1")
+	s.create(c, "c2")
+	err := s.daemon.Stop()
+	c.Assert(err, IsNil)
+
+	// Change the containers behind the daemon's back.
+	fake := filepath.Join(s.flexDir, "lxc", "fake.json")
+	err = ioutil.WriteFile(fake, []byte(`{"c2": {"state": "STOPPED"}, "c3": {"state": "RUNNING"}}`), 0600)
+	c.Assert(err, IsNil)
+
+	s.startDaemon(c)
+	list, err := s.client.List()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].Name, Equals, "c2")
+	c.Assert(list[0].Source, Equals, "ubuntu/trusty/amd64")
+	c.Assert(list[1].Name, Equals, "c3")
+	c.Assert(list[1].State, Equals, "RUNNING")
+	c.Assert(list[1].Source, Equals, "")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*adding unknown container "c3" to the database.*`)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*removing missing container "c1" from the database.*`)
+}
+
+func (s *FlexSuite) TestContainerConfig(c *C) {
+	s.create(c, "c1")
+	config := map[string]string{
+		"limits.memory":    "512MB",
+		"environment.FOO":  "bar",
+		"user.description": "a container",
+	}
+	err := s.client.SetConfig("c1", config)
+	c.Assert(err, IsNil)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config, DeepEquals, config)
+
+	// The configuration is applied on start.
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+	var stdout bytes.Buffer
+	_, err = s.client.Exec("c1", []string{"config"}, flex.ExecOptions{Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "environment.FOO=bar\nlimits.memory=512MB\nuser.description=a container\n")
+
+	stdout.Reset()
+	_, err = s.client.Exec("c1", []string{"env"}, flex.ExecOptions{Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Matches, "(?s)FOO=bar\n.*")
+
+	// Changes wait for the next start, except for limits.
+	err = s.client.SetConfig("c1", map[string]string{"limits.processes": "100"})
+	c.Assert(err, IsNil)
+	stdout.Reset()
+	_, err = s.client.Exec("c1", []string{"config"}, flex.ExecOptions{Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "environment.FOO=bar\nlimits.processes=100\nuser.description=a container\n")
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config, DeepEquals, map[string]string{"limits.processes": "100"})
+}
+
+func (s *FlexSuite) TestContainerLimits(c *C) {
+	s.create(c, "c1")
+	limits := map[string]string{
+		"limits.cpu":           "0-1",
+		"limits.cpu.allowance": "50%",
+		"limits.memory":        "1GiB",
+		"limits.memory.swap":   "false",
+		"limits.processes":     "500",
+		"limits.disk.priority": "10",
+	}
+	err := s.client.UpdateProfile("default", limits, nil)
+	c.Assert(err, IsNil)
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	config := func() string {
+		var stdout bytes.Buffer
+		_, err := s.client.Exec("c1", []string{"config"}, flex.ExecOptions{Stdout: &stdout})
+		c.Assert(err, IsNil)
+		return stdout.String()
+	}
+	c.Assert(config(), Equals, "limits.cpu.allowance=50%\nlimits.cpu=0-1\nlimits.disk.priority=10\n"+
+		"limits.memory.swap=false\nlimits.memory=1GiB\nlimits.processes=500\n")
+
+	// Limits of running containers change right away, including those
+	// coming from profiles.
+	err = s.client.SetConfig("c1", map[string]string{"limits.cpu.allowance": "25ms/100ms"})
+	c.Assert(err, IsNil)
+	c.Assert(config(), Equals, "limits.cpu.allowance=25ms/100ms\nlimits.cpu=0-1\nlimits.disk.priority=10\n"+
+		"limits.memory.swap=false\nlimits.memory=1GiB\nlimits.processes=500\n")
+	err = s.client.UpdateProfile("default", map[string]string{"limits.memory": "2GB"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(config(), Equals, "limits.cpu.allowance=25ms/100ms\nlimits.memory=2GB\n")
+}
+
+func (s *FlexSuite) TestContainerConfigInvalid(c *C) {
+	s.create(c, "c1")
+	tests := []struct {
+		key, value, err string
+	}{
+		{"limits.memry", "1GB", `unknown configuration key "limits.memry"`},
+		{"limits.memory", "lots", `invalid value for limits.memory: "lots" is not a size`},
+		{"limits.memory", "1XB", `invalid value for limits.memory: unknown size unit "XB"`},
+		{"limits.cpu", "0", `invalid value for limits.cpu: number of CPUs must be positive`},
+		{"limits.cpu", "1-", `invalid value for limits.cpu: "1-" is neither a number of CPUs nor a CPU set`},
+		{"limits.cpu.allowance", "0%", `invalid value for limits.cpu.allowance: "0%" is not a percentage between 1% and 100%`},
+		{"limits.cpu.allowance", "25ms", `invalid value for limits.cpu.allowance: "25ms" is neither a percentage nor a time such as 25ms/100ms`},
+		{"limits.cpu.allowance", "25ms/2000ms", `invalid value for limits.cpu.allowance: CPU time in "25ms/2000ms" out of range`},
+		{"limits.memory.swap", "maybe", `invalid value for limits.memory.swap: "maybe" is not a boolean`},
+		{"limits.processes", "0", `invalid value for limits.processes: "0" is not a positive integer`},
+		{"limits.disk.priority", "11", `invalid value for limits.disk.priority: "11" is not a priority between 0 and 10`},
+		{"security.nesting", "maybe", `invalid value for security.nesting: "maybe" is not a boolean`},
+		{"boot.autostart.delay", "-1", `invalid value for boot.autostart.delay: "-1" is not a non-negative integer`},
+		{"environment.", "x", `unknown configuration key "environment."`},
+		{"environment.A=B", "x", `invalid environment variable name "A=B"`},
+		{"environment.A", "x\nlxc.hook.pre-start = /bin/sh", `invalid value for environment.A: "x\nlxc.hook.pre-start = /bin/sh" has control characters`},
+		{"environment.A\nlxc.hook.pre-start", "x", `invalid configuration key "environment.A\nlxc.hook.pre-start"`},
+		{"user.note", "a\x00b", `invalid value for user.note: "a\x00b" has control characters`},
+	}
+	for _, test := range tests {
+		err := s.client.SetConfig("c1", map[string]string{test.key: test.value})
+		c.Assert(err, ErrorMatches, regexp.QuoteMeta(test.err))
+		c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusBadRequest)
+	}
+	for _, value := range []string{"2", "0-3,6", "2-2"} {
+		err := s.client.SetConfig("c1", map[string]string{"limits.cpu": value})
+		c.Assert(err, IsNil)
+	}
+
+	err := s.client.SetConfig("c2", nil)
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+}
+
+func (s *FlexSuite) TestProfiles(c *C) {
+	profiles, err := s.client.Profiles()
+	c.Assert(err, IsNil)
+	c.Assert(profiles, DeepEquals, []flex.ProfileInfo{{Name: "default", Config: map[string]string{}, Devices: map[string]flex.Device{}}})
+
+	err = s.client.CreateProfile("p1", map[string]string{"limits.memory": "1GB", "environment.FOO": "p1"}, nil)
+	c.Assert(err, IsNil)
+	err = s.client.CreateProfile("p1", nil, nil)
+	c.Assert(err, ErrorMatches, `profile "p1" already exists`)
+	err = s.client.CreateProfile("p2", map[string]string{"limits.memory": "lots"}, nil)
+	c.Assert(err, ErrorMatches, `invalid value for limits.memory: .*`)
+	err = s.client.UpdateProfile("default", map[string]string{"environment.FOO": "default", "limits.cpu": "2"}, nil)
+	c.Assert(err, IsNil)
+
+	s.create(c, "c1")
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"default"})
+	c.Assert(info.ExpandedConfig, DeepEquals, map[string]string{"environment.FOO": "default", "limits.cpu": "2"})
+
+	// Later profiles take precedence, and local keys over all of them.
+	err = s.client.ApplyProfiles("c1", []string{"default", "p1"})
+	c.Assert(err, IsNil)
+	err = s.client.SetConfig("c1", map[string]string{"limits.memory": "2GB"})
+	c.Assert(err, IsNil)
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"default", "p1"})
+	c.Assert(info.Config, DeepEquals, map[string]string{"limits.memory": "2GB"})
+	c.Assert(info.ExpandedConfig, DeepEquals, map[string]string{"environment.FOO": "p1", "limits.cpu": "2", "limits.memory": "2GB"})
+
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+	var stdout bytes.Buffer
+	_, err = s.client.Exec("c1", []string{"config"}, flex.ExecOptions{Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "environment.FOO=p1\nlimits.cpu=2\nlimits.memory=2GB\n")
+
+	err = s.client.ApplyProfiles("c1", []string{"p2"})
+	c.Assert(err, ErrorMatches, `profile "p2" not found`)
+	err = s.client.DeleteProfile("p1")
+	c.Assert(err, ErrorMatches, `profile "p1" is used by containers`)
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusConflict)
+	err = s.client.DeleteProfile("default")
+	c.Assert(err, ErrorMatches, `the default profile cannot be deleted`)
+
+	err = s.client.ApplyProfiles("c1", nil)
+	c.Assert(err, IsNil)
+	err = s.client.DeleteProfile("p1")
+	c.Assert(err, IsNil)
+	_, err = s.client.Profile("p1")
+	c.Assert(err, ErrorMatches, `profile "p1" not found`)
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, HasLen, 0)
+	c.Assert(info.ExpandedConfig, DeepEquals, map[string]string{"limits.memory": "2GB"})
+}
+
+func (s *FlexSuite) TestDevices(c *C) {
+	s.create(c, "c1")
+	invalid := []struct {
+		devices map[string]flex.Device
+		err     string
+	}{
+		{map[string]flex.Device{"d": {}}, `missing type of device "d"`},
+		{map[string]flex.Device{"d": {"type": "tape"}}, `unknown type of device "d": "tape"`},
+		{map[string]flex.Device{"d": {"type": "disk", "path": "/mnt"}}, `missing source of device "d"`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "srv", "path": "/mnt"}}, `invalid source of device "d": "srv" is not an absolute path`},
+		{map[string]flex.Device{"d": {"type": "nic", "nictype": "tunnel", "parent": "br0"}}, `invalid nictype of device "d": unknown nic type "tunnel"`},
+		{map[string]flex.Device{"d": {"type": "nic", "nictype": "bridged", "parent": "br0", "hwaddr": "00:16"}}, `invalid hwaddr of device "d": "00:16" is not a MAC address`},
+		{map[string]flex.Device{"d": {"type": "unix-char", "path": "/dev/null", "mtu": "1500"}}, `unknown property of unix-char device "d": "mtu"`},
+		{map[string]flex.Device{"d": {"type": "nic", "nictype": "bridged", "parent": "br0\nlxc.hook.pre-start = /bin/sh"}}, `invalid parent of device "d": "br0\nlxc.hook.pre-start = /bin/sh" is not a network interface name`},
+		{map[string]flex.Device{"d": {"type": "nic", "nictype": "bridged", "parent": "br0", "name": "eth0 = x"}}, `invalid name of device "d": "eth0 = x" is not a network interface name`},
+		{map[string]flex.Device{"d": {"type": "nic", "nictype": "physical", "parent": "averyverylongname"}}, `invalid parent of device "d": "averyverylongname" is not a network interface name`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv", "path": "/mnt\nlxc.hook.pre-start = /bin/sh"}}, `invalid path of device "d": "/mnt\nlxc.hook.pre-start = /bin/sh" has spaces or control characters`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv", "path": "/mnt/a b"}}, `invalid path of device "d": "/mnt/a b" has spaces or control characters`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv", "path": "/../../etc"}}, `invalid path of device "d": "/../../etc" is not a clean path`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv", "path": "/mnt/../../etc"}}, `invalid path of device "d": "/mnt/../../etc" is not a clean path`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv", "path": "/mnt/"}}, `invalid path of device "d": "/mnt/" is not a clean path`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv", "path": "/"}}, `invalid path of device "d": "/" is the root directory`},
+		{map[string]flex.Device{"d": {"type": "disk", "source": "/srv/a\tb", "path": "/mnt"}}, `invalid source of device "d": "/srv/a\tb" has spaces or control characters`},
+	}
+	for _, test := range invalid {
+		err := s.client.SetDevices("c1", test.devices)
+		c.Assert(err, ErrorMatches, regexp.QuoteMeta(test.err))
+		c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusBadRequest)
+	}
+
+	eth0 := flex.Device{"type": "nic", "nictype": "bridged", "parent": "flexbr0"}
+	err := s.client.UpdateProfile("default", nil, map[string]flex.Device{"eth0": eth0})
+	c.Assert(err, IsNil)
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	devices := func() string {
+		var stdout bytes.Buffer
+		_, err := s.client.Exec("c1", []string{"devices"}, flex.ExecOptions{Stdout: &stdout})
+		c.Assert(err, IsNil)
+		return stdout.String()
+	}
+	c.Assert(devices(), Equals, "eth0 nic\n")
+
+	// Unix devices are added right away, while disks wait for a restart.
+	null := flex.Device{"type": "unix-char", "path": "/dev/null"}
+	data := flex.Device{"type": "disk", "source": "/srv/data", "path": "/data", "readonly": "true"}
+	err = s.client.SetDevices("c1", map[string]flex.Device{"null": null, "data": data})
+	c.Assert(err, IsNil)
+	c.Assert(devices(), Equals, "eth0 nic\nnull unix-char\n")
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Devices, DeepEquals, map[string]flex.Device{"null": null, "data": data})
+	c.Assert(info.ExpandedDevices, DeepEquals, map[string]flex.Device{"eth0": eth0, "null": null, "data": data})
+
+	err = s.client.Reboot("c1")
+	c.Assert(err, IsNil)
+	c.Assert(devices(), Equals, "data disk\neth0 nic\nnull unix-char\n")
+
+	// Local devices take the place of profile ones with the same name.
+	err = s.client.SetDevices("c1", map[string]flex.Device{"eth0": null})
+	c.Assert(err, IsNil)
+	c.Assert(devices(), Equals, "data disk\neth0 unix-char\n")
+}
+
+// makeImage returns an image tarball with the provided metadata.yaml, a
+// tiny root filesystem, and the extra files in name and content pairs.
+// makeImage returns an image tarball holding metadata, a minimal root
+// filesystem, and the extra files given as name and content pairs. Names
+// ending in "/" are directories, and contents starting with "-> " make
+// symlinks to the rest of the content.
+func makeImage(c *C, metadata string, extra ...string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name, content string
+	}{
+		{"metadata.yaml", metadata},
+		{"rootfs/", ""},
+		{"rootfs/etc/", ""},
+		{"rootfs/etc/hostname", "image\n"},
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		files = append(files, struct{ name, content string }{extra[i], extra[i+1]})
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), ModTime: time.Unix(1400000000, 0)}
+		if strings.HasSuffix(f.name, "/") {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if strings.HasPrefix(f.content, "-> ") {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, f.content[3:], 0
+			f.content = ""
+		}
+		c.Assert(tw.WriteHeader(hdr), IsNil)
+		_, err := tw.Write([]byte(f.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(gz.Close(), IsNil)
+	return buf.Bytes()
+}
+
+const testImageMetadata = `
+architecture: x86_64
+creation_date: 1400000000
+properties:
+  os: ubuntu
+  release: trusty
+  description: Ubuntu 14.04 LTS
+`
+
+func (s *FlexSuite) TestImages(c *C) {
+	data := makeImage(c, testImageMetadata)
+	sum := sha256.Sum256(data)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	image, err := s.client.ImportImage(bytes.NewReader(data), "")
+	c.Assert(err, IsNil)
+	c.Assert(image.Fingerprint, Equals, fingerprint)
+	c.Assert(image.Size, Equals, int64(len(data)))
+	c.Assert(image.Architecture, Equals, "x86_64")
+	c.Assert(image.CreatedAt.Equal(time.Unix(1400000000, 0)), Equals, true)
+	c.Assert(image.Properties, DeepEquals, map[string]string{"os": "ubuntu", "release": "trusty", "description": "Ubuntu 14.04 LTS"})
+	_, err = os.Stat(filepath.Join(s.flexDir, "images", fingerprint))
+	c.Assert(err, IsNil)
+
+	_, err = s.client.ImportImage(bytes.NewReader(data), "")
+	c.Assert(err, ErrorMatches, `image "`+fingerprint+`" already exists`)
+	_, err = s.client.ImportImage(strings.NewReader("not a tarball"), "")
+	c.Assert(err, ErrorMatches, `invalid image: cannot read metadata.yaml: .*`)
+	_, err = s.client.ImportImage(bytes.NewReader(makeImage(c, "properties: {}")), "")
+	c.Assert(err, ErrorMatches, `invalid image: metadata.yaml has no architecture`)
+
+	err = s.client.CreateImageAlias("ubuntu/trusty", fingerprint[:8], "the LTS")
+	c.Assert(err, IsNil)
+	err = s.client.CreateImageAlias("ubuntu/trusty", fingerprint, "")
+	c.Assert(err, ErrorMatches, `image alias "ubuntu/trusty" already exists`)
+	err = s.client.CreateImageAlias("other", "abc", "")
+	c.Assert(err, ErrorMatches, `image "abc" not found`)
+	aliases, err := s.client.ImageAliases()
+	c.Assert(err, IsNil)
+	c.Assert(aliases, DeepEquals, []flex.ImageAlias{{Name: "ubuntu/trusty", Description: "the LTS", Target: fingerprint}})
+
+	images, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 1)
+	c.Assert(images[0].Aliases, DeepEquals, []string{"ubuntu/trusty"})
+	image, err = s.client.Image(fingerprint[:12])
+	c.Assert(err, IsNil)
+	c.Assert(image.Fingerprint, Equals, fingerprint)
+
+	// Containers are created from aliases or fingerprints.
+	for i, ref := range []string{"ubuntu/trusty", fingerprint[:12]} {
+		name := fmt.Sprintf("c%d", i)
+		op, err := s.client.CreateFromImage(name, ref, nil, nil)
+		c.Assert(err, IsNil)
+		op, err = s.client.WaitForOperation(op.ID, -1)
+		c.Assert(err, IsNil)
+		c.Assert(op.Status, Equals, flex.OperationSuccess)
+		info, err := s.client.Container(name)
+		c.Assert(err, IsNil)
+		c.Assert(info.Source, Equals, fingerprint)
+	}
+	_, err = s.client.CreateFromImage("c2", "ubuntu/precise", nil, nil)
+	c.Assert(err, ErrorMatches, `image "ubuntu/precise" not found`)
+
+	err = s.client.DeleteImageAlias("ubuntu/trusty")
+	c.Assert(err, IsNil)
+	err = s.client.DeleteImageAlias("ubuntu/trusty")
+	c.Assert(err, ErrorMatches, `image alias "ubuntu/trusty" not found`)
+	err = s.client.DeleteImage(fingerprint[:12])
+	c.Assert(err, IsNil)
+	_, err = s.client.Image(fingerprint)
+	c.Assert(err, ErrorMatches, `image "`+fingerprint+`" not found`)
+	_, err = os.Stat(filepath.Join(s.flexDir, "images", fingerprint))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FlexSuite) TestCreateFromImageOptions(c *C) {
+	image, err := s.client.ImportImage(bytes.NewReader(makeImage(c, testImageMetadata)), "")
+	c.Assert(err, IsNil)
+	err = s.client.CreateProfile("p1", map[string]string{"user.a": "1"}, nil)
+	c.Assert(err, IsNil)
+
+	op, err := s.client.CreateFromImage("c1", image.Fingerprint[:8], []string{"default", "p1"}, map[string]string{"user.b": "2"})
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Profiles, DeepEquals, []string{"default", "p1"})
+	c.Assert(info.Config, DeepEquals, map[string]string{"user.b": "2"})
+	c.Assert(info.ExpandedConfig["user.a"], Equals, "1")
+
+	_, err = s.client.CreateFromImage("c2", image.Fingerprint, nil, map[string]string{"limits.memory": "lots"})
+	c.Assert(err, ErrorMatches, `invalid value for limits.memory: .*`)
+	_, err = s.client.CreateFromImage("c2", image.Fingerprint, []string{"missing"}, nil)
+	c.Assert(err, ErrorMatches, `.*"missing".*`)
+	_, err = s.client.Container("c2")
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+}
+
+// makeImageServer writes into dir the streams of an image server
+// publishing the image tarball in data as ubuntu/trusty/amd64, claiming
+// it has the provided sha256 sum.
+func makeImageServer(c *C, dir string, data []byte, sum string) {
+	path := "images/ubuntu/trusty/amd64/20150601/flex.tar.gz"
+	files := map[string]string{
+		"streams/v1/index.json": `{
+			"format": "index:1.0",
+			"index": {
+				"images": {
+					"datatype": "image-downloads",
+					"format": "products:1.0",
+					"path": "streams/v1/images.json",
+					"products": ["ubuntu:trusty:amd64"]
+				}
+			}
+		}`,
+		"streams/v1/images.json": fmt.Sprintf(`{
+			"format": "products:1.0",
+			"products": {
+				"ubuntu:trusty:amd64": {
+					"aliases": "ubuntu/trusty/amd64, ubuntu/trusty",
+					"versions": {
+						"20150101": {"items": {"flex.tar.gz": {"ftype": "flex.tar.gz", "path": "images/old.tar.gz", "sha256": "%s", "size": 1}}},
+						"20150601": {"items": {
+							"root.tar.xz": {"ftype": "root.tar.xz", "path": "images/root.tar.xz"},
+							"flex.tar.gz": {"ftype": "flex.tar.gz", "path": %q, "sha256": %q, "size": %d}
+						}}
+					}
+				}
+			}
+		}`, strings.Repeat("0", 64), path, sum, len(data)),
+		path: string(data),
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		c.Assert(os.MkdirAll(filepath.Dir(name), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(name, []byte(content), 0644), IsNil)
+	}
+}
+
+func (s *FlexSuite) TestImageServers(c *C) {
+	data := makeImage(c, testImageMetadata)
+	sum := sha256.Sum256(data)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	fileDir := c.MkDir()
+	makeImageServer(c, fileDir, data, fingerprint)
+	httpDir := c.MkDir()
+	makeImageServer(c, httpDir, data, strings.Repeat("1", 64))
+	server := httptest.NewServer(http.FileServer(http.Dir(httpDir)))
+	defer server.Close()
+
+	err := s.daemon.Stop()
+	c.Assert(err, IsNil)
+	config := testConfig
+	config.ImageServers = map[string]string{
+		"images": "file://" + fileDir,
+		"broken": server.URL,
+	}
+	s.daemon, err = flex.StartDaemon(&config)
+	c.Assert(err, IsNil)
+
+	create := func(name string, image string) (*flex.Operation, error) {
+		op, err := s.client.CreateFromImage(name, image, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return s.client.WaitForOperation(op.ID, -1)
+	}
+
+	op, err := create("c1", "images:ubuntu/trusty")
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Source, Equals, fingerprint)
+	image, err := s.client.Image(fingerprint)
+	c.Assert(err, IsNil)
+	c.Assert(image.Properties["release"], Equals, "trusty")
+
+	// Later creates use the image in the store.
+	c.Assert(os.RemoveAll(filepath.Join(fileDir, "images")), IsNil)
+	op, err = create("c2", "images:ubuntu/trusty/amd64")
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+
+	_, err = create("c3", "images:ubuntu/precise")
+	c.Assert(err, ErrorMatches, `image "images:ubuntu/precise" not found`)
+	_, err = create("c3", "other:ubuntu/trusty")
+	c.Assert(err, ErrorMatches, `unknown image server in "other:ubuntu/trusty"`)
+
+	// Downloads are verified.
+	op, err = create("c3", "broken:ubuntu/trusty")
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationFailure)
+	c.Assert(op.Error, Matches, `cannot create container "c3": cannot download image "broken:ubuntu/trusty": fingerprint mismatch: .*`)
+	_, err = s.client.Container("c3")
+	c.Assert(err, ErrorMatches, `container "c3" not found`)
+	images, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 1)
+}
+
+func (s *FlexSuite) TestImageDownloadCancel(c *C) {
+	data := makeImage(c, testImageMetadata)
+	sum := sha256.Sum256(data)
+	dir := c.MkDir()
+	makeImageServer(c, dir, data, hex.EncodeToString(sum[:]))
+
+	// The server stalls after sending part of the image.
+	started := make(chan bool, 1)
+	stalled := make(chan bool)
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/images/") {
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Write(data[:10])
+		w.(http.Flusher).Flush()
+		started <- true
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	otherData := makeImage(c, testImageMetadata, "rootfs/etc/issue", "other")
+	sum = sha256.Sum256(otherData)
+	otherDir := c.MkDir()
+	makeImageServer(c, otherDir, otherData, hex.EncodeToString(sum[:]))
+	otherServer := httptest.NewServer(http.FileServer(http.Dir(otherDir)))
+	defer otherServer.Close()
+
+	err := s.daemon.Stop()
+	c.Assert(err, IsNil)
+	config := testConfig
+	config.ImageServers = map[string]string{"stalled": server.URL, "other": otherServer.URL}
+	s.daemon, err = flex.StartDaemon(&config)
+	c.Assert(err, IsNil)
+
+	op, err := s.client.CreateFromImage("c1", "stalled:ubuntu/trusty", nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(op.MayCancel, Equals, true)
+	<-started
+
+	// Other images are downloaded meanwhile.
+	other, err := s.client.CreateFromImage("c2", "other:ubuntu/trusty", nil, nil)
+	c.Assert(err, IsNil)
+	other, err = s.client.WaitForOperation(other.ID, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(other.Status, Equals, flex.OperationSuccess, Commentf("%s", other.Error))
+
+	// While creating containers from the same image waits for the download
+	// in progress, and may be cancelled meanwhile.
+	waiting, err := s.client.CreateFromImage("c3", "stalled:ubuntu/trusty", nil, nil)
+	c.Assert(err, IsNil)
+	err = s.client.CancelOperation(waiting.ID)
+	c.Assert(err, IsNil)
+	waiting, err = s.client.WaitForOperation(waiting.ID, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(waiting.Status, Equals, flex.OperationCancelled)
+
+	err = s.client.CancelOperation(op.ID)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationCancelled)
+	c.Assert(op.Error, Matches, `cannot create container "c1": cannot download image "stalled:ubuntu/trusty": .*context canceled`)
+	_, err = s.client.Container("c1")
+	c.Assert(err, ErrorMatches, `container "c1" not found`)
+}
+
+func (s *FlexSuite) TestPublicImages(c *C) {
+	var fingerprints []string
+	for i, alias := range []string{"public", "private"} {
+		image, err := s.client.ImportImage(bytes.NewReader(makeImage(c, testImageMetadata, "rootfs/etc/issue", alias)), "")
+		c.Assert(err, IsNil)
+		c.Assert(image.Public, Equals, false)
+		err = s.client.CreateImageAlias(alias, image.Fingerprint, "")
+		c.Assert(err, IsNil)
+		fingerprints = append(fingerprints, image.Fingerprint)
+		if i == 0 {
+			err = s.client.SetImagePublic(image.Fingerprint[:12], true)
+			c.Assert(err, IsNil)
+		}
+	}
+	public, private := fingerprints[0], fingerprints[1]
+	image, err := s.client.Image(public)
+	c.Assert(err, IsNil)
+	c.Assert(image.Public, Equals, true)
+
+	// Untrusted clients only see public images.
+	client, _, err := flex.NewClient(s.remoteConfig(c), "")
+	c.Assert(err, IsNil)
+	images, err := client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 1)
+	c.Assert(images[0].Fingerprint, Equals, public)
+	aliases, err := client.ImageAliases()
+	c.Assert(err, IsNil)
+	c.Assert(aliases, DeepEquals, []flex.ImageAlias{{Name: "public", Target: public}})
+	alias, err := client.ImageAlias("public")
+	c.Assert(err, IsNil)
+	c.Assert(alias.Target, Equals, public)
+	_, err = client.ImageAlias("private")
+	c.Assert(err, ErrorMatches, `image alias "private" not found`)
+	_, err = client.Image(private)
+	c.Assert(err, ErrorMatches, `image "`+private+`" not found`)
+	var buf bytes.Buffer
+	_, err = client.ExportImage(public, &buf)
+	c.Assert(err, IsNil)
+	_, err = client.ExportImage(private, &buf)
+	c.Assert(err, ErrorMatches, `image "`+private+`" not found`)
+
+	// Nor look them up by prefix, which would reveal private ones.
+	for _, prefix := range []string{public[:12], private[:12], public[:1]} {
+		_, err = client.Image(prefix)
+		c.Assert(err, ErrorMatches, `image "`+prefix+`" not found`)
+		_, err = client.ExportImage(prefix, &buf)
+		c.Assert(err, ErrorMatches, `image "`+prefix+`" not found`)
+	}
+
+	// And can't change them.
+	err = client.SetImagePublic(private, true)
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+	err = client.DeleteImage(public)
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+	err = client.CreateImageAlias("other", public, "")
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+	_, err = client.ImportImage(bytes.NewReader(makeImage(c, testImageMetadata)), "")
+	c.Assert(err, ErrorMatches, "client certificate not trusted")
+
+	err = s.client.SetImagePublic(public, false)
+	c.Assert(err, IsNil)
+	images, err = client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 0)
+}
+
+func (s *FlexSuite) TestPublicImagesWithoutCert(c *C) {
+	for i, alias := range []string{"public", "private"} {
+		image, err := s.client.ImportImage(bytes.NewReader(makeImage(c, testImageMetadata, "rootfs/etc/issue", alias)), "")
+		c.Assert(err, IsNil)
+		if i == 0 {
+			err = s.client.SetImagePublic(image.Fingerprint, true)
+			c.Assert(err, IsNil)
+		}
+	}
+	images, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 2)
+
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func(path string) (int, flex.Response) {
+		resp, err := client.Get("https://localhost:43789" + path)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		var doc flex.Response
+		err = json.NewDecoder(resp.Body).Decode(&doc)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, doc
+	}
+	code, doc := get("/1.0/images")
+	c.Assert(code, Equals, http.StatusOK)
+	var result []flex.ImageInfo
+	err = json.Unmarshal(doc.Metadata, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 1)
+	c.Assert(result[0].Public, Equals, true)
+
+	code, _ = get("/1.0/images/" + result[0].Fingerprint)
+	c.Assert(code, Equals, http.StatusOK)
+	code, doc = get("/1.0/containers")
+	c.Assert(code, Equals, http.StatusForbidden)
+	c.Assert(doc.Error, Equals, "client certificate not trusted")
+}
+
+func (s *FlexSuite) TestWriteResponseMarshalError(c *C) {
+	rec := httptest.NewRecorder()
+	err := flex.WriteResponse(rec, http.StatusOK, flex.SyncResponse, func() {}, "")
+	c.Assert(err, ErrorMatches, "cannot marshal response metadata: .*")
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+	var doc flex.Response
+	err = json.Unmarshal(rec.Body.Bytes(), &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, DeepEquals, flex.Response{
+		Type:       flex.ErrorResponse,
+		Status:     "Internal Server Error",
+		StatusCode: http.StatusInternalServerError,
+		Error:      "cannot marshal response metadata",
+	})
+}
+
+// writeResponse writes a response document with the provided metadata, or
+// an error document if err isn't empty.
+func writeResponse(c *C, w http.ResponseWriter, code int, metadata interface{}, err string) {
+	doc := flex.Response{Type: flex.SyncResponse, Status: http.StatusText(code), StatusCode: code, Error: err}
+	if err != "" {
+		doc.Type = flex.ErrorResponse
+	} else {
+		data, err := json.Marshal(metadata)
+		c.Assert(err, IsNil)
+		doc.Metadata = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	c.Assert(json.NewEncoder(w).Encode(&doc), IsNil)
+}
+
+func (s *FlexSuite) TestCreateFromRemoteImage(c *C) {
+	data := makeImage(c, testImageMetadata)
+	sum := sha256.Sum256(data)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// The other daemon drops the connection halfway through the first
+	// download.
+	var ranges []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.0/images/aliases/myimage":
+			writeResponse(c, w, http.StatusOK, &flex.ImageAlias{Name: "myimage", Target: fingerprint}, "")
+		case "/1.0/images/" + fingerprint:
+			writeResponse(c, w, http.StatusOK, &flex.ImageInfo{Fingerprint: fingerprint, Public: true}, "")
+		case "/1.0/images/" + fingerprint + "/export":
+			ranges = append(ranges, r.Header.Get("Range"))
+			if len(ranges) == 1 {
+				w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(data[:len(data)/2])
+				return
+			}
+			http.ServeContent(w, r, "image.tar.gz", time.Time{}, bytes.NewReader(data))
+		default:
+			writeResponse(c, w, http.StatusNotFound, nil, "not found")
+		}
+	}))
+	// Quiet the handshake failure with a mismatching certificate.
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	remote := &flex.RemoteConfig{
+		Addr:            server.Listener.Addr().String(),
+		CertFingerprint: flex.CertFingerprint(server.Certificate()),
+	}
+
+	op, err := s.client.CreateFromRemoteImage("c1", remote, "myimage", nil, nil)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	c.Assert(ranges, DeepEquals, []string{"", fmt.Sprintf("bytes=%d-", len(data)/2)})
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Source, Equals, fingerprint)
+	image, err := s.client.Image(fingerprint)
+	c.Assert(err, IsNil)
+	c.Assert(image.Size, Equals, int64(len(data)))
+	c.Assert(image.Public, Equals, false)
+
+	// Later creates use the image in the store.
+	op, err = s.client.CreateFromRemoteImage("c2", remote, fingerprint, nil, nil)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	c.Assert(ranges, HasLen, 2)
+
+	_, err = s.client.CreateFromRemoteImage("c3", remote, "other", nil, nil)
+	c.Assert(err, ErrorMatches, `image "`+remote.Addr+`:other" not found`)
+	remote.CertFingerprint = strings.Repeat("0", 64)
+	_, err = s.client.CreateFromRemoteImage("c3", remote, "myimage", nil, nil)
+	c.Assert(err, ErrorMatches, `cannot inspect image .*: .*does not match.*`)
+}
+
+func (s *FlexSuite) TestImageImportExport(c *C) {
+	data := makeImage(c, testImageMetadata)
+	sum := sha256.Sum256(data)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	_, err := s.client.ImportImage(bytes.NewReader(data), strings.Repeat("0", 64))
+	c.Assert(err, ErrorMatches, `invalid image: fingerprint mismatch: expected 0+, got `+fingerprint)
+	images, err := s.client.Images()
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 0)
+
+	image, err := s.client.ImportImage(bytes.NewReader(data), fingerprint)
+	c.Assert(err, IsNil)
+	c.Assert(image.Fingerprint, Equals, fingerprint)
+
+	var buf bytes.Buffer
+	filename, err := s.client.ExportImage(fingerprint[:12], &buf)
+	c.Assert(err, IsNil)
+	c.Assert(filename, Equals, fingerprint+".tar.gz")
+	c.Assert(buf.Bytes(), DeepEquals, data)
+
+	_, err = s.client.ExportImage("abc", &buf)
+	c.Assert(err, ErrorMatches, `image "abc" not found`)
+}
+
+func (s *FlexSuite) TestImageTemplates(c *C) {
+	metadata := testImageMetadata + `
+templates:
+  /etc/hostname:
+    when: [create]
+    template: hostname.tpl
+  /etc/motd:
+    when: [start]
+    template: motd.tpl
+`
+	data := makeImage(c, metadata,
+		"rootfs/etc/motd", "unrendered\n",
+		"templates/", "",
+		"templates/hostname.tpl", "{{.Name}} ({{.Properties.release}})\n",
+		"templates/motd.tpl", "{{.Name}}\n")
+	image, err := s.client.ImportImage(bytes.NewReader(data), "")
+	c.Assert(err, IsNil)
+	op, err := s.client.CreateFromImage("c1", image.Fingerprint, nil, nil)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	for path, content := range map[string]string{"/etc/hostname": "c1 (trusty)\n", "/etc/motd": "unrendered\n"} {
+		var stdout bytes.Buffer
+		code, err := s.client.Exec("c1", []string{"read", path}, flex.ExecOptions{Stdout: &stdout})
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, 0)
+		c.Assert(stdout.String(), Equals, content)
+	}
+}
+
+func (s *FlexSuite) TestImageTemplatesSymlinks(c *C) {
+	hostDir := c.MkDir()
+	hostFile := filepath.Join(hostDir, "hostname")
+	err := ioutil.WriteFile(hostFile, []byte("host\n"), 0644)
+	c.Assert(err, IsNil)
+	create := func(name string, data []byte) *flex.Operation {
+		image, err := s.client.ImportImage(bytes.NewReader(data), "")
+		c.Assert(err, IsNil)
+		op, err := s.client.CreateFromImage(name, image.Fingerprint, nil, nil)
+		c.Assert(err, IsNil)
+		op, err = s.client.WaitForOperation(op.ID, -1)
+		c.Assert(err, IsNil)
+		return op
+	}
+
+	// Templates aren't rendered through symlinks in the root filesystem.
+	data := makeImage(c, testImageMetadata+`
+templates:
+  /var/hostname:
+    when: [create]
+    template: hostname.tpl
+`, "rootfs/var", "-> "+hostDir, "templates/", "", "templates/hostname.tpl", "{{.Name}}\n")
+	op := create("c1", data)
+	c.Assert(op.Status, Equals, flex.OperationFailure)
+	c.Assert(op.Error, Matches, ".*var is a symlink")
+	content, err := ioutil.ReadFile(hostFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "host\n")
+
+	// Nor are templates read through symlinks.
+	data = makeImage(c, testImageMetadata+`
+templates:
+  /etc/hostname:
+    when: [create]
+    template: hostname.tpl
+`, "templates/", "", "templates/hostname.tpl", "-> "+hostFile)
+	op = create("c2", data)
+	c.Assert(op.Status, Equals, flex.OperationFailure)
+	c.Assert(op.Error, Matches, ".*hostname.tpl is a symlink")
+
+	// Nor rendered outside of the root filesystem.
+	data = makeImage(c, testImageMetadata+`
+templates:
+  /../config:
+    when: [create]
+    template: config.tpl
+`, "templates/", "", "templates/config.tpl", "lxc.hook.pre-start = /bin/sh\n")
+	op = create("c3", data)
+	c.Assert(op.Status, Equals, flex.OperationFailure)
+	c.Assert(op.Error, Matches, `.*invalid template target "/../config"`)
+	_, err = os.Stat(filepath.Join(s.flexDir, "lxc", "c3", "config"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// Only the root filesystem is unpacked into the container directory.
+	data = makeImage(c, testImageMetadata, "config", "lxc.hook.pre-start = /bin/false\n")
+	op = create("c3", data)
+	c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+	_, err = os.Stat(filepath.Join(s.flexDir, "lxc", "c3", "config"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(s.flexDir, "lxc", "c3", "metadata.yaml"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FlexSuite) TestPublish(c *C) {
+	metadata := testImageMetadata + `
+templates:
+  /etc/hostname:
+    when: [create]
+    template: hostname.tpl
+`
+	data := makeImage(c, metadata, "templates/", "", "templates/hostname.tpl", "{{.Name}}\n")
+	source, err := s.client.ImportImage(bytes.NewReader(data), "")
+	c.Assert(err, IsNil)
+	op, err := s.client.CreateFromImage("c1", source.Fingerprint, nil, nil)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	op, err = s.client.Publish("c1", "mine", true, map[string]string{"description": "Mine"})
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+	var image flex.ImageInfo
+	c.Assert(op.Result(&image), IsNil)
+	c.Assert(image.Fingerprint, Not(Equals), source.Fingerprint)
+	c.Assert(image.Architecture, Equals, "x86_64")
+	c.Assert(image.Properties, DeepEquals, map[string]string{"os": "ubuntu", "release": "trusty", "description": "Mine"})
+	c.Assert(image.Public, Equals, true)
+	c.Assert(image.Aliases, DeepEquals, []string{"mine"})
+
+	// The container was stopped for publishing, and started again.
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "RUNNING")
+
+	// The rendered template made it into the image, but not the template.
+	op, err = s.client.CreateFromImage("c2", "mine", nil, nil)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+	err = s.client.Start("c2")
+	c.Assert(err, IsNil)
+	var stdout bytes.Buffer
+	code, err := s.client.Exec("c2", []string{"read", "/etc/hostname"}, flex.ExecOptions{Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 0)
+	c.Assert(stdout.String(), Equals, "c1\n")
+
+	// Stopped containers stay stopped.
+	s.create(c, "c3")
+	op, err = s.client.Publish("c3", "", false, nil)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+	var stopped flex.ImageInfo
+	c.Assert(op.Result(&stopped), IsNil)
+	c.Assert(stopped.Architecture, Equals, "amd64")
+	c.Assert(stopped.Properties, DeepEquals, map[string]string{"os": "ubuntu", "release": "trusty"})
+	c.Assert(stopped.Public, Equals, false)
+	state, err = s.client.Status("c3")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "STOPPED")
+
+	_, err = s.client.Publish("c4", "", false, nil)
+	c.Assert(err, ErrorMatches, `container "c4" not found`)
+	_, err = s.client.Publish("c3", "mine", false, nil)
+	c.Assert(err, ErrorMatches, `image alias "mine" already exists`)
+	_, err = s.client.Publish("c3", "images:mine", false, nil)
+	c.Assert(err, ErrorMatches, `invalid image alias name "images:mine"`)
+
+	// Parameters of the media type don't matter.
+	header := http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	resp, doc := s.requestHeader(c, "POST", "/1.0/images", header, `{"container": "c4"}`)
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(doc.Error, Equals, `container "c4" not found`)
+	header = http.Header{"Content-Type": {"application/json;;"}}
+	resp, doc = s.requestHeader(c, "POST", "/1.0/images", header, "{}")
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(doc.Error, Matches, `invalid content type "application/json;;": .*`)
+}
+
+func (s *FlexSuite) TestSnapshots(c *C) {
+	image, err := s.client.ImportImage(bytes.NewReader(makeImage(c, testImageMetadata)), "")
+	c.Assert(err, IsNil)
+	wait := func(op *flex.Operation, err error) {
+		c.Assert(err, IsNil)
+		op, err = s.client.WaitForOperation(op.ID, -1)
+		c.Assert(err, IsNil)
+		c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+	}
+	write := func(name, path, content string) {
+		code, err := s.client.Exec(name, []string{"write", path}, flex.ExecOptions{Stdin: strings.NewReader(content)})
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, 0)
+	}
+	read := func(name, path string) string {
+		var stdout bytes.Buffer
+		code, err := s.client.Exec(name, []string{"read", path}, flex.ExecOptions{Stdout: &stdout})
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, 0)
+		return stdout.String()
+	}
+	state := func(name string) string {
+		state, err := s.client.Status(name)
+		c.Assert(err, IsNil)
+		return state.Status
+	}
+
+	wait(s.client.CreateFromImage("c1", image.Fingerprint, nil, map[string]string{"user.a": "1"}))
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+	write("c1", "/etc/motd", "before\n")
+
+	// Running containers are stopped for snapshots, and started again.
+	wait(s.client.CreateSnapshot("c1", "first"))
+	c.Assert(state("c1"), Equals, "RUNNING")
+	wait(s.client.CreateSnapshot("c1", ""))
+	_, err = s.client.CreateSnapshot("c1", "first")
+	c.Assert(err, ErrorMatches, `snapshot "c1/first" already exists`)
+	_, err = s.client.CreateSnapshot("c2", "")
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+	_, err = s.client.CreateSnapshot("c1", "a/b")
+	c.Assert(err, ErrorMatches, `invalid snapshot name "a/b"`)
+
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Snapshots, DeepEquals, []string{"first", "snap0"})
+	snapshots, err := s.client.Snapshots("c1")
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 2)
+	c.Assert(snapshots[0].Name, Equals, "first")
+	c.Assert(snapshots[0].Profiles, DeepEquals, []string{"default"})
+	c.Assert(snapshots[0].Config, DeepEquals, map[string]string{"user.a": "1"})
+	c.Assert(snapshots[0].CreatedAt.After(time.Now()), Equals, false)
+	c.Assert(snapshots[1].Name, Equals, "snap0")
+
+	write("c1", "/etc/motd", "after\n")
+	err = s.client.SetConfig("c1", map[string]string{"user.a": "2"})
+	c.Assert(err, IsNil)
+
+	wait(s.client.RestoreSnapshot("c1", "first"))
+	c.Assert(state("c1"), Equals, "RUNNING")
+	c.Assert(read("c1", "/etc/motd"), Equals, "before\n")
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config, DeepEquals, map[string]string{"user.a": "1"})
+	_, err = s.client.RestoreSnapshot("c1", "missing")
+	c.Assert(err, ErrorMatches, `snapshot "c1/missing" not found`)
+
+	// Snapshots are published without stopping the container.
+	write("c1", "/etc/motd", "after\n")
+	wait(s.client.Publish("c1/snap0", "snap", false, nil))
+	wait(s.client.CreateFromImage("c2", "snap", nil, nil))
+	err = s.client.Start("c2")
+	c.Assert(err, IsNil)
+	c.Assert(read("c2", "/etc/motd"), Equals, "before\n")
+	_, err = s.client.Publish("c1/missing", "", false, nil)
+	c.Assert(err, ErrorMatches, `snapshot "c1/missing" not found`)
+
+	wait(s.client.DeleteSnapshot("c1", "first"))
+	_, err = s.client.Snapshot("c1", "first")
+	c.Assert(err, ErrorMatches, `snapshot "c1/first" not found`)
+	_, err = s.client.DeleteSnapshot("c1", "first")
+	c.Assert(err, ErrorMatches, `snapshot "c1/first" not found`)
+	snapshot, err := s.client.Snapshot("c1", "snap0")
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Name, Equals, "snap0")
+
+	// Containers are destroyed along with their snapshots.
+	err = s.client.Stop("c1")
+	c.Assert(err, IsNil)
+	err = s.client.Destroy("c1")
+	c.Assert(err, IsNil)
+	wait(s.client.CreateFromImage("c1", image.Fingerprint, nil, nil))
+	info, err = s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.Snapshots, DeepEquals, []string{})
+	_, err = s.client.Snapshot("c1", "snap0")
+	c.Assert(err, ErrorMatches, `snapshot "c1/snap0" not found`)
+}
+
+func (s *FlexSuite) TestCheckpoints(c *C) {
+	checkpoint := func(name string, stop bool) *flex.CheckpointInfo {
+		op, err := s.client.CreateCheckpoint(name, stop, false)
+		c.Assert(err, IsNil)
+		op, err = s.client.WaitForOperation(op.ID, -1)
+		c.Assert(err, IsNil)
+		c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+		var info flex.CheckpointInfo
+		err = op.Result(&info)
+		c.Assert(err, IsNil)
+		return &info
+	}
+	ids := func(name string) []int {
+		checkpoints, err := s.client.Checkpoints(name)
+		c.Assert(err, IsNil)
+		ids := []int{}
+		for _, checkpoint := range checkpoints {
+			ids = append(ids, checkpoint.ID)
+		}
+		return ids
+	}
+	state := func(name string) string {
+		state, err := s.client.Status(name)
+		c.Assert(err, IsNil)
+		return state.Status
+	}
+
+	s.create(c, "c1")
+	c.Assert(ids("c1"), DeepEquals, []int{})
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	info := checkpoint("c1", false)
+	c.Assert(info.ID, Equals, 0)
+	c.Assert(info.Size > 0, Equals, true)
+	c.Assert(info.CreatedAt.After(time.Now()), Equals, false)
+	c.Assert(state("c1"), Equals, "RUNNING")
+	info = checkpoint("c1", true)
+	c.Assert(info.ID, Equals, 1)
+	c.Assert(state("c1"), Equals, "STOPPED")
+	c.Assert(ids("c1"), DeepEquals, []int{0, 1})
+
+	got, err := s.client.Checkpoint("c1", 1)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, info)
+	_, err = s.client.Checkpoint("c1", 7)
+	c.Assert(err, ErrorMatches, `checkpoint "7" of container "c1" not found`)
+	_, err = s.client.Checkpoints("c2")
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+
+	op, err := s.client.RestoreCheckpoint("c1", 1, false)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+	c.Assert(state("c1"), Equals, "RUNNING")
+	_, err = s.client.RestoreCheckpoint("c1", 7, false)
+	c.Assert(err, ErrorMatches, `checkpoint "7" of container "c1" not found`)
+
+	err = s.client.DeleteCheckpoint("c1", 0)
+	c.Assert(err, IsNil)
+	_, err = s.client.Checkpoint("c1", 0)
+	c.Assert(err, ErrorMatches, `checkpoint "0" of container "c1" not found`)
+	err = s.client.DeleteCheckpoint("c1", 0)
+	c.Assert(err, ErrorMatches, `checkpoint "0" of container "c1" not found`)
+
+	// Ids aren't reused once the newest checkpoint is deleted.
+	err = s.client.DeleteCheckpoint("c1", 1)
+	c.Assert(err, IsNil)
+	c.Assert(ids("c1"), DeepEquals, []int{})
+	c.Assert(checkpoint("c1", false).ID, Equals, 2)
+
+	// Ids keep increasing, and only the newest checkpoints are retained.
+	err = s.client.SetConfig("c1", map[string]string{"checkpoint.retain": "2"})
+	c.Assert(err, IsNil)
+	c.Assert(checkpoint("c1", false).ID, Equals, 3)
+	c.Assert(checkpoint("c1", false).ID, Equals, 4)
+	c.Assert(checkpoint("c1", false).ID, Equals, 5)
+	c.Assert(ids("c1"), DeepEquals, []int{4, 5})
+	err = s.client.SetConfig("c1", map[string]string{"checkpoint.retain": "-1"})
+	c.Assert(err, ErrorMatches, `invalid value for checkpoint.retain: "-1".*`)
+
+	// The deprecated routes still work, with the id as the result.
+	resp, doc := s.request(c, "GET", "/checkpoint?name=c1&stop=true", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	var legacy flex.Operation
+	err = json.Unmarshal(doc.Metadata, &legacy)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(legacy.ID, -1)
+	c.Assert(err, IsNil)
+	var id int
+	err = op.Result(&id)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, 6)
+	c.Assert(state("c1"), Equals, "STOPPED")
+	resp, _ = s.request(c, "GET", "/restore?name=c1&id=6", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(state("c1"), Equals, "RUNNING")
+
+	// Containers are destroyed along with their checkpoints.
+	err = s.client.Stop("c1")
+	c.Assert(err, IsNil)
+	err = s.client.Destroy("c1")
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(s.flexDir, "checkpoints", "c1"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FlexSuite) TestSendContainer(c *C) {
+	// Stand in for rsync, copying into dest what would go to the remote.
+	dest := c.MkDir()
+	bin := c.MkDir()
+	script := "#!/bin/sh\nfor arg; do src=$dst; dst=$arg; done\n" +
+		"mkdir -p " + dest + "/${dst#*:} && cp -a $src. " + dest + "/${dst#*:}\n"
+	err := ioutil.WriteFile(filepath.Join(bin, "rsync"), []byte(script), 0755)
+	c.Assert(err, IsNil)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s.create(c, "c1")
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+	op, err := s.client.CreateCheckpoint("c1", true, false)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+
+	op, err = s.client.SendContainer(&flex.RemoteConfig{Addr: "otherhost:8443"}, "c1", 0)
+	c.Assert(err, IsNil)
+	op, err = s.client.WaitForOperation(op.ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess, Commentf("%s", op.Error))
+	_, err = os.Stat(filepath.Join(dest, s.flexDir, "checkpoints", "c1", "0", "checkpoint.json"))
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(dest, s.flexDir, "lxc", "c1"))
+	c.Assert(err, IsNil)
+
+	_, err = s.client.SendContainer(&flex.RemoteConfig{Addr: "otherhost:8443"}, "c1", 3)
+	c.Assert(err, ErrorMatches, `checkpoint "3" of container "c1" not found`)
+}
+
+func (s *FlexSuite) TestReceiveContainer(c *C) {
+	// Drop the container from the database behind the daemon, leaving it
+	// in the backend only, as when it's been sent from elsewhere.
+	s.create(c, "c1")
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(s.flexDir, "flex.db")+"?_foreign_keys=1&_busy_timeout=5000")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("DELETE FROM containers WHERE name = 'c1'")
+	c.Assert(err, IsNil)
+	c.Assert(db.Close(), IsNil)
+	_, err = s.client.Container("c1")
+	c.Assert(err, ErrorMatches, `container "c1" not found`)
+
+	err = s.client.ReceiveContainer("c1")
+	c.Assert(err, IsNil)
+	info, err := s.client.Container("c1")
+	c.Assert(err, IsNil)
+	c.Assert(info.State, Equals, "STOPPED")
+	err = s.client.ReceiveContainer("c1")
+	c.Assert(err, IsNil)
+	err = s.client.ReceiveContainer("c2")
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+}
+
+func (s *FlexSuite) TestAutostart(c *C) {
+	s.create(c, "c1")
+	s.create(c, "c2")
+	err := s.client.SetConfig("c1", map[string]string{"boot.autostart": "true"})
+	c.Assert(err, IsNil)
+
+	s.restartDaemon(c)
+	for i := 0; i < 100; i++ {
+		state, err := s.client.Status("c1")
+		c.Assert(err, IsNil)
+		if state.Status == "RUNNING" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "RUNNING")
+	state, err = s.client.Status("c2")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "STOPPED")
+}
+
+func (s *FlexSuite) TestStartMissing(c *C) {
+	err := s.client.Start("c1")
+	c.Assert(err, ErrorMatches, `container "c1" not found`)
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *FlexSuite) TestExec(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	var stdout, stderr bytes.Buffer
+	opts := flex.ExecOptions{Stdout: &stdout, Stderr: &stderr}
+	code, err := s.client.Exec("c1", []string{"echo", "hello", "world"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 0)
+	c.Assert(stdout.String(), Equals, "hello world\n")
+	c.Assert(stderr.String(), Equals, "")
+
+	stdout.Reset()
+	code, err = s.client.Exec("c1", []string{"warn", "oops"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 0)
+	c.Assert(stdout.String(), Equals, "")
+	c.Assert(stderr.String(), Equals, "oops\n")
+
+	code, err = s.client.Exec("c1", []string{"exit", "42"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 42)
+}
+
+func (s *FlexSuite) TestExecMissingWebsockets(c *C) {
+	fds := map[string]string{"0": "secret0", "1": "secret1", "2": "secret2"}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			writeResponse(c, w, http.StatusOK, "pong", "")
+			return
+		}
+		metadata, err := json.Marshal(map[string]interface{}{"fds": fds})
+		c.Assert(err, IsNil)
+		op, err := json.Marshal(&flex.Operation{ID: "1", Status: flex.OperationRunning, Metadata: metadata})
+		c.Assert(err, IsNil)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&flex.Response{Type: flex.AsyncResponse, StatusCode: http.StatusAccepted, Metadata: op})
+	}))
+	defer server.Close()
+	config := &flex.Config{
+		DefaultRemote: "fake",
+		Remotes: map[string]flex.RemoteConfig{
+			"fake": {Addr: strings.TrimPrefix(server.URL, "https://"), CertFingerprint: flex.CertFingerprint(server.Certificate())},
+		},
+	}
+	client, _, err := flex.NewClient(config, "")
+	c.Assert(err, IsNil)
+
+	_, err = client.Exec("c1", []string{"true"}, flex.ExecOptions{})
+	c.Assert(err, ErrorMatches, `exec operation metadata has no websocket for "control"`)
+	fds = map[string]string{"control": "secret", "0": "secret0"}
+	_, err = client.Exec("c1", []string{"true"}, flex.ExecOptions{})
+	c.Assert(err, ErrorMatches, `exec operation metadata has no websocket for "1"`)
+}
+
+func (s *FlexSuite) TestExecEnvironment(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	var stdout bytes.Buffer
+	opts := flex.ExecOptions{
+		Env:    map[string]string{"FOO": "bar", "HOME": "/home/foo"},
+		Cwd:    "/tmp",
+		Stdout: &stdout,
+	}
+	_, err = s.client.Exec("c1", []string{"env"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "FOO=bar\nHOME=/home/foo\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n")
+
+	stdout.Reset()
+	_, err = s.client.Exec("c1", []string{"pwd"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "/tmp\n")
+
+	stdout.Reset()
+	opts.Stdin = strings.NewReader("input")
+	_, err = s.client.Exec("c1", []string{"cat"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "input")
+}
+
+func (s *FlexSuite) TestExecInteractive(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	var stdout bytes.Buffer
+	opts := flex.ExecOptions{Interactive: true, Stdout: &stdout}
+	code, err := s.client.Exec("c1", []string{"warn", "hello"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, 0)
+	c.Assert(stdout.String(), Equals, "hello\r\n")
+}
+
+func (s *FlexSuite) TestAttach(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	// Attaching goes through the API connection, both locally and
+	// remotely.
+	s.trustClient(c)
+	remote, _, err := flex.NewClient(s.remoteConfig(c), "")
+	c.Assert(err, IsNil)
+	for _, client := range []*flex.Client{s.client, remote} {
+		var stdout bytes.Buffer
+		code, err := client.Attach("c1", flex.ExecOptions{Stdout: &stdout})
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, 0)
+		c.Assert(stdout.String(), Equals, "/bin/bash\r\n")
+	}
+
+	// The old side channel is gone.
+	resp, doc := s.request(c, "GET", "/attach?name=c1&command=/bin/bash&secret=5", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusGone)
+	c.Assert(doc.Error, Matches, "attach has moved to .*")
+}
+
+func (s *FlexSuite) TestExecWebsocketSecret(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	resp, doc := s.request(c, "POST", "/1.0/containers/c1/exec", `{"command": ["true"]}`)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	var op flex.Operation
+	err = json.Unmarshal(doc.Metadata, &op)
+	c.Assert(err, IsNil)
+	var sockets struct {
+		FDs map[string]string `json:"fds"`
+	}
+	err = json.Unmarshal(op.Metadata, &sockets)
+	c.Assert(err, IsNil)
+	c.Assert(sockets.FDs, HasLen, 4)
+	c.Assert(sockets.FDs["0"], Not(Equals), sockets.FDs["1"])
+
+	resp, doc = s.request(c, "GET", "/1.0/operations/"+op.ID+"/websocket?secret=wrong", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+	c.Assert(doc.Error, Equals, "invalid websocket secret")
+}
+
+func (s *FlexSuite) TestExecTerminalSize(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	var stdout bytes.Buffer
+	opts := flex.ExecOptions{Interactive: true, Width: 80, Height: 24, Stdout: &stdout}
+	_, err = s.client.Exec("c1", []string{"size"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "24 80\r\n")
+
+	stdout.Reset()
+	control := make(chan flex.ExecControl, 1)
+	control <- flex.ExecControl{Command: "window-resize", Width: 132, Height: 43}
+	opts.Control = control
+	_, err = s.client.Exec("c1", []string{"winch"}, opts)
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "43 132\r\n")
+}
+
+func (s *FlexSuite) TestExecSignal(c *C) {
+	s.create(c, "c1")
+	err := s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	for _, interactive := range []bool{false, true} {
+		control := make(chan flex.ExecControl, 1)
+		control <- flex.ExecControl{Command: "signal", Signal: int(syscall.SIGHUP)}
+		opts := flex.ExecOptions{Interactive: interactive, Control: control}
+		code, err := s.client.Exec("c1", []string{"wait-signal"}, opts)
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, 128+int(syscall.SIGHUP))
+	}
+}
+
+func (s *FlexSuite) TestExecNotRunning(c *C) {
+	s.create(c, "c1")
+	_, err := s.client.Exec("c1", []string{"true"}, flex.ExecOptions{})
+	c.Assert(err, ErrorMatches, `container "c1" is not running`)
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusConflict)
+
+	_, err = s.client.Exec("c2", []string{"true"}, flex.ExecOptions{})
+	c.Assert(err, ErrorMatches, `container "c2" not found`)
+}
+
+func (s *FlexSuite) TestMethodNotAllowed(c *C) {
+	resp, _ := s.request(c, "DELETE", "/1.0/containers", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *FlexSuite) TestDeprecatedRoutes(c *C) {
+	s.create(c, "c1")
+	resp, _ := s.request(c, "GET", "/start?name=c1", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	state, err := s.client.Status("c1")
+	c.Assert(err, IsNil)
+	c.Assert(state.Status, Equals, "RUNNING")
+}
+
+func (s *FlexSuite) TestOperations(c *C) {
+	op, err := s.client.Create("c1", "ubuntu", "trusty", "amd64")
+	c.Assert(err, IsNil)
+	c.Assert(op.ID, Not(Equals), "")
+	c.Assert(op.Description, Equals, "create c1")
+
+	op, err = s.client.WaitForOperation(op.ID, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(op.Done(), Equals, true)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+
+	op, err = s.client.Operation(op.ID)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, flex.OperationSuccess)
+
+	err = s.client.CancelOperation(op.ID)
+	c.Assert(err, ErrorMatches, "operation .* cannot be cancelled")
+	c.Assert(err.(*flex.Error).StatusCode, Equals, http.StatusConflict)
+
+	_, err = s.client.Operation("missing")
+	c.Assert(err, ErrorMatches, `operation "missing" not found`)
+}
+
+func (s *FlexSuite) TestEvents(c *C) {
+	stream, err := s.client.Events("container")
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	s.create(c, "c1")
+	err = s.client.Start("c1")
+	c.Assert(err, IsNil)
+
+	for _, action := range []string{"created", "started"} {
+		select {
+		case e := <-stream.Events:
+			c.Assert(e.Type, Equals, "container")
+			var ce flex.ContainerEvent
+			c.Assert(json.Unmarshal(e.Metadata, &ce), IsNil)
+			c.Assert(ce.Name, Equals, "c1")
+			c.Assert(ce.Action, Equals, action)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for %s event", action)
+		}
+	}
+}
+
+func (s *FlexSuite) TestEventsUnknownType(c *C) {
+	_, err := s.client.Events("bogus")
+	c.Assert(err, ErrorMatches, `unknown event type "bogus"`)
+}
@@ -6,8 +6,10 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 /*
@@ -79,3 +81,40 @@ func newIdmap() (*idmap, error) {
 	m.gidrange = grange
 	return m, nil
 }
+
+// shiftTree moves the ownership of every file under dir from the host ids
+// into the ranges of the map.
+func (m *idmap) shiftTree(dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot find owner of %s", path)
+		}
+		if uint(st.Uid) >= m.uidrange || uint(st.Gid) >= m.gidrange {
+			return fmt.Errorf("%s is owned by %d:%d, outside of the id map", path, st.Uid, st.Gid)
+		}
+		err = os.Lchown(path, int(uint(st.Uid)+m.uidmin), int(uint(st.Gid)+m.gidmin))
+		if err != nil {
+			return err
+		}
+		// Changing the owner clears the setuid and setgid bits.
+		if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && fi.Mode()&os.ModeSymlink == 0 {
+			return os.Chmod(path, fi.Mode())
+		}
+		return nil
+	})
+}
+
+// unshiftIDs returns the ids seen from within containers for the host
+// ids uid and gid, which must be in the ranges of the map.
+func (m *idmap) unshiftIDs(uid, gid int64) (int64, int64, error) {
+	uid -= int64(m.uidmin)
+	gid -= int64(m.gidmin)
+	if uid < 0 || uid >= int64(m.uidrange) || gid < 0 || gid >= int64(m.gidrange) {
+		return 0, 0, fmt.Errorf("ids outside of the id map")
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,1160 @@
+package flex
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ImageInfo describes an image in the store of a daemon, which containers
+// may be created from.
+type ImageInfo struct {
+	// Fingerprint is the SHA-256 hash of the image tarball, in hex.
+	Fingerprint string `json:"fingerprint"`
+
+	// Size is the size of the image tarball, in bytes.
+	Size int64 `json:"size"`
+
+	Architecture string    `json:"architecture"`
+	CreatedAt    time.Time `json:"created_at"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+
+	// Properties holds free-form details of the image, such as its
+	// "os", "release" and "description".
+	Properties map[string]string `json:"properties"`
+
+	// Aliases holds the names of the aliases targeting the image.
+	Aliases []string `json:"aliases"`
+
+	// Public images may be listed and downloaded by untrusted clients,
+	// such as other daemons creating containers from them.
+	Public bool `json:"public"`
+}
+
+// ImageAlias is a human-friendly name for an image.
+type ImageAlias struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Target is the fingerprint of the image the alias refers to.
+	Target string `json:"target"`
+}
+
+// Image tarballs, which may be compressed with gzip, bzip2 or xz, hold:
+//
+//	metadata.yaml   the image metadata, as held by imageMetadata
+//	rootfs/         the root filesystem of containers, owned by the ids
+//	                seen from within them
+//	templates/      templates for files in the root filesystem, rendered
+//	                when containers are created
+//
+// For example:
+//
+//	architecture: x86_64
+//	creation_date: 1400000000
+//	properties:
+//	  os: ubuntu
+//	  release: trusty
+//	  description: Ubuntu 14.04 LTS
+//	templates:
+//	  /etc/hostname:
+//	    when: [create]
+//	    template: hostname.tpl
+//
+// Templates use the text/template syntax, with the fields of
+// imageTemplateContext, such as {{.Name}} for the container name.
+
+// imageMetadata holds the content of the metadata.yaml file at the top of
+// image tarballs.
+type imageMetadata struct {
+	Architecture string            `yaml:"architecture"`
+	CreationDate int64             `yaml:"creation_date"`
+	Properties   map[string]string `yaml:"properties"`
+
+	// Templates holds the templates of files in the root filesystem,
+	// by absolute path within it.
+	Templates map[string]*imageTemplate `yaml:"templates"`
+}
+
+// imageTemplate describes a template in an image tarball.
+type imageTemplate struct {
+	// When holds the events that render the template. Only "create" is
+	// supported.
+	When []string `yaml:"when"`
+
+	// Template is the name of the template file within templates/.
+	Template string `yaml:"template"`
+}
+
+// imageTemplateContext holds the values available to image templates.
+type imageTemplateContext struct {
+	// Name is the name of the container.
+	Name string
+
+	Architecture string
+	Properties   map[string]string
+}
+
+// imagePath returns the path of the image tarball with the provided
+// fingerprint in the store.
+func imagePath(fingerprint string) string {
+	return varPath("images", fingerprint)
+}
+
+// readImageMetadata returns the metadata held by the image tarball at path.
+func readImageMetadata(path string) (*imageMetadata, error) {
+	// tar figures out the compression of the tarball by itself.
+	output, err := exec.Command("tar", "-xOf", path, "metadata.yaml").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read metadata.yaml: %s", outputErr(output, err))
+	}
+	return parseImageMetadata(output)
+}
+
+func parseImageMetadata(data []byte) (*imageMetadata, error) {
+	var meta imageMetadata
+	err := yaml.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse metadata.yaml: %v", err)
+	}
+	if meta.Architecture == "" {
+		return nil, fmt.Errorf("metadata.yaml has no architecture")
+	}
+	return &meta, nil
+}
+
+// unpackImage unpacks the root filesystem of the image tarball at path into
+// dir/rootfs, for the container named name, rendering the templates in the
+// image along the way. Nothing else in the tarball is unpacked into dir.
+func unpackImage(path string, dir string, name string) error {
+	meta, err := readImageMetadata(path)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("tar", "-C", dir, "--numeric-owner", "-xpf", path, "rootfs").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot unpack image: %s", outputErr(output, err))
+	}
+	ctx := &imageTemplateContext{
+		Name:         name,
+		Architecture: meta.Architecture,
+		Properties:   meta.Properties,
+	}
+	var templatesDir string
+	for target, tmpl := range meta.Templates {
+		render := false
+		for _, when := range tmpl.When {
+			render = render || when == "create"
+		}
+		if !render {
+			continue
+		}
+		if !filepath.IsAbs(target) || filepath.Clean(target) != target {
+			return fmt.Errorf("invalid template target %q", target)
+		}
+		if templatesDir == "" {
+			templatesDir, err = ioutil.TempDir(dir, ".templates_")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(templatesDir)
+			output, err := exec.Command("tar", "-C", templatesDir, "-xf", path, "templates").CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("cannot unpack image templates: %s", outputErr(output, err))
+			}
+			templatesDir = filepath.Join(templatesDir, "templates")
+			if err := checkRealDir(templatesDir); err != nil {
+				return err
+			}
+			if err := checkRealDir(filepath.Join(dir, "rootfs")); err != nil {
+				return err
+			}
+		}
+		err := renderImageTemplate(templatesDir, tmpl.Template, filepath.Join(dir, "rootfs"), target, ctx)
+		if err != nil {
+			return fmt.Errorf("cannot render template of %s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// renderImageTemplate renders the template at path within dir into target
+// within targetDir. Neither path may go through symlinks, as both come
+// from the image tarball and could otherwise reach files of the host.
+func renderImageTemplate(dir string, path string, targetDir string, target string, ctx *imageTemplateContext) error {
+	path, err := noSymlinksPath(dir, path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	t, err := template.New(filepath.Base(path)).Parse(string(data))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, ctx)
+	if err != nil {
+		return err
+	}
+
+	target, err = noSymlinksPath(targetDir, target)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Lstat(target); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checkRealDir returns an error unless the file at path is a directory,
+// rather than a symlink to one.
+func checkRealDir(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Base(path))
+	}
+	return nil
+}
+
+// noSymlinksPath returns the path of the file at path within dir, failing
+// if any of its components is a symlink, or if the file exists and isn't a
+// regular file. Paths going above dir stop at it.
+func noSymlinksPath(dir string, path string) (string, error) {
+	elems := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	result := dir
+	for i, elem := range elems {
+		result = filepath.Join(result, elem)
+		fi, err := os.Lstat(result)
+		if os.IsNotExist(err) && i == len(elems)-1 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink", filepath.Join(elems[:i+1]...))
+		}
+		if i == len(elems)-1 && !fi.Mode().IsRegular() {
+			return "", fmt.Errorf("%s is not a regular file", path)
+		}
+	}
+	return result, nil
+}
+
+// outputErr returns the first line of output of a failed command, which
+// usually tells the most about the failure, or err if there was no output.
+func outputErr(output []byte, err error) string {
+	if msg := strings.TrimSpace(string(output)); msg != "" {
+		return strings.SplitN(msg, "\n", 2)[0]
+	}
+	return err.Error()
+}
+
+// storeImage adds the image tarball read from r to the store and returns
+// its details. If fingerprint isn't empty, the tarball must have it.
+// If the image is in the store already, its details are returned along
+// with errImageExists.
+func (d *Daemon) storeImage(r io.Reader, fingerprint string) (*ImageInfo, error) {
+	f, err := ioutil.TempFile(varPath("images"), ".upload_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot receive image: %v", err)
+	}
+	return d.addImage(f.Name(), hex.EncodeToString(h.Sum(nil)), size, fingerprint)
+}
+
+// addImage moves the image tarball at path, with the provided sha256 sum
+// and size, into the store, and returns its details. If fingerprint isn't
+// empty, it must match the sum. If the image is in the store already, its
+// details are returned along with errImageExists.
+func (d *Daemon) addImage(path string, sum string, size int64, fingerprint string) (*ImageInfo, error) {
+	if fingerprint != "" && fingerprint != sum {
+		return nil, fmt.Errorf("fingerprint mismatch: expected %s, got %s", fingerprint, sum)
+	}
+	meta, err := readImageMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	image := &ImageInfo{
+		Fingerprint:  sum,
+		Size:         size,
+		Architecture: meta.Architecture,
+		CreatedAt:    time.Unix(meta.CreationDate, 0).UTC(),
+		UploadedAt:   time.Now().UTC(),
+		Properties:   meta.Properties,
+		Aliases:      []string{},
+	}
+	if image.Properties == nil {
+		image.Properties = make(map[string]string)
+	}
+	err = os.Rename(path, imagePath(image.Fingerprint))
+	if err != nil {
+		return nil, err
+	}
+	err = dbImageCreate(d.db, image)
+	if err == errImageExists {
+		// The file just replaced is the same.
+		return image, err
+	}
+	if err != nil {
+		os.Remove(imagePath(image.Fingerprint))
+		return nil, err
+	}
+	return image, nil
+}
+
+// remoteImage describes an image available for download from an image
+// server or another daemon.
+type remoteImage struct {
+	// ref is the reference to the image, as provided by the user.
+	ref string
+
+	client      *http.Client
+	url         string
+	fingerprint string
+}
+
+// Image servers and daemons which don't accept connections or start
+// responding within these times are given up on. Downloads themselves may
+// take as long as they need.
+const (
+	imageDialTimeout     = 30 * time.Second
+	imageResponseTimeout = time.Minute
+)
+
+// setImageTimeouts sets up transport for talking to image servers and
+// other daemons, with the timeouts above.
+func setImageTimeouts(transport *http.Transport) {
+	transport.DialContext = (&net.Dialer{Timeout: imageDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = imageDialTimeout
+	transport.ResponseHeaderTimeout = imageResponseTimeout
+}
+
+// fetchImage returns the image from the store, downloading it first if
+// it's not there yet. The download is aborted if ctx is cancelled.
+func (d *Daemon) fetchImage(ctx context.Context, image *remoteImage) (*ImageInfo, error) {
+	// Downloads of the same image would share the partial file.
+	unlock, err := d.lockDownload(ctx, image.fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download image %q: %v", image.ref, err)
+	}
+	defer unlock()
+	info, err := dbImage(d.db, image.fingerprint)
+	if err != errNoSuchImage {
+		return info, err
+	}
+	info, err = d.downloadImage(ctx, image.client, image.url, image.fingerprint)
+	if err == errImageExists {
+		return info, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot download image %q: %v", image.ref, err)
+	}
+	return info, nil
+}
+
+// lockDownload waits until no other download of the image with the
+// provided fingerprint is in progress, or ctx is cancelled, and returns a
+// function that must be called once the download by the caller ends.
+func (d *Daemon) lockDownload(ctx context.Context, fingerprint string) (unlock func(), err error) {
+	for {
+		d.downloadsMu.Lock()
+		done, ok := d.downloads[fingerprint]
+		if !ok {
+			done = make(chan struct{})
+			d.downloads[fingerprint] = done
+			d.downloadsMu.Unlock()
+			return func() {
+				d.downloadsMu.Lock()
+				delete(d.downloads, fingerprint)
+				d.downloadsMu.Unlock()
+				close(done)
+			}, nil
+		}
+		d.downloadsMu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// findDaemonImage returns the public image referred to by ref, which is
+// either an alias or a fingerprint, in the store of the daemon listening
+// on addr, which must present the certificate with the provided
+// fingerprint.
+func (d *Daemon) findDaemonImage(addr string, certFingerprint string, ref string) (*remoteImage, error) {
+	cert, err := loadCert(varPath("server.crt"), varPath("server.key"))
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{}
+	c.setRemote(&RemoteConfig{Addr: addr, CertFingerprint: certFingerprint}, cert)
+	setImageTimeouts(c.http.Transport.(*http.Transport))
+	fingerprint := ref
+	alias, err := c.ImageAlias(ref)
+	if err == nil {
+		fingerprint = alias.Target
+	} else if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+	if !fingerprintExp.MatchString(fingerprint) {
+		return nil, errNoSuchImage
+	}
+	image, err := c.Image(fingerprint)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusNotFound {
+		return nil, errNoSuchImage
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &remoteImage{
+		ref:         addr + ":" + ref,
+		client:      &c.http,
+		url:         c.url(imageURL(image.Fingerprint, "export")),
+		fingerprint: image.Fingerprint,
+	}, nil
+}
+
+// imageDownloadAttempts is the number of times an image download is
+// attempted before giving up.
+var imageDownloadAttempts = 3
+
+// downloadImage downloads the image tarball with the provided fingerprint
+// from url into the store, using client, and returns its details. The
+// tarball is kept in a partial file while it downloads, so interrupted
+// downloads are resumed with range requests where they stopped, both by
+// further attempts and by later calls for the same image. The download is
+// aborted if ctx is cancelled.
+func (d *Daemon) downloadImage(ctx context.Context, client *http.Client, url string, fingerprint string) (*ImageInfo, error) {
+	path := varPath("images", ".partial_"+fingerprint)
+	var err error
+	for i := 0; i < imageDownloadAttempts; i++ {
+		if i > 0 {
+			Debugf("resuming download of image %s: %v", fingerprint, err)
+		}
+		var done bool
+		done, err = downloadPartial(ctx, client, url, path)
+		if done {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	image, err := d.addImage(path, hex.EncodeToString(h.Sum(nil)), size, fingerprint)
+	if err != nil && err != errImageExists {
+		// Start over next time.
+		os.Remove(path)
+	}
+	return image, err
+}
+
+// downloadPartial appends to the file at path the content from url which
+// it's missing, and returns whether the file is now complete. Failures
+// after the download started are reported along with done set to false,
+// so the download may be resumed, unless ctx was cancelled.
+func downloadPartial(ctx context.Context, client *http.Client, url string, path string) (done bool, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return true, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return true, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return ctx.Err() != nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, so start over.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return true, err
+		}
+		if err := f.Truncate(0); err != nil {
+			return true, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing is missing, or the file is corrupt, which the
+		// fingerprint verification catches.
+		return true, nil
+	default:
+		return true, fmt.Errorf("cannot download image: %s", resp.Status)
+	}
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		return ctx.Err() != nil, err
+	}
+	return true, f.Sync()
+}
+
+// resolveImage returns the image referred to by ref, which is either an
+// alias or a fingerprint, possibly abbreviated to a unique prefix.
+func (d *Daemon) resolveImage(ref string) (*ImageInfo, error) {
+	alias, err := dbImageAlias(d.db, ref)
+	if err == nil {
+		ref = alias.Target
+	} else if err != errNoSuchImageAlias {
+		return nil, err
+	}
+	if !fingerprintExp.MatchString(ref) {
+		return nil, errNoSuchImage
+	}
+	return dbImage(d.db, ref)
+}
+
+var fingerprintExp = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// imageError returns the error response appropriate for err, which was
+// obtained while trying to perform action on the image referred to by ref.
+func imageError(ref string, action string, err error) response {
+	switch err {
+	case errNoSuchImage:
+		return notFound("image %q not found", ref)
+	case errImageExists:
+		return errorf(http.StatusConflict, "image %q already exists", ref)
+	case errAmbiguousImage:
+		return badRequest("image fingerprint %q is ambiguous", ref)
+	case errNoSuchImageAlias:
+		return notFound("image alias %q not found", ref)
+	case errImageAliasExists:
+		return errorf(http.StatusConflict, "image alias %q already exists", ref)
+	case errNoSuchImageServer:
+		return badRequest("unknown image server in %q", ref)
+	}
+	return internalError("cannot %s image %q: %v", action, ref, err)
+}
+
+// serveImages serves /1.0/images. Untrusted clients may only list the
+// public images.
+func (d *Daemon) serveImages(r *http.Request) response {
+	if r.Method != "GET" && !d.isTrusted(r) {
+		return errUntrusted
+	}
+	res := &resource{
+		get:  d.imagesGet,
+		post: d.imagesPost,
+	}
+	return res.serve(r)
+}
+
+// serveImage serves /1.0/images/<fingerprint>, its tarball under
+// /1.0/images/<fingerprint>/export, and the aliases under
+// /1.0/images/aliases. Untrusted clients may only get the public images
+// and the aliases targeting them.
+func (d *Daemon) serveImage(r *http.Request) response {
+	if r.Method != "GET" && !d.isTrusted(r) {
+		return errUntrusted
+	}
+	var res *resource
+	ref := imageRef(r)
+	switch {
+	case ref == "aliases":
+		res = &resource{get: d.imageAliasesGet, post: d.imageAliasesPost}
+	case strings.HasPrefix(ref, "aliases/"):
+		res = &resource{get: d.imageAliasGet, delete: d.imageAliasDelete}
+	case strings.HasSuffix(ref, "/export"):
+		res = &resource{get: d.imageExport}
+	default:
+		res = &resource{get: d.imageGet, put: d.imagePut, delete: d.imageDelete}
+	}
+	return res.serve(r)
+}
+
+// imageRef returns the image fingerprint or alias name in the path of a
+// request under /1.0/images/.
+func imageRef(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/1.0/images/")
+}
+
+// isVisible returns whether the image may be served in response to r.
+func (d *Daemon) isVisible(r *http.Request, image *ImageInfo) bool {
+	return image.Public || d.isTrusted(r)
+}
+
+// visibleImage returns the image with the fingerprint in ref which may be
+// served in response to r. Untrusted clients must provide the complete
+// fingerprint of a public image, so that they can't learn about private
+// images from ambiguous prefixes.
+func (d *Daemon) visibleImage(r *http.Request, ref string) (*ImageInfo, error) {
+	if !fingerprintExp.MatchString(ref) {
+		return nil, errNoSuchImage
+	}
+	trusted := d.isTrusted(r)
+	if !trusted && len(ref) != 64 {
+		return nil, errNoSuchImage
+	}
+	image, err := dbImage(d.db, ref)
+	if err == nil && !trusted && !image.Public {
+		err = errNoSuchImage
+	}
+	return image, err
+}
+
+func (d *Daemon) imagesGet(r *http.Request) response {
+	fingerprints, err := dbImages(d.db)
+	if err != nil {
+		return internalError("cannot list images: %v", err)
+	}
+	result := make([]*ImageInfo, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		image, err := dbImage(d.db, fingerprint)
+		if err == errNoSuchImage {
+			// Deleted meanwhile.
+			continue
+		}
+		if err != nil {
+			return imageError(fingerprint, "inspect", err)
+		}
+		if !d.isVisible(r, image) {
+			continue
+		}
+		result = append(result, image)
+	}
+	return &syncResponse{result}
+}
+
+// imagesPost adds the image tarball in the request body to the store,
+// verifying it against the fingerprint in the X-Flex-Fingerprint header
+// if there's one. JSON requests publish a container as an image instead.
+func (d *Daemon) imagesPost(r *http.Request) response {
+	if ctype := r.Header.Get("Content-Type"); ctype != "" {
+		mediaType, _, err := mime.ParseMediaType(ctype)
+		if err != nil {
+			return badRequest("invalid content type %q: %v", ctype, err)
+		}
+		if mediaType == "application/json" {
+			return d.imagesPublish(r)
+		}
+	}
+	defer r.Body.Close()
+	image, err := d.storeImage(r.Body, r.Header.Get("X-Flex-Fingerprint"))
+	if err == errImageExists {
+		return imageError(image.Fingerprint, "add", err)
+	}
+	if err != nil {
+		return badRequest("invalid image: %v", err)
+	}
+	return &syncResponse{image}
+}
+
+// imagesPublishReq holds the details of an image to publish from the root
+// filesystem of a container, or of its snapshot when Container is in the
+// <name>/<snapshot> form.
+type imagesPublishReq struct {
+	Container string `json:"container"`
+	Alias     string `json:"alias"`
+	Public    bool   `json:"public"`
+
+	// Properties holds properties of the image, besides those taken
+	// from the image the container was created from, if any.
+	Properties map[string]string `json:"properties"`
+}
+
+// imagesPublish adds an image made of the root filesystem of a container
+// to the store. Running containers are stopped while that happens, and
+// started again afterwards, unless a snapshot is published.
+func (d *Daemon) imagesPublish(r *http.Request) response {
+	var req imagesPublishReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if req.Container == "" {
+		return badRequest("missing container name")
+	}
+	if strings.Contains(req.Alias, ":") {
+		return badRequest("invalid image alias name %q", req.Alias)
+	}
+	name, snapshot := req.Container, ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, snapshot = name[:i], name[i+1:]
+	}
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return containerError(name, "publish", err)
+	}
+	var backendSnapshot string
+	if snapshot != "" {
+		snap, err := dbSnapshot(d.db, rec.id, snapshot)
+		if err != nil {
+			return snapshotError(name, snapshot, "publish", err)
+		}
+		backendSnapshot = snap.backendName
+	}
+	if req.Alias != "" {
+		if _, err := dbImageAlias(d.db, req.Alias); err != errNoSuchImageAlias {
+			if err == nil {
+				err = errImageAliasExists
+			}
+			return imageError(req.Alias, "alias", err)
+		}
+	}
+	meta := d.publishMetadata(rec, req.Properties)
+
+	return d.startOperation(fmt.Sprintf("publish %s", req.Container), false, func(op *operation) (interface{}, error) {
+		image, err := d.publishImage(op, name, backendSnapshot, meta)
+		if err == errImageExists {
+			// Published before without changes since.
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot publish %q: %v", req.Container, err)
+		}
+		if req.Public {
+			err = dbImageSetPublic(d.db, image.Fingerprint, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if req.Alias != "" {
+			err = dbImageAliasCreate(d.db, &ImageAlias{Name: req.Alias, Target: image.Fingerprint})
+			if err != nil {
+				return nil, fmt.Errorf("cannot create image alias %q: %v", req.Alias, err)
+			}
+		}
+		return dbImage(d.db, image.Fingerprint)
+	})
+}
+
+// publishMetadata returns the metadata of an image published from the
+// container recorded in rec, with the provided properties.
+func (d *Daemon) publishMetadata(rec *containerRecord, properties map[string]string) *imageMetadata {
+	meta := &imageMetadata{
+		CreationDate: time.Now().Unix(),
+		Properties:   make(map[string]string),
+	}
+	if source, err := dbImage(d.db, rec.source); err == nil && source.Fingerprint == rec.source {
+		meta.Architecture = source.Architecture
+		for _, key := range []string{"os", "release"} {
+			if value, ok := source.Properties[key]; ok {
+				meta.Properties[key] = value
+			}
+		}
+	} else if fields := strings.Split(rec.source, "/"); len(fields) == 3 {
+		// Downloaded by LXC as distro/release/arch.
+		meta.Properties["os"] = fields[0]
+		meta.Properties["release"] = fields[1]
+		meta.Architecture = fields[2]
+	}
+	if meta.Architecture == "" {
+		meta.Architecture = hostArchitecture()
+	}
+	for key, value := range properties {
+		meta.Properties[key] = value
+	}
+	return meta
+}
+
+// hostArchitecture returns the architecture of the host, as named by the
+// kernel.
+func hostArchitecture() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7l"
+	}
+	return runtime.GOARCH
+}
+
+// publishImage adds to the store an image with the provided metadata,
+// made of the root filesystem of the named container, or of its snapshot
+// if snapshot isn't empty. The container is stopped while it's packed, if
+// it's running and no snapshot is packed.
+func (d *Daemon) publishImage(op *operation, name string, snapshot string, meta *imageMetadata) (*ImageInfo, error) {
+	if snapshot == "" {
+		restart, err := d.stopForChange(op, name)
+		if err != nil {
+			return nil, err
+		}
+		defer restart()
+	}
+
+	op.progress("packing root filesystem")
+	f, err := ioutil.TempFile(varPath("images"), ".publish_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	err = packImage(cw, meta, func(tw *tar.Writer) error {
+		return d.backend.PackRootfs(name, snapshot, tw)
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.addImage(f.Name(), hex.EncodeToString(h.Sum(nil)), cw.n, "")
+}
+
+// packImage writes into w a gzip-compressed image tarball with the
+// provided metadata, and the root filesystem written by pack.
+func packImage(w io.Writer, meta *imageMetadata, pack func(tw *tar.Writer) error) error {
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     "metadata.yaml",
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(meta.CreationDate, 0),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = pack(tw)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// packRootfs writes the root filesystem at dir into tw under rootfs/, with
+// the file owners shifted back out of the id map m, if it's not nil.
+// Sockets are left out.
+func packRootfs(tw *tar.Writer, dir string, m *idmap) error {
+	// Paths of files with several hard links, by inode.
+	links := make(map[uint64]string)
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return fmt.Errorf("cannot pack %s: %v", path, err)
+		}
+		hdr.Name = "rootfs/" + filepath.ToSlash(rel)
+		if rel == "." {
+			hdr.Name = "rootfs"
+		}
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot find owner of %s", path)
+		}
+		uid, gid := int64(st.Uid), int64(st.Gid)
+		if m != nil {
+			uid, gid, err = m.unshiftIDs(uid, gid)
+			if err != nil {
+				return fmt.Errorf("%s is owned by %d:%d, outside of the id map", path, st.Uid, st.Gid)
+			}
+		}
+		hdr.Uid, hdr.Gid = int(uid), int(gid)
+		hdr.Uname, hdr.Gname = "", ""
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if target, ok := links[uint64(st.Ino)]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, target, 0
+			} else {
+				links[uint64(st.Ino)] = hdr.Name
+			}
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || hdr.Typeflag != tar.TypeReg {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (d *Daemon) imageGet(r *http.Request) response {
+	ref := imageRef(r)
+	image, err := d.visibleImage(r, ref)
+	if err != nil {
+		return imageError(ref, "inspect", err)
+	}
+	return &syncResponse{image}
+}
+
+type imagePutReq struct {
+	Public bool `json:"public"`
+}
+
+// imagePut changes whether an image is public.
+func (d *Daemon) imagePut(r *http.Request) response {
+	ref := imageRef(r)
+	var req imagePutReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if !fingerprintExp.MatchString(ref) {
+		return notFound("image %q not found", ref)
+	}
+	image, err := dbImage(d.db, ref)
+	if err == nil {
+		err = dbImageSetPublic(d.db, image.Fingerprint, req.Public)
+	}
+	if err != nil {
+		return imageError(ref, "change", err)
+	}
+	return emptySyncResponse
+}
+
+// imageExport serves the tarball of an image, named after its fingerprint
+// and compression, with the fingerprint in the X-Flex-Fingerprint header.
+func (d *Daemon) imageExport(r *http.Request) response {
+	ref := strings.TrimSuffix(imageRef(r), "/export")
+	image, err := d.visibleImage(r, ref)
+	if err != nil {
+		return imageError(ref, "export", err)
+	}
+	path := imagePath(image.Fingerprint)
+	ext, err := imageExtension(path)
+	if err != nil {
+		return internalError("cannot read image %q: %v", ref, err)
+	}
+	return &fileResponse{
+		req:      r,
+		path:     path,
+		filename: image.Fingerprint + ext,
+		headers:  map[string]string{"X-Flex-Fingerprint": image.Fingerprint},
+	}
+}
+
+// imageExtension returns the file name extension suitable for the image
+// tarball at path, based on its compression.
+func imageExtension(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 6)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return ".tar.gz", nil
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return ".tar.xz", nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return ".tar.bz2", nil
+	}
+	return ".tar", nil
+}
+
+func (d *Daemon) imageDelete(r *http.Request) response {
+	ref := imageRef(r)
+	if !fingerprintExp.MatchString(ref) {
+		return notFound("image %q not found", ref)
+	}
+	image, err := dbImage(d.db, ref)
+	if err != nil {
+		return imageError(ref, "delete", err)
+	}
+	err = dbImageDelete(d.db, image.Fingerprint)
+	if err != nil {
+		return imageError(ref, "delete", err)
+	}
+	err = os.Remove(imagePath(image.Fingerprint))
+	if err != nil && !os.IsNotExist(err) {
+		return internalError("cannot remove image file: %v", err)
+	}
+	return emptySyncResponse
+}
+
+func (d *Daemon) imageAliasesGet(r *http.Request) response {
+	aliases, err := dbImageAliases(d.db)
+	if err != nil {
+		return internalError("cannot list image aliases: %v", err)
+	}
+	if d.isTrusted(r) {
+		return &syncResponse{aliases}
+	}
+	result := []*ImageAlias{}
+	for _, alias := range aliases {
+		image, err := dbImage(d.db, alias.Target)
+		if err == errNoSuchImage {
+			// Deleted meanwhile.
+			continue
+		}
+		if err != nil {
+			return imageError(alias.Target, "inspect", err)
+		}
+		if image.Public {
+			result = append(result, alias)
+		}
+	}
+	return &syncResponse{result}
+}
+
+// imageAliasesPost creates an alias, whose target may be an abbreviated
+// fingerprint.
+func (d *Daemon) imageAliasesPost(r *http.Request) response {
+	var req ImageAlias
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if req.Name == "" {
+		return badRequest("missing image alias name")
+	}
+	if strings.Contains(req.Name, ":") {
+		return badRequest("invalid image alias name %q", req.Name)
+	}
+	if !fingerprintExp.MatchString(req.Target) {
+		return notFound("image %q not found", req.Target)
+	}
+	image, err := dbImage(d.db, req.Target)
+	if err != nil {
+		return imageError(req.Target, "alias", err)
+	}
+	req.Target = image.Fingerprint
+	err = dbImageAliasCreate(d.db, &req)
+	if err == errImageAliasExists {
+		return imageError(req.Name, "alias", err)
+	}
+	if err != nil {
+		return imageError(req.Target, "alias", err)
+	}
+	return emptySyncResponse
+}
+
+func (d *Daemon) imageAliasGet(r *http.Request) response {
+	name := strings.TrimPrefix(imageRef(r), "aliases/")
+	alias, err := dbImageAlias(d.db, name)
+	if err == nil && !d.isTrusted(r) {
+		var image *ImageInfo
+		image, err = dbImage(d.db, alias.Target)
+		if err == nil && !image.Public {
+			err = errNoSuchImageAlias
+		}
+	}
+	if err != nil {
+		return imageError(name, "inspect alias of", err)
+	}
+	return &syncResponse{alias}
+}
+
+func (d *Daemon) imageAliasDelete(r *http.Request) response {
+	name := strings.TrimPrefix(imageRef(r), "aliases/")
+	err := dbImageAliasDelete(d.db, name)
+	if err != nil {
+		return imageError(name, "delete alias of", err)
+	}
+	return emptySyncResponse
+}
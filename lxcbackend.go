@@ -0,0 +1,558 @@
+package flex
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// lxcBackend manages containers through liblxc.
+type lxcBackend struct {
+	lxcpath string
+	id_map  *idmap
+}
+
+func newLXCBackend(lxcpath string) (*lxcBackend, error) {
+	m, err := newIdmap()
+	if err != nil {
+		return nil, err
+	}
+	Debugf("idmap is %d %d %d %d\n",
+		m.uidmin,
+		m.uidrange,
+		m.gidmin,
+		m.gidrange)
+	return &lxcBackend{lxcpath: lxcpath, id_map: m}, nil
+}
+
+// container returns the named container, which must be defined.
+func (b *lxcBackend) container(name string) (*lxc.Container, error) {
+	c, err := lxc.NewContainer(name, b.lxcpath)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Defined() {
+		return nil, ErrNoSuchContainer
+	}
+	return c, nil
+}
+
+func (b *lxcBackend) Create(name string, opts CreateOptions) error {
+	c, err := lxc.NewContainer(name, b.lxcpath)
+	if err != nil {
+		return err
+	}
+	if c.Defined() {
+		return ErrContainerExists
+	}
+
+	/*
+	 * Set the id mapping. This may not be how we want to do it, but it's a
+	 * start.  First, we remove any id_map lines in the config which might
+	 * have come from ~/.config/lxc/default.conf.  Then add id mapping based
+	 * on Domain.id_map
+	 */
+	if b.id_map != nil {
+		Debugf("setting custom idmap")
+		err = c.SetConfigItem("lxc.id_map", "")
+		if err != nil {
+			Debugf("cannot clear id mapping, continuing: %v", err)
+		}
+		uidstr := fmt.Sprintf("u 0 %d %d\n", b.id_map.uidmin, b.id_map.uidrange)
+		Debugf("uidstr is %s\n", uidstr)
+		err = c.SetConfigItem("lxc.id_map", uidstr)
+		if err != nil {
+			return fmt.Errorf("cannot set uid mapping: %v", err)
+		}
+		gidstr := fmt.Sprintf("g 0 %d %d\n", b.id_map.gidmin, b.id_map.gidrange)
+		err = c.SetConfigItem("lxc.id_map", gidstr)
+		if err != nil {
+			return fmt.Errorf("cannot set gid mapping: %v", err)
+		}
+	}
+
+	if opts.Image != "" {
+		return b.createFromImage(c, name, opts)
+	}
+
+	/*
+	 * Actually create the container
+	 */
+	return c.Create(lxc.TemplateOptions{
+		Template: "download",
+		Distro:   opts.Distro,
+		Release:  opts.Release,
+		Arch:     opts.Arch,
+	})
+}
+
+// createFromImage defines the container c, named name, with the root
+// filesystem unpacked from the image tarball in opts, shifted into the
+// id map of the backend.
+func (b *lxcBackend) createFromImage(c *lxc.Container, name string, opts CreateOptions) error {
+	dir := filepath.Join(b.lxcpath, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = b.unpackImage(c, dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+func (b *lxcBackend) unpackImage(c *lxc.Container, dir string, opts CreateOptions) error {
+	err := unpackImage(opts.Image, dir, c.Name())
+	if err != nil {
+		return err
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	if b.id_map != nil {
+		err = b.id_map.shiftTree(rootfs)
+		if err != nil {
+			return fmt.Errorf("cannot shift root filesystem: %v", err)
+		}
+	}
+	items := [][2]string{
+		{"lxc.rootfs", rootfs},
+		{"lxc.utsname", c.Name()},
+	}
+	if opts.Arch != "" {
+		items = append(items, [2]string{"lxc.arch", opts.Arch})
+	}
+	// Use the configuration LXC ships for the distribution, if any.
+	includes := []string{"common"}
+	if b.id_map != nil {
+		includes = append(includes, "userns")
+	}
+	for _, include := range includes {
+		path := fmt.Sprintf("/usr/share/lxc/config/%s.%s.conf", opts.Distro, include)
+		if _, err := os.Stat(path); err != nil || opts.Distro == "" {
+			continue
+		}
+		items = append(items, [2]string{"lxc.include", path})
+	}
+	for _, item := range items {
+		err := c.SetConfigItem(item[0], item[1])
+		if err != nil {
+			return fmt.Errorf("cannot set %s: %v", item[0], err)
+		}
+	}
+	return c.SaveConfigFile(filepath.Join(dir, "config"))
+}
+
+func (b *lxcBackend) Start(name string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	return c.Start()
+}
+
+func (b *lxcBackend) Stop(name string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	return c.Stop()
+}
+
+func (b *lxcBackend) Reboot(name string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	return c.Reboot()
+}
+
+func (b *lxcBackend) Destroy(name string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if state := c.State(); state != lxc.STOPPED {
+		return fmt.Errorf("container is %s", strings.ToLower(state.String()))
+	}
+	// LXC refuses to destroy containers with snapshots.
+	snapshots, err := c.Snapshots()
+	if err != nil && err != lxc.ErrNoSnapshot {
+		return err
+	}
+	for _, s := range snapshots {
+		err := c.DestroySnapshot(s)
+		if err != nil {
+			return fmt.Errorf("cannot destroy snapshot %s: %v", s.Name, err)
+		}
+	}
+	return c.Destroy()
+}
+
+// RuntimeState gathers the details of running containers from LXC and
+// their cgroups. Interfaces without addresses are left out.
+func (b *lxcBackend) RuntimeState(name string) (*ContainerState, error) {
+	c, err := b.container(name)
+	if err != nil {
+		return nil, err
+	}
+	state := &ContainerState{Status: c.State().String()}
+	if state.Status != "RUNNING" {
+		return state, nil
+	}
+	state.InitPID = c.InitPid()
+	ifaces, err := c.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list interfaces: %v", err)
+	}
+	state.Addresses = make(map[string][]string)
+	for _, iface := range ifaces {
+		addrs, err := c.IPAddress(iface)
+		if err == nil && len(addrs) > 0 {
+			state.Addresses[iface] = addrs
+		}
+	}
+	// The host may lack the memory or cpuacct cgroup controllers, which
+	// shouldn't keep the rest of the state from being reported.
+	memory, err := c.MemoryUsage()
+	if err != nil {
+		Logf("cannot get memory usage of container %q: %v", name, err)
+	} else {
+		state.MemoryUsage = uint64(memory)
+	}
+	state.CPUTime, err = c.CPUTime()
+	if err != nil {
+		Logf("cannot get CPU time of container %q: %v", name, err)
+		state.CPUTime = 0
+	}
+	for _, task := range c.CgroupItem("tasks") {
+		if task != "" {
+			state.Processes++
+		}
+	}
+	state.StartedAt, err = processStartTime(state.InitPID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get start time: %v", err)
+	}
+	return state, nil
+}
+
+// clockTicks is the number of clock ticks per second used in /proc, which
+// is fixed on the architectures LXC supports.
+const clockTicks = 100
+
+// processStartTime returns when the process with the provided id started.
+func processStartTime(pid int) (time.Time, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The command name may hold spaces, but is followed by the last ')'.
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("cannot parse /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse /proc/%d/stat", pid)
+	}
+	data, err = ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			btime, err := strconv.ParseInt(strings.TrimPrefix(line, "btime "), 10, 64)
+			if err != nil {
+				break
+			}
+			return time.Unix(btime, 0).Add(time.Duration(ticks) * time.Second / clockTicks), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot find boot time in /proc/stat")
+}
+
+// Configure renders the configuration into a file of its own next to the
+// LXC configuration of the container, which includes it. That leaves
+// alone whatever else is in the LXC configuration, such as the network
+// set up by the template.
+func (b *lxcBackend) Configure(name string, config map[string]string, devices map[string]Device) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	items, err := lxcConfigItems(config, devices)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by flex from the container configuration. Do not edit.\n")
+	for _, item := range items {
+		fmt.Fprintf(&buf, "%s = %s\n", item[0], item[1])
+	}
+	path := filepath.Join(b.lxcpath, name, "flex.conf")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	for _, include := range c.ConfigItem("lxc.include") {
+		if include == path {
+			return nil
+		}
+	}
+	err = c.SetConfigItem("lxc.include", path)
+	if err != nil {
+		return fmt.Errorf("cannot include %s: %v", path, err)
+	}
+	return c.SaveConfigFile(c.ConfigFileName())
+}
+
+// UpdateLimits lifts all limits and sets the requested ones again, as
+// there's no telling which of them the running container has. Failing to
+// lift a limit is not an error, as the host may lack some controllers,
+// such as the one for swap.
+func (b *lxcBackend) UpdateLimits(name string, config map[string]string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	items, err := cgroupLimits(config)
+	if err != nil {
+		return err
+	}
+	for _, item := range cgroupDefaults() {
+		err := c.SetCgroupItem(item[0], item[1])
+		if err != nil {
+			Debugf("cannot reset %s of container %q: %v", item[0], name, err)
+		}
+	}
+	for _, item := range items {
+		err := c.SetCgroupItem(item[0], item[1])
+		if err != nil {
+			return fmt.Errorf("cannot set %s: %v", item[0], err)
+		}
+	}
+	return nil
+}
+
+// AddDevice supports adding unix devices and physical network interfaces
+// to running containers.
+func (b *lxcBackend) AddDevice(name string, devname string, dev Device) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dev["type"] == "unix-char" || dev["type"] == "unix-block":
+		return c.AddDeviceNode(deviceSource(dev), dev["path"])
+	case dev["type"] == "nic" && dev["nictype"] == "physical":
+		target := dev["name"]
+		if target == "" {
+			target = dev["parent"]
+		}
+		return c.AttachInterface(dev["parent"], target)
+	}
+	return ErrHotplugUnsupported
+}
+
+func (b *lxcBackend) RemoveDevice(name string, devname string, dev Device) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dev["type"] == "unix-char" || dev["type"] == "unix-block":
+		return c.RemoveDeviceNode(deviceSource(dev), dev["path"])
+	case dev["type"] == "nic" && dev["nictype"] == "physical":
+		target := dev["name"]
+		if target == "" {
+			target = dev["parent"]
+		}
+		return c.DetachInterface(target)
+	}
+	return ErrHotplugUnsupported
+}
+
+func (b *lxcBackend) List() ([]string, error) {
+	c := lxc.DefinedContainers(b.lxcpath)
+	names := make([]string, 0, len(c))
+	for i := range c {
+		names = append(names, c[i].Name())
+	}
+	return names, nil
+}
+
+func (b *lxcBackend) State(name string) (string, error) {
+	c, err := b.container(name)
+	if err != nil {
+		return "", err
+	}
+	return c.State().String(), nil
+}
+
+func (b *lxcBackend) Attach(name string, argv []string, opts AttachOptions) (int, error) {
+	c, err := b.container(name)
+	if err != nil {
+		return -1, err
+	}
+
+	options := lxc.DefaultAttachOptions
+
+	options.StdinFd = opts.Stdin.Fd()
+	options.StdoutFd = opts.Stdout.Fd()
+	options.StderrFd = opts.Stderr.Fd()
+
+	options.ClearEnv = true
+	options.Env = opts.Env
+	if opts.Cwd != "" {
+		options.Cwd = opts.Cwd
+	}
+
+	// The attached process is a child of the daemon, so it may be
+	// waited on and signalled directly.
+	pid, err := c.RunCommandNoWait(argv, options)
+	if err != nil {
+		return -1, err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return -1, err
+	}
+	var state *os.ProcessState
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		state, err = proc.Wait()
+		done <- err
+	}()
+	for {
+		select {
+		case sig := <-opts.Signals:
+			err := proc.Signal(sig)
+			if err != nil {
+				Debugf("cannot send %v to process %d: %v", sig, pid, err)
+			}
+		case err := <-done:
+			if err != nil {
+				return -1, err
+			}
+			status := state.Sys().(syscall.WaitStatus)
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+}
+
+func (b *lxcBackend) PackRootfs(name string, snapshot string, tw *tar.Writer) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if snapshot != "" {
+		s, err := b.snapshot(c, snapshot)
+		if err != nil {
+			return err
+		}
+		// Snapshots are containers themselves, kept elsewhere.
+		c, err = lxc.NewContainer(s.Name, s.Path)
+		if err != nil {
+			return err
+		}
+	} else if state := c.State(); state != lxc.STOPPED {
+		return fmt.Errorf("container is %s", strings.ToLower(state.String()))
+	}
+	var rootfs string
+	if items := c.ConfigItem("lxc.rootfs"); len(items) > 0 {
+		rootfs = strings.TrimPrefix(items[0], "dir:")
+	}
+	if fi, err := os.Stat(rootfs); err != nil || !fi.IsDir() {
+		return fmt.Errorf("unsupported root filesystem: %q", rootfs)
+	}
+	return packRootfs(tw, rootfs, b.id_map)
+}
+
+// snapshot returns the named snapshot of c.
+func (b *lxcBackend) snapshot(c *lxc.Container, snapshot string) (*lxc.Snapshot, error) {
+	snapshots, err := c.Snapshots()
+	if err == lxc.ErrNoSnapshot {
+		return nil, ErrNoSuchSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		if snapshots[i].Name == snapshot {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, ErrNoSuchSnapshot
+}
+
+func (b *lxcBackend) Snapshot(name string) (string, error) {
+	c, err := b.container(name)
+	if err != nil {
+		return "", err
+	}
+	if state := c.State(); state != lxc.STOPPED {
+		return "", fmt.Errorf("container is %s", strings.ToLower(state.String()))
+	}
+	s, err := c.CreateSnapshot()
+	if err != nil {
+		return "", err
+	}
+	return s.Name, nil
+}
+
+func (b *lxcBackend) RestoreSnapshot(name string, snapshot string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if state := c.State(); state != lxc.STOPPED {
+		return fmt.Errorf("container is %s", strings.ToLower(state.String()))
+	}
+	s, err := b.snapshot(c, snapshot)
+	if err != nil {
+		return err
+	}
+	// Restoring under the same name replaces the container.
+	return c.RestoreSnapshot(*s, name)
+}
+
+func (b *lxcBackend) DeleteSnapshot(name string, snapshot string) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	s, err := b.snapshot(c, snapshot)
+	if err != nil {
+		return err
+	}
+	return c.DestroySnapshot(*s)
+}
+
+func (b *lxcBackend) Checkpoint(name string, dir string, stop bool, verbose bool) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	return c.Checkpoint(lxc.CheckpointOpts{Directory: dir, Stop: stop, Verbose: verbose})
+}
+
+func (b *lxcBackend) Restore(name string, dir string, verbose bool) error {
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	return c.Restore(lxc.RestoreOpts{Directory: dir, Verbose: verbose})
+}
@@ -0,0 +1,213 @@
+package flex
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lxcConfigItems returns the LXC configuration items, as key and value
+// pairs, that implement the provided container configuration and devices.
+func lxcConfigItems(config map[string]string, devices map[string]Device) ([][2]string, error) {
+	var items [][2]string
+	limits, err := cgroupLimits(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range limits {
+		items = append(items, [2]string{"lxc.cgroup." + item[0], item[1]})
+	}
+	nesting, err := parseConfigBool(config["security.nesting"])
+	if err != nil {
+		return nil, err
+	}
+	if nesting {
+		items = append(items, [2]string{"lxc.aa_profile", "lxc-container-default-with-nesting"})
+	} else {
+		items = append(items, [2]string{"lxc.aa_profile", "lxc-container-default"})
+	}
+	env := containerEnv(config)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		items = append(items, [2]string{"lxc.environment", name + "=" + env[name]})
+	}
+	for _, name := range sortedDeviceNames(devices) {
+		ditems, err := lxcDeviceItems(devices[name])
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up device %q: %v", name, err)
+		}
+		items = append(items, ditems...)
+	}
+	return items, nil
+}
+
+// cgroupLimits returns the cgroup items, as key and value pairs, that
+// implement the limits.* keys in config. Items come in the order they must
+// be set, as the memory limit must not be above the memory and swap one.
+func cgroupLimits(config map[string]string) ([][2]string, error) {
+	var items [][2]string
+	if value := config["limits.cpu"]; value != "" {
+		cpus, err := parseCPULimit(value)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, [2]string{"cpuset.cpus", cpus})
+	}
+	if value := config["limits.cpu.allowance"]; value != "" {
+		shares, quota, period, err := parseCPUAllowance(value)
+		if err != nil {
+			return nil, err
+		}
+		if shares > 0 {
+			items = append(items, [2]string{"cpu.shares", strconv.Itoa(shares)})
+		} else {
+			items = append(items, [2]string{"cpu.cfs_period_us", strconv.Itoa(period)})
+			items = append(items, [2]string{"cpu.cfs_quota_us", strconv.Itoa(quota)})
+		}
+	}
+	memory := ""
+	if value := config["limits.memory"]; value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		memory = strconv.FormatUint(size, 10)
+		items = append(items, [2]string{"memory.limit_in_bytes", memory})
+	}
+	if value := config["limits.memory.swap"]; value != "" {
+		swap, err := parseConfigBool(value)
+		if err != nil {
+			return nil, err
+		}
+		if !swap {
+			items = append(items, [2]string{"memory.swappiness", "0"})
+			if memory != "" {
+				items = append(items, [2]string{"memory.memsw.limit_in_bytes", memory})
+			}
+		}
+	}
+	if value := config["limits.processes"]; value != "" {
+		items = append(items, [2]string{"pids.max", value})
+	}
+	if value := config["limits.disk.priority"]; value != "" {
+		if err := checkDiskPriority(value); err != nil {
+			return nil, err
+		}
+		priority, _ := strconv.Atoi(value)
+		// Weights go from 10 to 1000.
+		items = append(items, [2]string{"blkio.weight", strconv.Itoa(10 + priority*99)})
+	}
+	return items, nil
+}
+
+// cgroupDefaults returns the cgroup items that lift the limits set by
+// cgroupLimits, in the order they must be set.
+func cgroupDefaults() [][2]string {
+	cpus := "0"
+	if n := runtime.NumCPU(); n > 1 {
+		cpus = fmt.Sprintf("0-%d", n-1)
+	}
+	return [][2]string{
+		{"memory.memsw.limit_in_bytes", "-1"},
+		{"memory.limit_in_bytes", "-1"},
+		{"memory.swappiness", "60"},
+		{"cpuset.cpus", cpus},
+		{"cpu.shares", "1024"},
+		{"cpu.cfs_quota_us", "-1"},
+		{"cpu.cfs_period_us", "100000"},
+		{"pids.max", "max"},
+		{"blkio.weight", "500"},
+	}
+}
+
+// lxcDeviceItems returns the LXC configuration items that make dev
+// available to a container.
+func lxcDeviceItems(dev Device) ([][2]string, error) {
+	var items [][2]string
+	switch dev["type"] {
+	case "disk":
+		source := deviceSource(dev)
+		fi, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		opts := "bind,create=dir"
+		if !fi.IsDir() {
+			opts = "bind,create=file"
+		}
+		if ro, _ := parseConfigBool(dev["readonly"]); ro {
+			opts += ",ro"
+		}
+		items = append(items, [2]string{"lxc.mount.entry", lxcMountEntry(source, dev["path"], opts)})
+	case "nic":
+		types := map[string]string{"bridged": "veth", "macvlan": "macvlan", "physical": "phys"}
+		items = append(items, [2]string{"lxc.network.type", types[dev["nictype"]]})
+		items = append(items, [2]string{"lxc.network.link", dev["parent"]})
+		items = append(items, [2]string{"lxc.network.flags", "up"})
+		if dev["nictype"] == "macvlan" {
+			items = append(items, [2]string{"lxc.network.macvlan.mode", "bridge"})
+		}
+		for _, key := range []string{"name", "hwaddr", "mtu"} {
+			if dev[key] != "" {
+				items = append(items, [2]string{"lxc.network." + key, dev[key]})
+			}
+		}
+	case "unix-char", "unix-block":
+		major, minor, err := unixDeviceNumbers(dev)
+		if err != nil {
+			return nil, err
+		}
+		kind := "c"
+		if dev["type"] == "unix-block" {
+			kind = "b"
+		}
+		items = append(items, [2]string{"lxc.cgroup.devices.allow", fmt.Sprintf("%s %d:%d rwm", kind, major, minor)})
+		items = append(items, [2]string{"lxc.mount.entry", lxcMountEntry(deviceSource(dev), dev["path"], "bind,create=file")})
+	default:
+		return nil, fmt.Errorf("unknown device type %q", dev["type"])
+	}
+	return items, nil
+}
+
+// lxcMountEntry returns an lxc.mount.entry value which mounts source at
+// path, relative to the root of the container.
+func lxcMountEntry(source string, path string, opts string) string {
+	return fmt.Sprintf("%s %s none %s 0 0", source, strings.TrimPrefix(path, "/"), opts)
+}
+
+// unixDeviceNumbers returns the major and minor numbers of the unix device
+// dev, which default to those of the host device at its source.
+func unixDeviceNumbers(dev Device) (major int, minor int, err error) {
+	if dev["major"] == "" || dev["minor"] == "" {
+		var st syscall.Stat_t
+		source := deviceSource(dev)
+		err := syscall.Stat(source, &st)
+		if err != nil {
+			return 0, 0, &os.PathError{Op: "stat", Path: source, Err: err}
+		}
+		want := uint32(syscall.S_IFCHR)
+		if dev["type"] == "unix-block" {
+			want = syscall.S_IFBLK
+		}
+		if uint32(st.Mode)&syscall.S_IFMT != want {
+			return 0, 0, fmt.Errorf("%s is not a %s device", source, dev["type"])
+		}
+		major = int((st.Rdev >> 8) & 0xfff)
+		minor = int((st.Rdev & 0xff) | ((st.Rdev >> 12) & 0xfff00))
+	}
+	if dev["major"] != "" {
+		major, _ = strconv.Atoi(dev["major"])
+	}
+	if dev["minor"] != "" {
+		minor, _ = strconv.Atoi(dev["minor"])
+	}
+	return major, minor, nil
+}
@@ -0,0 +1,192 @@
+package flex_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/flex"
+)
+
+var _ = Suite(&LXCConfigSuite{})
+
+type LXCConfigSuite struct{}
+
+var cgroupLimitsTests = []struct {
+	config map[string]string
+	items  [][2]string
+	err    string
+}{{
+	config: map[string]string{},
+}, {
+	config: map[string]string{"limits.cpu": "1"},
+	items:  [][2]string{{"cpuset.cpus", "0"}},
+}, {
+	config: map[string]string{"limits.cpu": "4"},
+	items:  [][2]string{{"cpuset.cpus", "0-3"}},
+}, {
+	config: map[string]string{"limits.cpu": "0-1,6"},
+	items:  [][2]string{{"cpuset.cpus", "0-1,6"}},
+}, {
+	config: map[string]string{"limits.cpu.allowance": "100%"},
+	items:  [][2]string{{"cpu.shares", "1024"}},
+}, {
+	config: map[string]string{"limits.cpu.allowance": "50%"},
+	items:  [][2]string{{"cpu.shares", "512"}},
+}, {
+	config: map[string]string{"limits.cpu.allowance": "1%"},
+	items:  [][2]string{{"cpu.shares", "10"}},
+}, {
+	config: map[string]string{"limits.cpu.allowance": "50ms/200ms"},
+	items:  [][2]string{{"cpu.cfs_period_us", "200000"}, {"cpu.cfs_quota_us", "50000"}},
+}, {
+	config: map[string]string{"limits.cpu.allowance": "101%"},
+	err:    `"101%" is not a percentage between 1% and 100%`,
+}, {
+	config: map[string]string{"limits.memory": "256MiB"},
+	items:  [][2]string{{"memory.limit_in_bytes", "268435456"}},
+}, {
+	config: map[string]string{"limits.memory": "1GB", "limits.memory.swap": "false"},
+	items: [][2]string{
+		{"memory.limit_in_bytes", "1000000000"},
+		{"memory.swappiness", "0"},
+		{"memory.memsw.limit_in_bytes", "1000000000"},
+	},
+}, {
+	config: map[string]string{"limits.memory.swap": "false"},
+	items:  [][2]string{{"memory.swappiness", "0"}},
+}, {
+	config: map[string]string{"limits.memory": "1GB", "limits.memory.swap": "true"},
+	items:  [][2]string{{"memory.limit_in_bytes", "1000000000"}},
+}, {
+	config: map[string]string{"limits.memory": "lots"},
+	err:    `"lots" is not a size`,
+}, {
+	config: map[string]string{"limits.processes": "500"},
+	items:  [][2]string{{"pids.max", "500"}},
+}, {
+	config: map[string]string{"limits.disk.priority": "0"},
+	items:  [][2]string{{"blkio.weight", "10"}},
+}, {
+	config: map[string]string{"limits.disk.priority": "5"},
+	items:  [][2]string{{"blkio.weight", "505"}},
+}, {
+	config: map[string]string{"limits.disk.priority": "10"},
+	items:  [][2]string{{"blkio.weight", "1000"}},
+}, {
+	config: map[string]string{"limits.disk.priority": "100"},
+	err:    `"100" is not a priority between 0 and 10`,
+}, {
+	config: map[string]string{
+		"limits.cpu":           "2",
+		"limits.cpu.allowance": "25ms/100ms",
+		"limits.memory":        "512MiB",
+		"limits.memory.swap":   "no",
+		"limits.processes":     "100",
+		"limits.disk.priority": "1",
+	},
+	items: [][2]string{
+		{"cpuset.cpus", "0-1"},
+		{"cpu.cfs_period_us", "100000"},
+		{"cpu.cfs_quota_us", "25000"},
+		{"memory.limit_in_bytes", "536870912"},
+		{"memory.swappiness", "0"},
+		{"memory.memsw.limit_in_bytes", "536870912"},
+		{"pids.max", "100"},
+		{"blkio.weight", "109"},
+	},
+}}
+
+func (s *LXCConfigSuite) TestCgroupLimits(c *C) {
+	for _, test := range cgroupLimitsTests {
+		comment := Commentf("config: %v", test.config)
+		items, err := flex.CgroupLimits(test.config)
+		if test.err != "" {
+			c.Assert(err, ErrorMatches, test.err, comment)
+			continue
+		}
+		c.Assert(err, IsNil, comment)
+		c.Assert(items, DeepEquals, test.items, comment)
+	}
+}
+
+func (s *LXCConfigSuite) TestCgroupDefaults(c *C) {
+	// Every limit that may be set has a default to lift it.
+	defaults := make(map[string]string)
+	for _, item := range flex.CgroupDefaults() {
+		defaults[item[0]] = item[1]
+	}
+	for _, test := range cgroupLimitsTests {
+		for _, item := range test.items {
+			_, ok := defaults[item[0]]
+			c.Assert(ok, Equals, true, Commentf("no default for %s", item[0]))
+		}
+	}
+	cpus := "0"
+	if n := runtime.NumCPU(); n > 1 {
+		cpus = fmt.Sprintf("0-%d", n-1)
+	}
+	c.Assert(defaults["cpuset.cpus"], Equals, cpus)
+	c.Assert(defaults["blkio.weight"], Equals, "500")
+	c.Assert(defaults["cpu.shares"], Equals, "1024")
+	c.Assert(defaults["pids.max"], Equals, "max")
+
+	// The swap limit is lifted before the memory one, which it must not
+	// be below.
+	order := make(map[string]int)
+	for i, item := range flex.CgroupDefaults() {
+		order[item[0]] = i
+	}
+	c.Assert(order["memory.memsw.limit_in_bytes"] < order["memory.limit_in_bytes"], Equals, true)
+}
+
+func (s *LXCConfigSuite) TestLXCConfigItems(c *C) {
+	dir := c.MkDir()
+	file := filepath.Join(dir, "file")
+	err := ioutil.WriteFile(file, nil, 0644)
+	c.Assert(err, IsNil)
+
+	config := map[string]string{
+		"limits.memory":        "1GB",
+		"limits.disk.priority": "0",
+		"security.nesting":     "true",
+		"environment.B":        "2",
+		"environment.A":        "1",
+	}
+	devices := map[string]flex.Device{
+		"data":  {"type": "disk", "source": dir, "path": "/mnt/data", "readonly": "true"},
+		"file":  {"type": "disk", "source": file, "path": "/etc/file"},
+		"eth1":  {"type": "nic", "nictype": "macvlan", "parent": "eth0", "name": "eth1", "mtu": "1400"},
+		"fuse":  {"type": "unix-char", "path": "/dev/fuse", "major": "10", "minor": "229"},
+		"loop0": {"type": "unix-block", "path": "/dev/loop0", "major": "7", "minor": "0"},
+	}
+	items, err := flex.LXCConfigItems(config, devices)
+	c.Assert(err, IsNil)
+	c.Assert(items, DeepEquals, [][2]string{
+		{"lxc.cgroup.memory.limit_in_bytes", "1000000000"},
+		{"lxc.cgroup.blkio.weight", "10"},
+		{"lxc.aa_profile", "lxc-container-default-with-nesting"},
+		{"lxc.environment", "A=1"},
+		{"lxc.environment", "B=2"},
+		{"lxc.mount.entry", dir + " mnt/data none bind,create=dir,ro 0 0"},
+		{"lxc.network.type", "macvlan"},
+		{"lxc.network.link", "eth0"},
+		{"lxc.network.flags", "up"},
+		{"lxc.network.macvlan.mode", "bridge"},
+		{"lxc.network.name", "eth1"},
+		{"lxc.network.mtu", "1400"},
+		{"lxc.mount.entry", file + " etc/file none bind,create=file 0 0"},
+		{"lxc.cgroup.devices.allow", "c 10:229 rwm"},
+		{"lxc.mount.entry", "/dev/fuse dev/fuse none bind,create=file 0 0"},
+		{"lxc.cgroup.devices.allow", "b 7:0 rwm"},
+		{"lxc.mount.entry", "/dev/loop0 dev/loop0 none bind,create=file 0 0"},
+	})
+
+	_, err = flex.LXCConfigItems(nil, map[string]flex.Device{"missing": {"type": "disk", "source": filepath.Join(dir, "missing"), "path": "/mnt"}})
+	c.Assert(err, ErrorMatches, `cannot set up device "missing": stat .*/missing: no such file or directory`)
+	_, err = flex.LXCConfigItems(map[string]string{"limits.disk.priority": "100"}, nil)
+	c.Assert(err, ErrorMatches, `"100" is not a priority between 0 and 10`)
+}
@@ -0,0 +1,363 @@
+package flex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// OperationStatus defines the progress of a background operation.
+type OperationStatus string
+
+const (
+	OperationRunning   OperationStatus = "running"
+	OperationSuccess   OperationStatus = "success"
+	OperationFailure   OperationStatus = "failure"
+	OperationCancelled OperationStatus = "cancelled"
+)
+
+// Operation describes an action being performed by the daemon in the
+// background. It's returned as the metadata of async responses and by
+// the /1.0/operations API.
+type Operation struct {
+	ID          string          `json:"id"`
+	Description string          `json:"description"`
+	Status      OperationStatus `json:"status"`
+	Progress    string          `json:"progress,omitempty"`
+	MayCancel   bool            `json:"may_cancel"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+
+	// Metadata holds the result of a successful operation. While the
+	// operation is running it may hold details for interacting with it,
+	// such as the secrets for connecting to its websockets.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	// Error holds the reason for a failed operation.
+	Error string `json:"error,omitempty"`
+}
+
+// Done returns whether the operation has finished, successfully or not.
+func (op *Operation) Done() bool {
+	return op.Status != OperationRunning
+}
+
+// Result unmarshals the result of a successful operation into v.
+func (op *Operation) Result(v interface{}) error {
+	if op.Status != OperationSuccess {
+		return fmt.Errorf("operation %s has no result: %s", op.ID, op.Status)
+	}
+	if len(op.Metadata) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(op.Metadata, v)
+	if err != nil {
+		return fmt.Errorf("cannot parse operation result: %v", err)
+	}
+	return nil
+}
+
+// operationExpiry defines for how long finished operations are kept around
+// so that clients may learn about their outcome.
+var operationExpiry = 5 * time.Minute
+
+var errCancelled = errors.New("operation cancelled")
+
+// operation is the daemon side of a background operation.
+type operation struct {
+	tomb   tomb.Tomb
+	events *eventHub
+
+	// sockets accepts the websocket connections for the operation, if
+	// it has any.
+	sockets websocketHandler
+
+	mu  sync.Mutex
+	doc Operation
+}
+
+// progress updates the progress message reported to clients.
+func (op *operation) progress(format string, args ...interface{}) {
+	op.mu.Lock()
+	op.doc.Progress = fmt.Sprintf(format, args...)
+	op.doc.UpdatedAt = time.Now().UTC()
+	op.mu.Unlock()
+	op.events.publish("operation", op.snapshot())
+}
+
+// dying returns a channel that is closed when the operation is cancelled.
+func (op *operation) dying() <-chan struct{} {
+	return op.tomb.Dying()
+}
+
+// context returns a context which is cancelled along with the operation,
+// and a function releasing it once no longer needed.
+func (op *operation) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-op.dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (op *operation) finish(result interface{}, err error) {
+	op.mu.Lock()
+	defer func() {
+		op.mu.Unlock()
+		op.events.publish("operation", op.snapshot())
+	}()
+	op.doc.UpdatedAt = time.Now().UTC()
+	op.doc.MayCancel = false
+	op.doc.Metadata = nil
+	if err == nil && result != nil {
+		data, merr := json.Marshal(result)
+		if merr != nil {
+			err = fmt.Errorf("cannot marshal operation result: %v", merr)
+		}
+		op.doc.Metadata = data
+	}
+	switch {
+	case err == nil:
+		op.doc.Status = OperationSuccess
+	case !op.tomb.Alive():
+		op.doc.Status = OperationCancelled
+		op.doc.Error = err.Error()
+	default:
+		op.doc.Status = OperationFailure
+		op.doc.Error = err.Error()
+	}
+}
+
+// snapshot returns a copy of the operation document.
+func (op *operation) snapshot() *Operation {
+	op.mu.Lock()
+	doc := op.doc
+	op.mu.Unlock()
+	return &doc
+}
+
+func newOperationID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startOperation runs f in the background as a new operation, and returns
+// the async response which refers the client to it. If mayCancel is true,
+// clients may cancel the operation, in which case the channel returned by
+// op.dying is closed and f is expected to return as soon as possible.
+func (d *Daemon) startOperation(description string, mayCancel bool, f func(op *operation) (interface{}, error)) response {
+	op, err := d.newOperation(description, mayCancel)
+	if err != nil {
+		return internalError("%v", err)
+	}
+	return d.runOperation(op, f)
+}
+
+// newOperation returns a new operation, which is only made visible to
+// clients once it's started by runOperation.
+func (d *Daemon) newOperation(description string, mayCancel bool) (*operation, error) {
+	id, err := newOperationID()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate operation id: %v", err)
+	}
+	now := time.Now().UTC()
+	op := &operation{events: d.events, doc: Operation{
+		ID:          id,
+		Description: description,
+		Status:      OperationRunning,
+		MayCancel:   mayCancel,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}}
+	return op, nil
+}
+
+// runOperation runs f in the background on behalf of op, as documented
+// in startOperation.
+func (d *Daemon) runOperation(op *operation, f func(op *operation) (interface{}, error)) response {
+	id := op.doc.ID
+	description := op.doc.Description
+
+	d.opsMu.Lock()
+	d.ops[id] = op
+	d.opsMu.Unlock()
+	d.events.publish("operation", op.snapshot())
+
+	op.tomb.Go(func() error {
+		result, err := f(op)
+		op.finish(result, err)
+		Debugf("operation %s (%s) finished: %s", id, description, op.snapshot().Status)
+		time.AfterFunc(operationExpiry, func() {
+			d.opsMu.Lock()
+			delete(d.ops, id)
+			d.opsMu.Unlock()
+		})
+		return nil
+	})
+	return &asyncResponse{op.snapshot()}
+}
+
+// stopOperations interrupts all running operations, and waits for them
+// to finish.
+func (d *Daemon) stopOperations() {
+	d.opsMu.Lock()
+	ops := make([]*operation, 0, len(d.ops))
+	for _, op := range d.ops {
+		ops = append(ops, op)
+	}
+	d.opsMu.Unlock()
+	for _, op := range ops {
+		op.tomb.Kill(errStop)
+	}
+	for _, op := range ops {
+		op.tomb.Wait()
+	}
+}
+
+type asyncResponse struct {
+	op *Operation
+}
+
+func (r *asyncResponse) render(w http.ResponseWriter) error {
+	w.Header().Set("Location", "/1.0/operations/"+r.op.ID)
+	return writeResponse(w, http.StatusAccepted, AsyncResponse, r.op, "")
+}
+
+// runCommand runs cmd on behalf of op, killing it if the operation is
+// cancelled meanwhile.
+func runCommand(op *operation, cmd *exec.Cmd) error {
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		return err
+	case <-op.dying():
+		cmd.Process.Kill()
+		<-done
+		return errCancelled
+	}
+}
+
+func (d *Daemon) operation(r *http.Request) (*operation, string, response) {
+	elems := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/1.0/operations/"), "/", 2)
+	d.opsMu.Lock()
+	op, ok := d.ops[elems[0]]
+	d.opsMu.Unlock()
+	if !ok {
+		return nil, "", notFound("operation %q not found", elems[0])
+	}
+	if len(elems) == 2 {
+		return op, elems[1], nil
+	}
+	return op, "", nil
+}
+
+func (d *Daemon) serveOperations(r *http.Request) response {
+	res := &resource{get: d.operationsGet}
+	return res.serve(r)
+}
+
+// serveOperation serves the resources under /1.0/operations/<id>.
+func (d *Daemon) serveOperation(r *http.Request) response {
+	_, sub, errResp := d.operation(r)
+	if errResp != nil {
+		return errResp
+	}
+	var res *resource
+	switch sub {
+	case "":
+		res = &resource{get: d.operationGet, delete: d.operationDelete}
+	case "wait":
+		res = &resource{get: d.operationWait}
+	case "websocket":
+		res = &resource{get: d.operationWebsocket}
+	default:
+		return notFound("unknown operation resource %q", sub)
+	}
+	return res.serve(r)
+}
+
+func (d *Daemon) operationsGet(r *http.Request) response {
+	d.opsMu.Lock()
+	result := make([]*Operation, 0, len(d.ops))
+	for _, op := range d.ops {
+		result = append(result, op.snapshot())
+	}
+	d.opsMu.Unlock()
+	return &syncResponse{result}
+}
+
+func (d *Daemon) operationGet(r *http.Request) response {
+	op, _, errResp := d.operation(r)
+	if errResp != nil {
+		return errResp
+	}
+	return &syncResponse{op.snapshot()}
+}
+
+func (d *Daemon) operationDelete(r *http.Request) response {
+	op, _, errResp := d.operation(r)
+	if errResp != nil {
+		return errResp
+	}
+	doc := op.snapshot()
+	if !doc.MayCancel {
+		return errorf(http.StatusConflict, "operation %s cannot be cancelled", doc.ID)
+	}
+	op.tomb.Kill(errCancelled)
+	return emptySyncResponse
+}
+
+// operationWait blocks until the operation finishes or the number of seconds
+// in the timeout parameter elapses. A negative or missing timeout waits
+// until the operation finishes.
+func (d *Daemon) operationWait(r *http.Request) response {
+	op, _, errResp := d.operation(r)
+	if errResp != nil {
+		return errResp
+	}
+	timeout := -1
+	if s := r.FormValue("timeout"); s != "" {
+		var err error
+		timeout, err = strconv.Atoi(s)
+		if err != nil {
+			return badRequest("invalid timeout %q", s)
+		}
+	}
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		expired = time.After(time.Duration(timeout) * time.Second)
+	}
+	// Give up early if the client goes away or the daemon is stopping,
+	// rather than holding on to the handler until the operation ends.
+	select {
+	case <-op.tomb.Dead():
+	case <-expired:
+	case <-r.Context().Done():
+	case <-d.tomb.Dying():
+	}
+	return &syncResponse{op.snapshot()}
+}
@@ -0,0 +1,198 @@
+package flex
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ProfileInfo describes a configuration profile, which may be applied to
+// containers to share configuration and devices among them.
+type ProfileInfo struct {
+	Name    string            `json:"name"`
+	Config  map[string]string `json:"config"`
+	Devices map[string]Device `json:"devices"`
+}
+
+// defaultProfiles holds the profiles applied to containers created without
+// any profiles being requested.
+var defaultProfiles = []string{"default"}
+
+// expandConfig returns the configuration resulting from applying the
+// provided profile configurations in order, followed by local, with later
+// values for a key taking precedence over earlier ones.
+func expandConfig(profiles []map[string]string, local map[string]string) map[string]string {
+	expanded := make(map[string]string)
+	for _, config := range append(profiles, local) {
+		for k, v := range config {
+			expanded[k] = v
+		}
+	}
+	return expanded
+}
+
+// profileError returns the error response appropriate for err, which was
+// obtained from the database while trying to perform action on the named
+// profile.
+func profileError(name string, action string, err error) response {
+	switch err {
+	case errNoSuchProfile:
+		return notFound("profile %q not found", name)
+	case errProfileExists:
+		return errorf(http.StatusConflict, "profile %q already exists", name)
+	case errProfileInUse:
+		return errorf(http.StatusConflict, "profile %q is used by containers", name)
+	}
+	return internalError("cannot %s profile %q: %v", action, name, err)
+}
+
+// checkProfiles returns an error response if any of the named profiles
+// doesn't exist or is repeated, and nil otherwise.
+func (d *Daemon) checkProfiles(names []string) response {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return badRequest("profile %q applied more than once", name)
+		}
+		seen[name] = true
+		_, err := dbProfile(d.db, name)
+		if err == errNoSuchProfile {
+			return badRequest("profile %q not found", name)
+		}
+		if err != nil {
+			return profileError(name, "inspect", err)
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) serveProfiles(r *http.Request) response {
+	res := &resource{
+		get:  d.profilesGet,
+		post: d.profilesPost,
+	}
+	return res.serve(r)
+}
+
+// serveProfile serves /1.0/profiles/<name>.
+func (d *Daemon) serveProfile(r *http.Request) response {
+	res := &resource{
+		get:    d.profileGet,
+		put:    d.profilePut,
+		delete: d.profileDelete,
+	}
+	return res.serve(r)
+}
+
+func profilePath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/1.0/profiles/")
+}
+
+func (d *Daemon) profilesGet(r *http.Request) response {
+	names, err := dbProfiles(d.db)
+	if err != nil {
+		return internalError("cannot list profiles: %v", err)
+	}
+	result := make([]*ProfileInfo, 0, len(names))
+	for _, name := range names {
+		profile, err := dbProfile(d.db, name)
+		if err == errNoSuchProfile {
+			// Deleted meanwhile.
+			continue
+		}
+		if err != nil {
+			return profileError(name, "inspect", err)
+		}
+		result = append(result, profile)
+	}
+	return &syncResponse{result}
+}
+
+func (d *Daemon) profilesPost(r *http.Request) response {
+	var req ProfileInfo
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if req.Name == "" {
+		return badRequest("missing profile name")
+	}
+	if strings.ContainsAny(req.Name, "/,") {
+		return badRequest("invalid profile name %q", req.Name)
+	}
+	if err := checkContainerConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := checkDevices(req.Devices); err != nil {
+		return badRequest("%v", err)
+	}
+	err := dbProfileCreate(d.db, req.Name, req.Config, req.Devices)
+	if err != nil {
+		return profileError(req.Name, "create", err)
+	}
+	return emptySyncResponse
+}
+
+func (d *Daemon) profileGet(r *http.Request) response {
+	name := profilePath(r)
+	profile, err := dbProfile(d.db, name)
+	if err != nil {
+		return profileError(name, "inspect", err)
+	}
+	return &syncResponse{profile}
+}
+
+// profilePutReq holds the new configuration and devices of a profile.
+// Those left out are not changed.
+type profilePutReq struct {
+	Config  map[string]string `json:"config"`
+	Devices map[string]Device `json:"devices"`
+}
+
+func (d *Daemon) profilePut(r *http.Request) response {
+	name := profilePath(r)
+	var req profilePutReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if err := checkContainerConfig(req.Config); err != nil {
+		return badRequest("%v", err)
+	}
+	if err := checkDevices(req.Devices); err != nil {
+		return badRequest("%v", err)
+	}
+	users, err := dbProfileContainers(d.db, name)
+	if err != nil {
+		return profileError(name, "update", err)
+	}
+	var olds []*ContainerInfo
+	for _, user := range users {
+		old, err := d.containerInfo(user)
+		if err != nil {
+			return containerError(user, "inspect", err)
+		}
+		olds = append(olds, old)
+	}
+	err = dbProfileUpdate(d.db, name, req.Config, req.Devices)
+	if err != nil {
+		return profileError(name, "update", err)
+	}
+	for _, old := range olds {
+		d.events.publish("container", &ContainerEvent{Name: old.Name, Action: "configured"})
+		err := d.applyConfig(old)
+		if err != nil {
+			return internalError("profile %q saved, but not applied to container %q: %v", name, old.Name, err)
+		}
+	}
+	return emptySyncResponse
+}
+
+func (d *Daemon) profileDelete(r *http.Request) response {
+	name := profilePath(r)
+	if name == "default" {
+		return errorf(http.StatusForbidden, "the default profile cannot be deleted")
+	}
+	err := dbProfileDelete(d.db, name)
+	if err != nil {
+		return profileError(name, "delete", err)
+	}
+	return emptySyncResponse
+}
@@ -0,0 +1,174 @@
+package flex
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// ResponseType defines the kind of document returned by the daemon.
+type ResponseType string
+
+const (
+	// SyncResponse documents carry the result of a completed request
+	// in their metadata.
+	SyncResponse ResponseType = "sync"
+
+	// AsyncResponse documents report a background operation which was
+	// started to serve the request, with the Operation in their metadata.
+	AsyncResponse ResponseType = "async"
+
+	// ErrorResponse documents report a request that could not be
+	// served, with the reason in their error message.
+	ErrorResponse ResponseType = "error"
+)
+
+// Response is the document returned by every daemon endpoint.
+type Response struct {
+	Type       ResponseType    `json:"type"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Error is returned by the client when the daemon responds to a request
+// with an error document.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// decode unmarshals the response metadata into v. A response without
+// metadata leaves v untouched.
+func (r *Response) decode(v interface{}) error {
+	if len(r.Metadata) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(r.Metadata, v)
+	if err != nil {
+		return fmt.Errorf("cannot parse response metadata: %v", err)
+	}
+	return nil
+}
+
+// parseResponse reads the document in the body of resp, and turns error
+// documents into an *Error.
+func parseResponse(resp *http.Response) (*Response, error) {
+	defer resp.Body.Close()
+
+	var r Response
+	err := json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse daemon response: %v", err)
+	}
+	if r.Type == ErrorResponse {
+		return nil, &Error{StatusCode: r.StatusCode, Message: r.Error}
+	}
+	return &r, nil
+}
+
+type jmap map[string]interface{}
+
+// response is implemented by the values returned from the daemon handlers,
+// and knows how to render itself as a Response document.
+type response interface {
+	render(w http.ResponseWriter) error
+}
+
+type syncResponse struct {
+	metadata interface{}
+}
+
+func (r *syncResponse) render(w http.ResponseWriter) error {
+	return writeResponse(w, http.StatusOK, SyncResponse, r.metadata, "")
+}
+
+// fileResponse serves the content of the file at path, supporting range
+// requests so interrupted downloads may be resumed.
+type fileResponse struct {
+	req      *http.Request
+	path     string
+	filename string
+	headers  map[string]string
+}
+
+func (r *fileResponse) render(w http.ResponseWriter) error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return writeResponse(w, http.StatusInternalServerError, ErrorResponse, nil, err.Error())
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return writeResponse(w, http.StatusInternalServerError, ErrorResponse, nil, err.Error())
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": r.filename}))
+	for key, value := range r.headers {
+		w.Header().Set(key, value)
+	}
+	http.ServeContent(w, r.req, r.filename, fi.ModTime(), f)
+	return nil
+}
+
+type errorResponse struct {
+	code int
+	msg  string
+}
+
+func (r *errorResponse) render(w http.ResponseWriter) error {
+	return writeResponse(w, r.code, ErrorResponse, nil, r.msg)
+}
+
+// emptySyncResponse is returned by handlers which have nothing to report
+// other than success.
+var emptySyncResponse = &syncResponse{}
+
+func errorf(code int, format string, args ...interface{}) response {
+	return &errorResponse{code, fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) response {
+	return errorf(http.StatusBadRequest, format, args...)
+}
+
+func notFound(format string, args ...interface{}) response {
+	return errorf(http.StatusNotFound, format, args...)
+}
+
+func internalError(format string, args ...interface{}) response {
+	return errorf(http.StatusInternalServerError, format, args...)
+}
+
+// marshalErrorDoc is sent in place of responses whose metadata cannot be
+// marshalled, so that clients still get a valid error document.
+var marshalErrorDoc = []byte(`{"type":"error","status":"Internal Server Error","status_code":500,"error":"cannot marshal response metadata"}` + "\n")
+
+func writeResponse(w http.ResponseWriter, code int, t ResponseType, metadata interface{}, msg string) error {
+	doc := Response{
+		Type:       t,
+		Status:     http.StatusText(code),
+		StatusCode: code,
+		Error:      msg,
+	}
+	if metadata != nil {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(marshalErrorDoc)
+			return fmt.Errorf("cannot marshal response metadata: %v", err)
+		}
+		doc.Metadata = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(&doc)
+}
@@ -0,0 +1,249 @@
+package flex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Image servers publish images following the simplestreams format, with
+// streams/v1/index.json listing the products files, which in turn hold the
+// products with their aliases and versions. For example:
+//
+//	{
+//	    "format": "products:1.0",
+//	    "products": {
+//	        "ubuntu:trusty:amd64": {
+//	            "aliases": "ubuntu/trusty/amd64,ubuntu/trusty",
+//	            "os": "ubuntu",
+//	            "release": "trusty",
+//	            "arch": "amd64",
+//	            "versions": {
+//	                "20150601": {
+//	                    "items": {
+//	                        "flex.tar.xz": {
+//	                            "ftype": "flex.tar.xz",
+//	                            "path": "images/ubuntu/trusty/amd64/20150601/flex.tar.xz",
+//	                            "sha256": "5c8b4c38...",
+//	                            "size": 123456789
+//	                        }
+//	                    }
+//	                }
+//	            }
+//	        }
+//	    }
+//	}
+//
+// Items of the flex.tar* file types are image tarballs as imported with
+// "flex image import", so their sha256 is the image fingerprint.
+
+type ssIndex struct {
+	Format string                  `json:"format"`
+	Index  map[string]ssIndexEntry `json:"index"`
+}
+
+type ssIndexEntry struct {
+	DataType string `json:"datatype"`
+	Path     string `json:"path"`
+}
+
+type ssProducts struct {
+	Format   string               `json:"format"`
+	Products map[string]ssProduct `json:"products"`
+}
+
+type ssProduct struct {
+	Aliases  string               `json:"aliases"`
+	Versions map[string]ssVersion `json:"versions"`
+}
+
+type ssVersion struct {
+	Items map[string]ssItem `json:"items"`
+}
+
+type ssItem struct {
+	FileType string `json:"ftype"`
+	Path     string `json:"path"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+}
+
+// ssFileTypes holds the file types of the items which are image tarballs.
+var ssFileTypes = map[string]bool{
+	"flex.tar":     true,
+	"flex.tar.gz":  true,
+	"flex.tar.bz2": true,
+	"flex.tar.xz":  true,
+}
+
+var errNoSuchImageServer = errors.New("no such image server")
+
+// imageServer talks to a server publishing images in the simplestreams
+// format, over http, https or from the local filesystem with file URLs.
+type imageServer struct {
+	name string
+	base *url.URL
+}
+
+// imageServerClient is used to talk to image servers. Image downloads may
+// take a long time, so there's no overall timeout, but servers must accept
+// connections and start responding in time.
+var imageServerClient = func() *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	setImageTimeouts(transport)
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &http.Client{Transport: transport}
+}()
+
+// newImageServer returns the image server with the provided name and
+// address.
+func newImageServer(name string, addr string) (*imageServer, error) {
+	base, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address of image server %q: %v", name, err)
+	}
+	switch base.Scheme {
+	case "http", "https", "file":
+	default:
+		return nil, fmt.Errorf("invalid address of image server %q: unsupported scheme %q", name, base.Scheme)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &imageServer{name, base}, nil
+}
+
+// getJSON decodes into v the JSON document at path, relative to the
+// server address.
+func (s *imageServer) getJSON(path string, v interface{}) error {
+	resp, err := s.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s from image server %q: %v", path, s.name, err)
+	}
+	return nil
+}
+
+// url returns the URL of the file at path, relative to the server address.
+func (s *imageServer) url(path string) (string, error) {
+	ref, err := url.Parse(path)
+	if err != nil || ref.IsAbs() || strings.HasPrefix(ref.Path, "/") {
+		return "", fmt.Errorf("invalid path from image server %q: %q", s.name, path)
+	}
+	return s.base.ResolveReference(ref).String(), nil
+}
+
+// get requests the file at path, relative to the server address.
+func (s *imageServer) get(path string) (*http.Response, error) {
+	u, err := s.url(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := imageServerClient.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach image server %q: %v", s.name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot get %s from image server %q: %s", path, s.name, resp.Status)
+	}
+	return resp, nil
+}
+
+// products returns the image products published by the server.
+func (s *imageServer) products() (map[string]ssProduct, error) {
+	var index ssIndex
+	err := s.getJSON("streams/v1/index.json", &index)
+	if err != nil {
+		return nil, err
+	}
+	products := make(map[string]ssProduct)
+	for _, entry := range index.Index {
+		if entry.DataType != "image-downloads" {
+			continue
+		}
+		var doc ssProducts
+		err := s.getJSON(entry.Path, &doc)
+		if err != nil {
+			return nil, err
+		}
+		for id, product := range doc.Products {
+			products[id] = product
+		}
+	}
+	return products, nil
+}
+
+// find returns the latest version of the image published by the server
+// under the provided alias or product id.
+func (s *imageServer) find(alias string) (*remoteImage, error) {
+	products, err := s.products()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(products))
+	for id := range products {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		product := products[id]
+		if id != alias && !ssHasAlias(product.Aliases, alias) {
+			continue
+		}
+		versions := make([]string, 0, len(product.Versions))
+		for version := range product.Versions {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+		for _, version := range versions {
+			for _, item := range product.Versions[version].Items {
+				if !ssFileTypes[item.FileType] || len(item.SHA256) != 64 || !fingerprintExp.MatchString(item.SHA256) {
+					continue
+				}
+				u, err := s.url(item.Path)
+				if err != nil {
+					return nil, err
+				}
+				return &remoteImage{
+					ref:         s.name + ":" + alias,
+					client:      imageServerClient,
+					url:         u,
+					fingerprint: item.SHA256,
+				}, nil
+			}
+		}
+	}
+	return nil, errNoSuchImage
+}
+
+func ssHasAlias(aliases string, alias string) bool {
+	for _, a := range strings.Split(aliases, ",") {
+		if strings.TrimSpace(a) == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// findRemoteImage returns the image published under alias by the named
+// image server.
+func (d *Daemon) findRemoteImage(server string, alias string) (*remoteImage, error) {
+	addr, ok := d.config.ImageServers[server]
+	if !ok {
+		return nil, errNoSuchImageServer
+	}
+	s, err := newImageServer(server, addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.find(alias)
+}
@@ -0,0 +1,283 @@
+package flex
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SnapshotInfo describes a snapshot of a container, holding its root
+// filesystem along with its profiles, configuration and devices as they
+// were when the snapshot was taken.
+type SnapshotInfo struct {
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"created_at"`
+	Profiles  []string          `json:"profiles"`
+	Config    map[string]string `json:"config"`
+	Devices   map[string]Device `json:"devices"`
+}
+
+// snapshotPath splits the path of a request under
+// /1.0/containers/<name>/snapshots/ into the container name, the snapshot
+// name and the path of the resource within the snapshot, if any.
+func snapshotPath(r *http.Request) (name string, snapshot string, sub string) {
+	name, sub = containerPath(r)
+	elems := strings.SplitN(strings.TrimPrefix(sub, "snapshots/"), "/", 2)
+	if len(elems) == 2 {
+		return name, elems[0], elems[1]
+	}
+	return name, elems[0], ""
+}
+
+// serveSnapshot serves the resources under
+// /1.0/containers/<name>/snapshots/<snapshot>.
+func (d *Daemon) serveSnapshot(r *http.Request) response {
+	name, snapshot, sub := snapshotPath(r)
+	if snapshot == "" {
+		return notFound("missing snapshot name in %s", r.URL.Path)
+	}
+	var res *resource
+	switch sub {
+	case "":
+		res = &resource{get: d.snapshotGet, delete: d.snapshotDelete}
+	case "restore":
+		res = &resource{post: d.snapshotRestore}
+	default:
+		return notFound("unknown resource %q of snapshot %q", sub, name+"/"+snapshot)
+	}
+	return res.serve(r)
+}
+
+// snapshotError returns the error response appropriate for err, which was
+// obtained while trying to perform action on the snapshot of the named
+// container.
+func snapshotError(name string, snapshot string, action string, err error) response {
+	switch err {
+	case ErrNoSuchContainer:
+		return notFound("container %q not found", name)
+	case ErrNoSuchSnapshot:
+		return notFound("snapshot %q not found", name+"/"+snapshot)
+	case errSnapshotExists:
+		return errorf(http.StatusConflict, "snapshot %q already exists", name+"/"+snapshot)
+	}
+	return internalError("cannot %s snapshot %q: %v", action, name+"/"+snapshot, err)
+}
+
+// snapshotInfo returns the details of the snapshot recorded in rec.
+func (d *Daemon) snapshotInfo(rec *snapshotRecord) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{
+		Name:      rec.name,
+		CreatedAt: rec.createdAt,
+	}
+	var err error
+	info.Profiles, err = dbSnapshotProfiles(d.db, rec.id)
+	if err != nil {
+		return nil, err
+	}
+	info.Config, err = dbSnapshotConfig(d.db, rec.id)
+	if err != nil {
+		return nil, err
+	}
+	info.Devices, err = dbSnapshotDevices(d.db, rec.id)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (d *Daemon) containerSnapshotsGet(r *http.Request) response {
+	name, _ := containerPath(r)
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return containerError(name, "inspect", err)
+	}
+	snapshots, err := dbSnapshots(d.db, rec.id)
+	if err != nil {
+		return containerError(name, "inspect", err)
+	}
+	result := []*SnapshotInfo{}
+	for _, snapshot := range snapshots {
+		info, err := d.snapshotInfo(snapshot)
+		if err != nil {
+			return snapshotError(name, snapshot.name, "inspect", err)
+		}
+		result = append(result, info)
+	}
+	return &syncResponse{result}
+}
+
+// containerSnapshotsPostReq holds the name of a snapshot to take. The
+// first unused name in the snap0, snap1, ... sequence is used if it's
+// empty.
+type containerSnapshotsPostReq struct {
+	Name string `json:"name"`
+}
+
+// containerSnapshotsPost takes a snapshot of a container. Running
+// containers are stopped while that happens, and started again
+// afterwards.
+func (d *Daemon) containerSnapshotsPost(r *http.Request) response {
+	name, _ := containerPath(r)
+
+	var req containerSnapshotsPostReq
+	if err := readJSON(r, &req); err != nil {
+		return badRequest("cannot parse request: %v", err)
+	}
+	if strings.Contains(req.Name, "/") {
+		return badRequest("invalid snapshot name %q", req.Name)
+	}
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return containerError(name, "snapshot", err)
+	}
+	if req.Name == "" {
+		req.Name, err = d.unusedSnapshotName(rec)
+		if err != nil {
+			return containerError(name, "snapshot", err)
+		}
+	} else if _, err := dbSnapshot(d.db, rec.id, req.Name); err != ErrNoSuchSnapshot {
+		if err == nil {
+			err = errSnapshotExists
+		}
+		return snapshotError(name, req.Name, "create", err)
+	}
+
+	return d.startOperation(fmt.Sprintf("snapshot %s/%s", name, req.Name), false, func(op *operation) (interface{}, error) {
+		err := d.takeSnapshot(op, rec, req.Name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot snapshot container %q: %v", name, err)
+		}
+		return nil, nil
+	})
+}
+
+// unusedSnapshotName returns the first name in the snap0, snap1, ...
+// sequence which isn't used by a snapshot of the container recorded in
+// rec.
+func (d *Daemon) unusedSnapshotName(rec *containerRecord) (string, error) {
+	snapshots, err := dbSnapshots(d.db, rec.id)
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		used[snapshot.name] = true
+	}
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("snap%d", i)
+		if !used[name] {
+			return name, nil
+		}
+	}
+}
+
+// takeSnapshot takes the named snapshot of the container recorded in rec,
+// stopping it meanwhile if it's running.
+func (d *Daemon) takeSnapshot(op *operation, rec *containerRecord, snapshot string) error {
+	restart, err := d.stopForChange(op, rec.name)
+	if err != nil {
+		return err
+	}
+	defer restart()
+
+	op.progress("taking snapshot")
+	d.beginChange(rec.name)
+	backendName, err := d.backend.Snapshot(rec.name)
+	if err == nil {
+		err = dbSnapshotCreate(d.db, rec.id, snapshot, backendName)
+		if err != nil {
+			if derr := d.backend.DeleteSnapshot(rec.name, backendName); derr != nil {
+				Logf("cannot delete snapshot %s of container %q: %v", backendName, rec.name, derr)
+			}
+		}
+	}
+	d.endChange(rec.name, "snapshotted", err)
+	return err
+}
+
+func (d *Daemon) snapshotGet(r *http.Request) response {
+	name, snapshot, _ := snapshotPath(r)
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return snapshotError(name, snapshot, "inspect", err)
+	}
+	snap, err := dbSnapshot(d.db, rec.id, snapshot)
+	if err != nil {
+		return snapshotError(name, snapshot, "inspect", err)
+	}
+	info, err := d.snapshotInfo(snap)
+	if err != nil {
+		return snapshotError(name, snapshot, "inspect", err)
+	}
+	return &syncResponse{info}
+}
+
+func (d *Daemon) snapshotDelete(r *http.Request) response {
+	name, snapshot, _ := snapshotPath(r)
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return snapshotError(name, snapshot, "delete", err)
+	}
+	snap, err := dbSnapshot(d.db, rec.id, snapshot)
+	if err != nil {
+		return snapshotError(name, snapshot, "delete", err)
+	}
+
+	return d.startOperation(fmt.Sprintf("delete %s/%s", name, snapshot), false, func(op *operation) (interface{}, error) {
+		err := d.backend.DeleteSnapshot(name, snap.backendName)
+		if err == ErrNoSuchSnapshot {
+			// Gone from the backend already.
+			err = nil
+		}
+		if err == nil {
+			err = dbSnapshotDelete(d.db, snap.id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot delete snapshot %q: %v", name+"/"+snapshot, err)
+		}
+		return nil, nil
+	})
+}
+
+// snapshotRestore brings a container back to the state recorded in its
+// snapshot. Running containers are stopped while that happens, and started
+// again afterwards.
+func (d *Daemon) snapshotRestore(r *http.Request) response {
+	name, snapshot, _ := snapshotPath(r)
+	rec, err := dbContainer(d.db, name)
+	if err != nil {
+		return snapshotError(name, snapshot, "restore", err)
+	}
+	snap, err := dbSnapshot(d.db, rec.id, snapshot)
+	if err != nil {
+		return snapshotError(name, snapshot, "restore", err)
+	}
+
+	return d.startOperation(fmt.Sprintf("restore %s/%s", name, snapshot), false, func(op *operation) (interface{}, error) {
+		err := d.restoreSnapshot(op, rec, snap)
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore snapshot %q: %v", name+"/"+snapshot, err)
+		}
+		return nil, nil
+	})
+}
+
+// restoreSnapshot restores the snapshot of the container recorded in rec,
+// stopping the container meanwhile if it's running.
+func (d *Daemon) restoreSnapshot(op *operation, rec *containerRecord, snap *snapshotRecord) error {
+	restart, err := d.stopForChange(op, rec.name)
+	if err != nil {
+		return err
+	}
+	defer restart()
+
+	op.progress("restoring snapshot")
+	d.beginChange(rec.name)
+	err = d.backend.RestoreSnapshot(rec.name, snap.backendName)
+	if err == nil {
+		err = dbSnapshotRestore(d.db, rec.id, snap.id)
+	}
+	d.endChange(rec.name, "restored", err)
+	return err
+}
@@ -0,0 +1,207 @@
+package flex
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketHandler is implemented by operations which exchange data with
+// clients over websockets, connected to at /1.0/operations/<id>/websocket
+// with one of the secrets the operation reports in its metadata.
+type websocketHandler interface {
+	// accepts returns whether secret allows connecting to one of the
+	// websockets of the operation.
+	accepts(secret string) bool
+
+	// connect hands conn to the operation as the websocket for secret.
+	connect(secret string, conn *websocket.Conn) error
+}
+
+// websocketSet is a websocketHandler for a fixed set of websockets, each
+// identified by a name and connected to with its own random secret.
+type websocketSet struct {
+	mu      sync.Mutex
+	secrets map[string]string
+	conns   map[string]*websocket.Conn
+	ready   chan struct{}
+	closed  bool
+}
+
+// newWebsocketSet returns a websocketSet with the provided websocket names.
+func newWebsocketSet(names ...string) (*websocketSet, error) {
+	s := &websocketSet{
+		secrets: make(map[string]string),
+		conns:   make(map[string]*websocket.Conn),
+		ready:   make(chan struct{}),
+	}
+	for _, name := range names {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate websocket secret: %v", err)
+		}
+		s.secrets[name] = hex.EncodeToString(b)
+	}
+	return s, nil
+}
+
+// find returns the name of the websocket which secret allows connecting to.
+func (s *websocketSet) find(secret string) (string, bool) {
+	for name, want := range s.secrets {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(want)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (s *websocketSet) accepts(secret string) bool {
+	_, ok := s.find(secret)
+	return ok
+}
+
+func (s *websocketSet) connect(secret string, conn *websocket.Conn) error {
+	name, ok := s.find(secret)
+	if !ok {
+		return fmt.Errorf("invalid websocket secret")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("websockets closed")
+	}
+	if _, ok := s.conns[name]; ok {
+		return fmt.Errorf("websocket %q already connected", name)
+	}
+	s.conns[name] = conn
+	if len(s.conns) == len(s.secrets) {
+		close(s.ready)
+	}
+	return nil
+}
+
+// websocketTimeout defines for how long operations wait for clients to
+// connect to their websockets.
+var websocketTimeout = 30 * time.Second
+
+// wait blocks until all websockets are connected, and returns them by name.
+// It fails if that takes longer than websocketTimeout, or if op is cancelled
+// or the daemon stops meanwhile.
+func (s *websocketSet) wait(d *Daemon, op *operation) (map[string]*websocket.Conn, error) {
+	select {
+	case <-s.ready:
+	case <-time.After(websocketTimeout):
+		return nil, fmt.Errorf("timed out waiting for websocket connections")
+	case <-op.dying():
+		return nil, errCancelled
+	case <-d.tomb.Dying():
+		return nil, fmt.Errorf("daemon stopped")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, nil
+}
+
+// close closes all websockets connected so far, and refuses further ones.
+func (s *websocketSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// websocketResponse upgrades the connection of the request to a websocket,
+// and hands it to an operation.
+type websocketResponse struct {
+	r      *http.Request
+	op     *operation
+	secret string
+}
+
+func (resp *websocketResponse) render(w http.ResponseWriter) error {
+	conn, err := upgrader.Upgrade(w, resp.r, nil)
+	if err != nil {
+		// The upgrader has responded with the error already.
+		return nil
+	}
+	err = resp.op.sockets.connect(resp.secret, conn)
+	if err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
+	}
+	return nil
+}
+
+func (d *Daemon) operationWebsocket(r *http.Request) response {
+	op, _, errResp := d.operation(r)
+	if errResp != nil {
+		return errResp
+	}
+	if op.sockets == nil {
+		return badRequest("operation %s has no websockets", op.snapshot().ID)
+	}
+	secret := r.FormValue("secret")
+	if !op.sockets.accepts(secret) {
+		return errorf(http.StatusForbidden, "invalid websocket secret")
+	}
+	return &websocketResponse{r, op, secret}
+}
+
+// wsWriteStream sends the data read from r to conn as binary messages,
+// until r reaches EOF or fails.
+func wsWriteStream(conn *websocket.Conn, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// wsCloseStream tells the peer that no more data will be sent on conn.
+func wsCloseStream(conn *websocket.Conn) error {
+	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// wsReadStream writes the data in the binary messages received from conn
+// to w, until the peer closes the stream.
+func wsReadStream(w io.Writer, conn *websocket.Conn) error {
+	for {
+		mt, r, err := conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		_, err = io.Copy(w, r)
+		if err != nil {
+			return err
+		}
+	}
+}